@@ -43,19 +43,18 @@ func (a *Account) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
-	a.Capabilities = make(map[URI]Capability)
-	for key, cap := range capabilities {
-		rawCap, ok := raw.RawCapabilities[key]
-		if !ok {
-			continue
-		}
-		newCap := cap.New()
-		err := json.Unmarshal(rawCap, newCap)
-		if err != nil {
-			return err
-		}
-		a.Capabilities[key] = newCap
-	}
+	var err error
+	a.Capabilities, err = decodeCapabilities(nil, a.RawCapabilities)
+	return err
+}
 
-	return nil
+// MarshalJSON encodes the Account as it was received from the server, in the
+// same way as Session.MarshalJSON
+func (a Account) MarshalJSON() ([]byte, error) {
+	raw, err := encodeCapabilities(a.Capabilities, a.RawCapabilities)
+	if err != nil {
+		return nil, err
+	}
+	a.RawCapabilities = raw
+	return json.Marshal(account(a))
 }
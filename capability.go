@@ -9,7 +9,8 @@ type Capability interface {
 	New() Capability
 }
 
-// Register a Capability
+// Register a Capability. To register a Capability for a single Client, use a
+// Registry
 func RegisterCapability(c Capability) {
 	capabilities[c.URI()] = c
 }
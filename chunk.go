@@ -0,0 +1,403 @@
+package jmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// chunkRequest returns a copy of req where /get calls with more ids than
+// maxObjectsInGet, and /set calls with more objects than maxObjectsInSet, are
+// replaced by several calls which are each within the limit. The call IDs of
+// the chunks of each call are returned, to be used with mergeChunks.
+//
+// Calls which use a result reference for their ids, or whose results are
+// referenced by another call, are never chunked: the reference would only see
+// part of the objects.
+func chunkRequest(req *Request, limits coreLimits) (*Request, map[string][]string, error) {
+	referenced := make(map[string]bool)
+	for _, call := range req.Calls {
+		args, err := toGeneric(call.Args)
+		if err != nil {
+			return nil, nil, err
+		}
+		obj, _ := args.(map[string]interface{})
+		for key, val := range obj {
+			if !strings.HasPrefix(key, "#") {
+				continue
+			}
+			ref := &ResultReference{}
+			if fromGeneric(val, ref) == nil {
+				referenced[ref.ResultOf] = true
+			}
+		}
+	}
+
+	chunked := &Request{
+		Context:    req.Context,
+		Using:      req.Using,
+		CreatedIDs: req.CreatedIDs,
+	}
+	chunks := make(map[string][]string)
+	for _, call := range req.Calls {
+		var calls []*Invocation
+		if !referenced[call.CallID] {
+			var err error
+			switch {
+			case strings.HasSuffix(call.Name, "/get") && limits.MaxObjectsInGet > 0:
+				calls, err = chunkGet(call, int(limits.MaxObjectsInGet))
+			case strings.HasSuffix(call.Name, "/set") && limits.MaxObjectsInSet > 0:
+				calls, err = chunkSet(call, int(limits.MaxObjectsInSet))
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if len(calls) == 0 {
+			chunked.Calls = append(chunked.Calls, call)
+			continue
+		}
+		for _, c := range calls {
+			chunks[call.CallID] = append(chunks[call.CallID], c.CallID)
+		}
+		chunked.Calls = append(chunked.Calls, calls...)
+	}
+	return chunked, chunks, nil
+}
+
+// chunkGet splits a /get call into calls of at most max ids. If the call
+// doesn't need splitting, nil is returned
+func chunkGet(call *Invocation, max int) ([]*Invocation, error) {
+	args, err := toGeneric(call.Args)
+	if err != nil {
+		return nil, err
+	}
+	obj, _ := args.(map[string]interface{})
+	ids, _ := obj["ids"].([]interface{})
+	if len(ids) <= max {
+		return nil, nil
+	}
+	calls := []*Invocation{}
+	for start := 0; start < len(ids); start += max {
+		end := start + max
+		if end > len(ids) {
+			end = len(ids)
+		}
+		chunk := copyArgs(obj)
+		chunk["ids"] = ids[start:end]
+		inv, err := chunkInvocation(call, len(calls), chunk)
+		if err != nil {
+			return nil, err
+		}
+		calls = append(calls, inv)
+	}
+	return calls, nil
+}
+
+// chunkSet splits a /set call into calls of at most max objects to create,
+// update or destroy. If the call doesn't need splitting, nil is returned.
+//
+// Objects to create which refer to each other by creation id are kept in the
+// same chunk. If there are more than max of them, the call isn't split.
+//
+// If the call has an ifInState argument, only the first chunk is sent with it.
+// Each later chunk references the newState of the chunk before it instead, so
+// it fails with an invalidResultReference error if an earlier chunk failed.
+// Without ifInState, the chunks are independent, as the objects of a single
+// call are
+func chunkSet(call *Invocation, max int) ([]*Invocation, error) {
+	args, err := toGeneric(call.Args)
+	if err != nil {
+		return nil, err
+	}
+	obj, _ := args.(map[string]interface{})
+	for key := range obj {
+		// EmailSubmission/set refers to the objects of the call in
+		// its onSuccess arguments, these can't be split
+		if strings.HasPrefix(key, "onSuccess") {
+			return nil, nil
+		}
+	}
+	create, _ := obj["create"].(map[string]interface{})
+	update, _ := obj["update"].(map[string]interface{})
+	destroy, _ := obj["destroy"].([]interface{})
+	if len(create)+len(update)+len(destroy) <= max {
+		return nil, nil
+	}
+
+	// The objects to create, update or destroy, in the order they are
+	// added to chunks. The ops of a group are always added to the same chunk
+	type op struct {
+		key   string
+		id    string
+		value interface{}
+	}
+	groups := [][]op{}
+	for _, cids := range createGroups(create) {
+		if len(cids) > max {
+			return nil, nil
+		}
+		group := []op{}
+		for _, k := range cids {
+			group = append(group, op{key: "create", id: k, value: create[k]})
+		}
+		groups = append(groups, group)
+	}
+	for _, k := range sortedKeys(update) {
+		groups = append(groups, []op{{key: "update", id: k, value: update[k]}})
+	}
+	for _, id := range destroy {
+		groups = append(groups, []op{{key: "destroy", value: id}})
+	}
+	chunkOps := [][]op{}
+	for _, group := range groups {
+		last := len(chunkOps) - 1
+		if last < 0 || len(chunkOps[last])+len(group) > max {
+			chunkOps = append(chunkOps, nil)
+			last++
+		}
+		chunkOps[last] = append(chunkOps[last], group...)
+	}
+
+	_, hasState := obj["ifInState"]
+	if _, ok := obj["#ifInState"]; ok {
+		hasState = true
+	}
+	calls := []*Invocation{}
+	for _, ops := range chunkOps {
+		chunk := copyArgs(obj)
+		delete(chunk, "create")
+		delete(chunk, "update")
+		delete(chunk, "destroy")
+		if len(calls) > 0 && hasState {
+			delete(chunk, "ifInState")
+			chunk["#ifInState"] = &ResultReference{
+				ResultOf: calls[len(calls)-1].CallID,
+				Name:     call.Name,
+				Path:     "/newState",
+			}
+		}
+		for _, o := range ops {
+			if o.key == "destroy" {
+				d, _ := chunk["destroy"].([]interface{})
+				chunk["destroy"] = append(d, o.value)
+				continue
+			}
+			m, ok := chunk[o.key].(map[string]interface{})
+			if !ok {
+				m = make(map[string]interface{})
+				chunk[o.key] = m
+			}
+			m[o.id] = o.value
+		}
+		inv, err := chunkInvocation(call, len(calls), chunk)
+		if err != nil {
+			return nil, err
+		}
+		calls = append(calls, inv)
+	}
+	return calls, nil
+}
+
+// createGroups groups the creation ids of the objects to create, so objects
+// which refer to each other by creation id ("#" followed by the creation id, as
+// a value or a key) are in the same group. Groups are ordered by their first
+// creation id, and the ids in a group sorted
+func createGroups(create map[string]interface{}) [][]string {
+	cids := sortedKeys(create)
+	// The creation id each one is grouped with
+	parent := make(map[string]string, len(cids))
+	var find func(cid string) string
+	find = func(cid string) string {
+		if parent[cid] == cid {
+			return cid
+		}
+		parent[cid] = find(parent[cid])
+		return parent[cid]
+	}
+	for _, cid := range cids {
+		parent[cid] = cid
+	}
+	for _, cid := range cids {
+		for _, ref := range creationRefs(create[cid]) {
+			if _, ok := create[ref]; ok {
+				parent[find(ref)] = find(cid)
+			}
+		}
+	}
+	groups := [][]string{}
+	index := make(map[string]int)
+	for _, cid := range cids {
+		root := find(cid)
+		i, ok := index[root]
+		if !ok {
+			i = len(groups)
+			index[root] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], cid)
+	}
+	return groups
+}
+
+// creationRefs returns the creation ids referred to in v, a generic JSON value
+func creationRefs(v interface{}) []string {
+	refs := []string{}
+	switch val := v.(type) {
+	case string:
+		if strings.HasPrefix(val, "#") {
+			refs = append(refs, val[1:])
+		}
+	case map[string]interface{}:
+		for k, item := range val {
+			if strings.HasPrefix(k, "#") {
+				refs = append(refs, k[1:])
+			}
+			refs = append(refs, creationRefs(item)...)
+		}
+	case []interface{}:
+		for _, item := range val {
+			refs = append(refs, creationRefs(item)...)
+		}
+	}
+	return refs
+}
+
+func chunkInvocation(call *Invocation, i int, args map[string]interface{}) (*Invocation, error) {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	return &Invocation{
+		Name:   call.Name,
+		Args:   json.RawMessage(data),
+		CallID: chunkID(call, i),
+	}, nil
+}
+
+// chunkID returns the call ID of the i-th chunk of call
+func chunkID(call *Invocation, i int) string {
+	return fmt.Sprintf("%s.%d", call.CallID, i)
+}
+
+func copyArgs(args map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(args))
+	for k, v := range args {
+		c[k] = v
+	}
+	return c
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mergeChunks merges the responses to the chunks of each call back into a
+// single response with the call ID of the original call. The responses to
+// each chunk are merged in order: lists are concatenated and maps combined.
+// If any chunk failed, its error is included as an additional response with
+// the original call ID after the merged response of the chunks which
+// succeeded.
+func mergeChunks(resp *Response, chunks map[string][]string) {
+	if len(chunks) == 0 {
+		return
+	}
+	// The call ID each chunk belongs to
+	original := make(map[string]string)
+	for callID, ids := range chunks {
+		for _, id := range ids {
+			original[id] = callID
+		}
+	}
+
+	responses := []*Invocation{}
+	seen := make(map[string]bool)
+	merged := make(map[string][]*Invocation)
+	errs := make(map[string][]*Invocation)
+	for _, inv := range resp.Responses {
+		callID, ok := original[inv.CallID]
+		if !ok {
+			responses = append(responses, inv)
+			continue
+		}
+		inv.CallID = callID
+		if !seen[callID] {
+			// Placeholder for the merged responses, filled in below
+			seen[callID] = true
+			responses = append(responses, &Invocation{CallID: callID})
+		}
+		if inv.Name == "error" {
+			errs[callID] = append(errs[callID], inv)
+			continue
+		}
+		found := false
+		for _, m := range merged[callID] {
+			if m.Name == inv.Name && mergeResponse(m.Args, inv.Args) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged[callID] = append(merged[callID], inv)
+		}
+	}
+
+	resp.Responses = []*Invocation{}
+	for _, inv := range responses {
+		if inv.Name != "" {
+			resp.Responses = append(resp.Responses, inv)
+			continue
+		}
+		resp.Responses = append(resp.Responses, merged[inv.CallID]...)
+		resp.Responses = append(resp.Responses, errs[inv.CallID]...)
+	}
+}
+
+// mergeResponse merges the response src into dst, which must both be pointers
+// to the same struct type. Fields are merged according to their JSON name, as
+// defined for the standard /get and /set responses. It reports whether the
+// responses could be merged
+func mergeResponse(dst interface{}, src interface{}) bool {
+	dv := reflect.ValueOf(dst)
+	sv := reflect.ValueOf(src)
+	if dv.Type() != sv.Type() || dv.Kind() != reflect.Pointer || dv.Elem().Kind() != reflect.Struct {
+		return false
+	}
+	dv = dv.Elem()
+	sv = sv.Elem()
+	for i := 0; i < dv.NumField(); i++ {
+		name, _, _ := strings.Cut(dv.Type().Field(i).Tag.Get("json"), ",")
+		df := dv.Field(i)
+		sf := sv.Field(i)
+		if !df.CanSet() {
+			continue
+		}
+		switch name {
+		case "list", "notFound", "destroyed":
+			if df.Kind() == reflect.Slice {
+				df.Set(reflect.AppendSlice(df, sf))
+			}
+		case "created", "updated", "notCreated", "notUpdated", "notDestroyed":
+			if df.Kind() != reflect.Map || sf.Len() == 0 {
+				continue
+			}
+			if df.IsNil() {
+				df.Set(reflect.MakeMap(df.Type()))
+			}
+			iter := sf.MapRange()
+			for iter.Next() {
+				df.SetMapIndex(iter.Key(), iter.Value())
+			}
+		case "state", "newState":
+			df.Set(sf)
+		}
+	}
+	return true
+}
@@ -0,0 +1,210 @@
+package jmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testObject struct {
+	ID ID `json:"id"`
+}
+
+type testGetResponse struct {
+	Account  ID            `json:"accountId,omitempty"`
+	State    string        `json:"state,omitempty"`
+	List     []*testObject `json:"list,omitempty"`
+	NotFound []ID          `json:"notFound,omitempty"`
+}
+
+type testChunkSetResponse struct {
+	OldState     string             `json:"oldState,omitempty"`
+	NewState     string             `json:"newState,omitempty"`
+	Created      map[ID]*testObject `json:"created,omitempty"`
+	Updated      map[ID]*testObject `json:"updated,omitempty"`
+	Destroyed    []ID               `json:"destroyed,omitempty"`
+	NotDestroyed map[ID]*SetError   `json:"notDestroyed,omitempty"`
+}
+
+func newChunkTestServer(t *testing.T, maxObjects int) *testServer {
+	RegisterMethod("Chunk/get", func() MethodResponse { return &testGetResponse{} })
+	RegisterMethod("Chunk/set", func() MethodResponse { return &testChunkSetResponse{} })
+	ts := newTestServer(t)
+	ts.session["capabilities"].(map[string]interface{})["urn:ietf:params:jmap:core"] = map[string]interface{}{
+		"maxObjectsInGet": maxObjects,
+		"maxObjectsInSet": maxObjects,
+	}
+	state := 0
+	ts.handlers = map[string]func(args map[string]interface{}) (string, interface{}){
+		"Chunk/get": func(args map[string]interface{}) (string, interface{}) {
+			resp := &testGetResponse{
+				Account: ID(args["accountId"].(string)),
+				State:   fmt.Sprintf("%d", state),
+			}
+			for _, id := range args["ids"].([]interface{}) {
+				if id == "missing" {
+					resp.NotFound = append(resp.NotFound, ID(id.(string)))
+					continue
+				}
+				resp.List = append(resp.List, &testObject{ID: ID(id.(string))})
+			}
+			return "Chunk/get", resp
+		},
+		"Chunk/set": func(args map[string]interface{}) (string, interface{}) {
+			if ifInState, ok := args["ifInState"]; ok && ifInState != fmt.Sprintf("%d", state) {
+				return "error", &MethodError{Type: "stateMismatch"}
+			}
+			resp := &testChunkSetResponse{
+				OldState: fmt.Sprintf("%d", state),
+			}
+			if create, ok := args["create"].(map[string]interface{}); ok {
+				resp.Created = make(map[ID]*testObject)
+				for cid := range create {
+					resp.Created[ID(cid)] = &testObject{ID: ID("id-" + cid)}
+				}
+			}
+			if update, ok := args["update"].(map[string]interface{}); ok {
+				resp.Updated = make(map[ID]*testObject)
+				for id := range update {
+					resp.Updated[ID(id)] = nil
+				}
+			}
+			if destroy, ok := args["destroy"].([]interface{}); ok {
+				for _, id := range destroy {
+					if id == "missing" {
+						resp.NotDestroyed = map[ID]*SetError{"missing": {Type: "notFound"}}
+						continue
+					}
+					resp.Destroyed = append(resp.Destroyed, ID(id.(string)))
+				}
+			}
+			state += 1
+			resp.NewState = fmt.Sprintf("%d", state)
+			return "Chunk/set", resp
+		},
+	}
+	return ts
+}
+
+func TestClientChunkGet(t *testing.T) {
+	assert := assert.New(t)
+	ts := newChunkTestServer(t, 2)
+	client := ts.client()
+	client.ChunkCalls = true
+
+	req := &Request{}
+	req.Invoke(&testRawMethod{
+		name: "Chunk/get",
+		args: map[string]interface{}{
+			"accountId": "A1",
+			"ids":       []string{"a", "b", "missing", "c", "d"},
+		},
+	})
+	req.Invoke(&testMethod{Hello: "world"})
+
+	resp, err := client.Do(req)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal([]int{4}, ts.requestCalls)
+	if !assert.Equal(2, len(resp.Responses)) {
+		return
+	}
+	assert.Equal("0", resp.Responses[0].CallID)
+	get := resp.Responses[0].Args.(*testGetResponse)
+	assert.Equal(ID("A1"), get.Account)
+	ids := []ID{}
+	for _, obj := range get.List {
+		ids = append(ids, obj.ID)
+	}
+	assert.Equal([]ID{"a", "b", "c", "d"}, ids)
+	assert.Equal([]ID{"missing"}, get.NotFound)
+	assert.Equal("1", resp.Responses[1].CallID)
+}
+
+func TestClientChunkSet(t *testing.T) {
+	assert := assert.New(t)
+	ts := newChunkTestServer(t, 2)
+	client := ts.client()
+	client.ChunkCalls = true
+
+	req := &Request{}
+	req.Invoke(&testRawMethod{
+		name: "Chunk/set",
+		args: map[string]interface{}{
+			"accountId": "A1",
+			"ifInState": "0",
+			"create": map[string]interface{}{
+				"k1": map[string]interface{}{},
+				"k2": map[string]interface{}{},
+			},
+			"update": map[string]interface{}{
+				"u1": map[string]interface{}{},
+			},
+			"destroy": []string{"d1", "missing"},
+		},
+	})
+
+	resp, err := client.Do(req)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal([]int{3}, ts.requestCalls)
+	if !assert.Equal(1, len(resp.Responses)) {
+		return
+	}
+	set := resp.Responses[0].Args.(*testChunkSetResponse)
+	assert.Equal("0", set.OldState)
+	assert.Equal("3", set.NewState)
+	assert.Equal(map[ID]*testObject{"k1": {ID: "id-k1"}, "k2": {ID: "id-k2"}}, set.Created)
+	assert.Equal(map[ID]*testObject{"u1": nil}, set.Updated)
+	assert.Equal([]ID{"d1"}, set.Destroyed)
+	assert.Equal(map[ID]*SetError{"missing": {Type: "notFound"}}, set.NotDestroyed)
+
+	// A state mismatch in the first chunk stops the others
+	resp, err = client.Do(req)
+	if !assert.NoError(err) {
+		return
+	}
+	if !assert.Equal(3, len(resp.Responses)) {
+		return
+	}
+	for _, inv := range resp.Responses {
+		assert.Equal("0", inv.CallID)
+	}
+	assert.Equal("stateMismatch", resp.Responses[0].Args.(*MethodError).Type)
+	assert.Equal("invalidResultReference", resp.Responses[1].Args.(*MethodError).Type)
+}
+
+func TestChunkSet(t *testing.T) {
+	assert := assert.New(t)
+	call := &Invocation{
+		Name: "Chunk/set",
+		Args: map[string]interface{}{
+			"accountId": "A1",
+			"create": map[string]interface{}{
+				"a": map[string]interface{}{},
+				"b": map[string]interface{}{"name": "b"},
+				"c": map[string]interface{}{"parentId": "#a"},
+				"d": map[string]interface{}{"mailboxIds": map[string]bool{"#c": true}},
+			},
+			"destroy": []string{"d1"},
+		},
+		CallID: "0",
+	}
+	calls, err := chunkSet(call, 3)
+	if !assert.NoError(err) || !assert.Equal(2, len(calls)) {
+		return
+	}
+	// The objects which refer to each other are created together, and the
+	// chunks don't check the state as the call doesn't
+	assert.JSONEq(`{"accountId":"A1","create":{"a":{},"c":{"parentId":"#a"},"d":{"mailboxIds":{"#c":true}}}}`, string(calls[0].Args.(json.RawMessage)))
+	assert.JSONEq(`{"accountId":"A1","create":{"b":{"name":"b"}},"destroy":["d1"]}`, string(calls[1].Args.(json.RawMessage)))
+
+	// Unless there are too many of them
+	calls, err = chunkSet(call, 2)
+	assert.NoError(err)
+	assert.Nil(calls)
+}
@@ -7,10 +7,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
+	"mime"
 	"net/http"
-	"strings"
+	"sort"
 	"sync"
 
+	"git.sr.ht/~rockorager/go-jmap/internal/uritemplate"
 	"golang.org/x/oauth2"
 )
 
@@ -28,6 +31,65 @@ type Client struct {
 
 	// the JMAP Session object
 	Session *Session
+
+	// OnSessionChange, if set, is called after the Session object has been
+	// refetched because a Response reported a different session state. It
+	// is called from its own goroutine
+	OnSessionChange func(*SessionChange)
+
+	// If true, /get calls with more ids than the server accepts in a single
+	// call (maxObjectsInGet) and /set calls with more objects to create,
+	// update or destroy than it accepts (maxObjectsInSet) are split into
+	// several calls by Do. The responses to these calls are merged into a
+	// single response to the original call. See Do for details
+	ChunkCalls bool
+
+	// The policy for retrying requests which fail with a transient error.
+	// If nil, requests are not retried. API requests are only retried if
+	// they are idempotent: a request with /set, /copy, /import or /send
+	// calls is never retried, unless each of these calls has an ifInState
+	// argument which isn't a result reference. Uploads are only retried if the blob is an io.Seeker, or
+	// one of the types http.NewRequest knows how to replay (eg
+	// *bytes.Reader)
+	Retry *RetryPolicy
+
+	// The Registry used to decode the Session object and responses. If
+	// nil, only the methods and capabilities registered globally are used
+	Registry *Registry
+
+	// SessionStore, if set, caches the Session object. When the Client
+	// needs a Session and doesn't have one, it uses the stored Session
+	// rather than fetching it. As with any Session, it is refetched once
+	// a Response reports a different session state. The Session is stored
+	// each time it is fetched. Errors loading or storing the Session are
+	// ignored: the Session is fetched as if there were no store
+	SessionStore SessionStore
+
+	// Middleware which Requests made with Do are passed through, in order.
+	// The Request they see has its Context set, and is the one passed to
+	// Do: they run before the Session is fetched, capabilities are
+	// checked and calls are split. See Use
+	Middleware []Middleware
+
+	// Logger, if set, logs the requests made with Do, after they have
+	// passed through the Middleware (see LogRequests), and fetches of the
+	// Session object. Sensitive values are redacted by RedactRules
+	Logger *slog.Logger
+
+	// The rules to redact logged values with. If nil, DefaultRedactRules
+	// are used
+	RedactRules []RedactRule
+
+	// Whether a Session refetch is in progress
+	refreshing bool
+
+	// Limit the number of concurrent requests to the API and upload
+	// endpoints to the maxConcurrentRequests and maxConcurrentUpload
+	// limits of the Session
+	requests limiter
+	uploads  limiter
+	// The Session the limits were last set from
+	limitsSession *Session
 }
 
 // Set the HttpClient to a client which authenticates using the provided
@@ -61,78 +123,285 @@ func (c *Client) WithAccessToken(token string) *Client {
 // Authenticate will be called automatically when Do is called if the Session
 // object hasn't already been initialized. Call Authenticate before any requests
 // if you need to access information from the Session object prior to the first
-// request
+// request. Authenticate always fetches the Session object, even if a
+// SessionStore is set
 func (c *Client) Authenticate() error {
+	return c.AuthenticateWithContext(context.Background())
+}
+
+// AuthenticateWithContext is like Authenticate, but fetches the Session object
+// with the given context
+func (c *Client) AuthenticateWithContext(ctx context.Context) error {
+	s, err := c.fetchSession(ctx)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	c.Session = s
+	c.Unlock()
+	c.storeSession(s)
+	return nil
+}
+
+// EnsureSession returns the Session object of the Client. If the Client
+// doesn't have one yet, it is loaded from the SessionStore or, if none is
+// stored, fetched as with AuthenticateWithContext
+func (c *Client) EnsureSession(ctx context.Context) (*Session, error) {
+	return c.session(ctx)
+}
+
+// loadSession returns the Session from the SessionStore, or nil if there is
+// none. Its capabilities are decoded again with the Registry of the Client, in
+// a copy of the Session since the store may share it with other Clients
+func (c *Client) loadSession() *Session {
+	if c.SessionStore == nil {
+		return nil
+	}
+	stored, err := c.SessionStore.Load()
+	if err != nil {
+		c.log(context.Background(), slog.LevelWarn, "jmap session store load failed", slog.Any("error", err))
+		return nil
+	}
+	if stored == nil {
+		return nil
+	}
+	if c.Registry == nil {
+		return stored
+	}
+	s := *stored
+	s.Capabilities, err = decodeCapabilities(c.Registry, s.RawCapabilities)
+	if err != nil {
+		c.log(context.Background(), slog.LevelWarn, "jmap session store load failed", slog.Any("error", err))
+		return nil
+	}
+	s.Accounts = make(map[ID]Account, len(stored.Accounts))
+	for id, acct := range stored.Accounts {
+		acct.Capabilities, err = decodeCapabilities(c.Registry, acct.RawCapabilities)
+		if err != nil {
+			c.log(context.Background(), slog.LevelWarn, "jmap session store load failed", slog.Any("error", err))
+			return nil
+		}
+		s.Accounts[id] = acct
+	}
+	return &s
+}
+
+// storeSession stores the Session in the SessionStore
+func (c *Client) storeSession(s *Session) {
+	if c.SessionStore == nil {
+		return
+	}
+	if err := c.SessionStore.Store(s); err != nil {
+		c.log(context.Background(), slog.LevelWarn, "jmap session store failed", slog.Any("error", err))
+	}
+}
+
+// fetchSession retrieves the Session object from the SessionEndpoint
+func (c *Client) fetchSession(ctx context.Context) (*Session, error) {
 	c.Lock()
 	if c.SessionEndpoint == "" {
 		c.Unlock()
-		return fmt.Errorf("no session url is set")
+		return nil, fmt.Errorf("no session url is set")
 	}
 	c.Unlock()
 
-	req, err := http.NewRequest("GET", c.SessionEndpoint, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", c.SessionEndpoint, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	resp, err := c.HttpClient.Do(req)
+	resp, err := c.send(req, true)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("couldn't authenticate")
+		return nil, fmt.Errorf("couldn't authenticate: %s", resp.Status)
 	}
 
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	s := &Session{}
-	err = json.Unmarshal(data, s)
+	err = c.Registry.UnmarshalSession(data, s)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	c.log(ctx, slog.LevelDebug, "jmap session fetched", slog.String("sessionState", s.State))
+	return s, nil
+}
+
+// session returns the current Session object, authenticating first if it
+// hasn't been initialized
+func (c *Client) session(ctx context.Context) (*Session, error) {
+	c.Lock()
+	s := c.Session
+	c.Unlock()
+	if s == nil {
+		s = c.loadSession()
+	}
+	if s != nil {
+		c.Lock()
+		if c.Session == nil {
+			c.Session = s
+		}
+		c.Unlock()
+	} else if err := c.AuthenticateWithContext(ctx); err != nil {
+		return nil, err
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.limitsSession != c.Session {
+		// The Session has been replaced since the limits were set
+		limits := c.Session.limits()
+		c.requests.setLimit(int(limits.MaxConcurrentRequests))
+		c.uploads.setLimit(int(limits.MaxConcurrentUpload))
+		c.limitsSession = c.Session
+	}
+	return c.Session, nil
+}
+
+// CheckSessionState compares state, as returned in the SessionState of a
+// Response, to the state of the current Session object. If they differ the
+// Session is refetched in the background and OnSessionChange is called once it
+// has been replaced. Do calls CheckSessionState automatically; it only needs
+// to be called for responses received by other means
+func (c *Client) CheckSessionState(state string) {
+	c.Lock()
+	defer c.Unlock()
+	if state == "" || c.Session == nil || c.Session.State == state {
+		return
+	}
+	if c.refreshing {
+		return
+	}
+	c.refreshing = true
+	go c.refreshSession()
+}
+
+// refreshSession refetches the Session object and reports any changes to
+// OnSessionChange
+func (c *Client) refreshSession() {
+	s, err := c.fetchSession(context.Background())
+	c.Lock()
+	c.refreshing = false
+	if err != nil {
+		// Keep the stale Session: the next response with a differing
+		// state will trigger another attempt
+		c.Unlock()
+		c.log(context.Background(), slog.LevelWarn, "jmap session refresh failed", slog.Any("error", err))
+		return
+	}
+	old := c.Session
 	c.Session = s
-	return nil
+	onChange := c.OnSessionChange
+	c.Unlock()
+	c.storeSession(s)
+
+	// Apply any changed limits
+	c.session(context.Background())
+
+	if onChange != nil {
+		onChange(diffSessions(old, s))
+	}
 }
 
-// Do performs a JMAP request and returns the response
+// Do performs a JMAP request and returns the response. If the request has more
+// calls than the server accepts in a single request (the maxCallsInRequest
+// limit of the core capability), it is split into several requests which are
+// sent in order. Result references and creation ids which refer to calls in an
+// earlier request are replaced with their values, and a single Response is
+// returned.
+//
+// If ChunkCalls is set, /get and /set calls are also split to fit the
+// maxObjectsInGet and maxObjectsInSet limits. Their responses are merged: lists
+// are concatenated and maps of created, updated and failed objects combined.
+// If any part of a call fails, the MethodError is returned as an additional
+// response with the same call ID, following the merged response of the parts
+// which succeeded. If a /set call has an ifInState argument, its later parts
+// are only performed if the earlier parts succeeded. Objects to create which
+// refer to each other by creation id are sent in the same part. Calls which use
+// a result reference for their ids, or whose results are referenced by another
+// call, are not split.
+//
+// No more than maxConcurrentRequests requests are made to the API endpoint at
+// once, across all calls to Do. Do blocks until the request can be made, or
+// the Context of the request is done. The Context is also used to fetch the
+// Session object, if the Client hasn't been authenticated yet.
+//
+// The Request is passed through the Middleware of the Client before any of
+// this happens
 func (c *Client) Do(req *Request) (*Response, error) {
+	if req.Context == nil {
+		req.Context = context.Background()
+	}
 	c.Lock()
-	if c.Session == nil {
-		c.Unlock()
-		err := c.Authenticate()
-		if err != nil {
-			return nil, err
-		}
+	middleware := c.Middleware
+	if c.Logger != nil {
+		middleware = append(middleware[:len(middleware):len(middleware)], LogRequests(c.Logger, c.RedactRules...))
 	}
 	c.Unlock()
+	return Chain(c.roundTrip, middleware...)(req)
+}
+
+// roundTrip performs a Request once it has passed through the Middleware
+func (c *Client) roundTrip(req *Request) (*Response, error) {
+	if req.Context == nil {
+		req.Context = context.Background()
+	}
+	session, err := c.session(req.Context)
+	if err != nil {
+		return nil, err
+	}
 	// Check the required capabilities before making the request
 	for _, uri := range req.Using {
-		c.Lock()
-		_, ok := c.Session.Capabilities[uri]
-		c.Unlock()
-		if !ok {
+		if _, ok := session.Capabilities[uri]; !ok {
 			return nil, fmt.Errorf("server doesn't support required capability '%s'", uri)
 		}
 	}
+	limits := session.limits()
+	var chunks map[string][]string
+	if c.ChunkCalls {
+		req, chunks, err = chunkRequest(req, limits)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var resp *Response
+	max := limits.MaxCallsInRequest
+	if max > 0 && uint64(len(req.Calls)) > max {
+		resp, err = c.doSplit(req, session, int(max))
+	} else {
+		resp, err = c.do(req, session)
+	}
+	if err != nil {
+		return nil, err
+	}
+	mergeChunks(resp, chunks)
+	return resp, nil
+}
+
+// do performs a single HTTP request to the API endpoint. It waits until fewer
+// than maxConcurrentRequests requests are in progress before starting
+func (c *Client) do(req *Request, session *Session) (*Response, error) {
 	body, err := json.Marshal(req)
 	if err != nil {
 		return nil, err
 	}
-	if req.Context == nil {
-		req.Context = context.Background()
+	if err := c.requests.acquire(req.Context); err != nil {
+		return nil, err
 	}
-	httpReq, err := http.NewRequestWithContext(req.Context, "POST", c.Session.APIURL, bytes.NewReader(body))
+	defer c.requests.release()
+	httpReq, err := http.NewRequestWithContext(req.Context, "POST", session.APIURL, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
 
-	httpResp, err := c.HttpClient.Do(httpReq)
+	httpResp, err := c.send(httpReq, req.idempotent())
 	if err != nil {
 		return nil, err
 	}
@@ -143,12 +412,13 @@ func (c *Client) Do(req *Request) (*Response, error) {
 	}
 
 	resp := &Response{}
-	dec := json.NewDecoder(httpReq.Body)
-	err = dec.Decode(resp)
+	err = c.Registry.DecodeResponse(httpResp.Body, resp)
 	if err != nil {
 		return nil, fmt.Errorf("error? %v", err)
 	}
 
+	c.CheckSessionState(resp.SessionState)
+
 	return resp, nil
 }
 
@@ -159,96 +429,61 @@ func (c *Client) Do(req *Request) (*Response, error) {
 // - Server may return the same blob ID for multiple uploads of the same blob.
 // - Blob ID may become invalid after some time if it is unused.
 // - Blob ID is usable only by the uploader until it is used, even for shared accounts.
+//
+// Upload waits until fewer than maxConcurrentUpload uploads are in progress
+// before starting. Blobs larger than maxSizeUpload are rejected with an
+// *UploadTooLargeError. The blob is sent with the media type
+// application/octet-stream; use UploadWithOptions to set its type.
 func (c *Client) Upload(accountID ID, blob io.Reader) (*UploadResponse, error) {
-	c.Lock()
-	if c.SessionEndpoint == "" {
-		c.Unlock()
-		return nil, fmt.Errorf("jmap/client: SessionEndpoint is empty")
-	}
-	if c.Session == nil {
-		c.Unlock()
-		err := c.Authenticate()
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	url := strings.ReplaceAll(c.Session.UploadURL, "{accountId}", string(accountID))
-	c.Unlock()
-	req, err := http.NewRequest("POST", url, blob)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := c.HttpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return nil, decodeHttpError(resp)
-	}
-
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	info := &UploadResponse{}
-	err = json.Unmarshal(data, info)
-	if err != nil {
-		return nil, err
-	}
+	return c.UploadWithContext(context.Background(), accountID, blob)
+}
 
-	return info, nil
+// UploadWithContext is like Upload, but makes the request with the given
+// context. Cancelling the context aborts the upload, including while it is
+// waiting for another upload to finish
+func (c *Client) UploadWithContext(ctx context.Context, accountID ID, blob io.Reader) (*UploadResponse, error) {
+	return c.UploadWithOptions(ctx, accountID, blob, nil)
 }
 
-// Download downloads binary data by its Blob ID from the server.
+// Download downloads binary data by its Blob ID from the server. Use
+// DownloadWithOptions to set the name and type of the file, download a range
+// of the blob, or retrieve its metadata.
 func (c *Client) Download(accountID ID, blobID ID) (io.ReadCloser, error) {
-	c.Lock()
-	if c.SessionEndpoint == "" {
-		c.Unlock()
-		return nil, fmt.Errorf("jmap/client: SessionEndpoint is empty")
-	}
-	if c.Session == nil {
-		c.Unlock()
-		err := c.Authenticate()
-		if err != nil {
-			return nil, err
-		}
-	}
+	return c.DownloadWithContext(context.Background(), accountID, blobID)
+}
 
-	urlRepl := strings.NewReplacer(
-		"{accountId}", string(accountID),
-		"{blobId}", string(blobID),
-		"{type}", "application/octet-stream",
-		"{name}", "filename",
-	)
-	tgtUrl := urlRepl.Replace(c.Session.DownloadURL)
-	c.Unlock()
-	req, err := http.NewRequest("GET", tgtUrl, nil)
+// DownloadWithContext is like Download, but makes the request with the given
+// context. The context also applies to reading the returned body
+func (c *Client) DownloadWithContext(ctx context.Context, accountID ID, blobID ID) (io.ReadCloser, error) {
+	resp, err := c.DownloadWithOptions(ctx, accountID, blobID, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	return resp.Body, nil
+}
 
-	resp, err := c.HttpClient.Do(req)
-	if err != nil {
-		return nil, err
+// expandURL expands a URL template of the Session with vars. As required by
+// RFC 8620, each of the variables must be in the template
+func expandURL(template string, vars map[string]string) (string, error) {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
 	}
-	if resp.StatusCode != 200 {
-		defer resp.Body.Close()
-		return nil, decodeHttpError(resp)
+	sort.Strings(names)
+	if err := uritemplate.Require(template, names...); err != nil {
+		return "", err
 	}
-
-	return resp.Body, nil
+	return uritemplate.Expand(template, vars)
 }
 
+// decodeHttpError returns the error of a response with a status other than
+// 200. Request-level errors are decoded to a RequestError, other errors are
+// described by their status
 func decodeHttpError(resp *http.Response) error {
-	contentType := resp.Header.Get("Content-Type")
-	if contentType != "application/json" {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/problem+json", "application/json":
+	default:
 		return fmt.Errorf("HTTP %d %s", resp.StatusCode, resp.Status)
 	}
 
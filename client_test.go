@@ -0,0 +1,311 @@
+package jmap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testServer is a minimal JMAP server. The API endpoint echoes each
+// Test/method call back as its response
+type testServer struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	// The session object served from the session endpoint
+	session map[string]interface{}
+	// The sessionState returned in API responses
+	sessionState string
+	// The number of times the session endpoint was fetched
+	sessionFetches int
+	// The number of calls in each request to the API endpoint
+	requestCalls []int
+	// The number of requests to the API and upload endpoints to fail with
+	// a 503 status before succeeding
+	failures int
+	// The number of requests to the API and upload endpoints, including
+	// failed ones
+	attempts int
+	// Handlers for methods which aren't echoed. Result references in the
+	// arguments are resolved before they are called
+	handlers map[string]func(args map[string]interface{}) (string, interface{})
+	// The URLs requested from the download endpoint
+	downloads []string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	RegisterCapability(&testCapability{})
+	RegisterMethod("Test/method", newTest)
+	ts := &testServer{
+		session: map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"urn:ietf:params:jmap:core": map[string]interface{}{},
+				"test:jmap:capability":      map[string]interface{}{},
+			},
+			"accounts": map[string]interface{}{
+				"A1": map[string]interface{}{"name": "one"},
+			},
+			"primaryAccounts": map[string]interface{}{},
+			"state":           "s1",
+		},
+		sessionState: "s1",
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request) {
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		ts.sessionFetches += 1
+		ts.session["apiUrl"] = ts.URL + "/api"
+		ts.session["uploadUrl"] = ts.URL + "/upload/{accountId}"
+		ts.session["downloadUrl"] = ts.URL + "/download/{accountId}/{blobId}/{name}?type={type}"
+		json.NewEncoder(w).Encode(ts.session)
+	})
+	mux.HandleFunc("/download/", func(w http.ResponseWriter, r *http.Request) {
+		ts.mu.Lock()
+		ts.downloads = append(ts.downloads, r.URL.String())
+		ts.mu.Unlock()
+		// Every blob has the same content
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.Header().Set("ETag", `"e1"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("0123456789"))
+	})
+	mux.HandleFunc("/upload/", func(w http.ResponseWriter, r *http.Request) {
+		if ts.fail(w) {
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(&UploadResponse{
+			Account: ID(strings.TrimPrefix(r.URL.Path, "/upload/")),
+			ID:      ID(fmt.Sprintf("B%d", len(data))),
+			Type:    r.Header.Get("Content-Type"),
+			Size:    uint64(len(data)),
+		})
+	})
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		if ts.fail(w) {
+			return
+		}
+		req := struct {
+			Calls [][]json.RawMessage `json:"methodCalls"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		ts.requestCalls = append(ts.requestCalls, len(req.Calls))
+		responses := []interface{}{}
+		results := make(map[string]interface{})
+		for _, call := range req.Calls {
+			var name, callID string
+			json.Unmarshal(call[0], &name)
+			json.Unmarshal(call[2], &callID)
+			handler, ok := ts.handlers[name]
+			if !ok {
+				responses = append(responses, call)
+				continue
+			}
+			args := map[string]interface{}{}
+			json.Unmarshal(call[1], &args)
+			for key, val := range args {
+				if !strings.HasPrefix(key, "#") {
+					continue
+				}
+				ref := val.(map[string]interface{})
+				v, err := evalPointer(results[ref["resultOf"].(string)], ref["path"].(string))
+				if err != nil {
+					name, args = "error", map[string]interface{}{"type": "invalidResultReference"}
+					break
+				}
+				delete(args, key)
+				args[strings.TrimPrefix(key, "#")] = v
+			}
+			var resp interface{} = args
+			if name != "error" {
+				name, resp = handler(args)
+			}
+			// Round trip the response to generic values for
+			// references
+			data, _ := json.Marshal(resp)
+			var generic interface{}
+			json.Unmarshal(data, &generic)
+			results[callID] = generic
+			responses = append(responses, []interface{}{name, resp, callID})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"methodResponses": responses,
+			"sessionState":    ts.sessionState,
+		})
+	})
+	ts.Server = httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// fail counts a request attempt, and responds with a 503 status if the
+// request should fail
+func (ts *testServer) fail(w http.ResponseWriter) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.attempts += 1
+	if ts.failures <= 0 {
+		return false
+	}
+	ts.failures -= 1
+	w.Header().Set("Retry-After", "0")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	return true
+}
+
+func (ts *testServer) client() *Client {
+	return &Client{
+		HttpClient:      ts.Client(),
+		SessionEndpoint: ts.URL + "/session",
+	}
+}
+
+type testMethod struct {
+	Hello string
+}
+
+func (m *testMethod) Name() string { return "Test/method" }
+
+func (m *testMethod) Requires() []URI { return []URI{"test:jmap:capability"} }
+
+func TestClientDo(t *testing.T) {
+	assert := assert.New(t)
+	ts := newTestServer(t)
+	client := ts.client()
+
+	req := &Request{}
+	for i := 0; i < 3; i++ {
+		req.Invoke(&testMethod{Hello: fmt.Sprintf("%d", i)})
+	}
+	resp, err := client.Do(req)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(3, len(resp.Responses))
+	for i, inv := range resp.Responses {
+		assert.Equal(fmt.Sprintf("%x", i), inv.CallID)
+		assert.Equal(fmt.Sprintf("%d", i), inv.Args.(*test).Hello)
+	}
+}
+
+func TestClientSessionRefresh(t *testing.T) {
+	assert := assert.New(t)
+	ts := newTestServer(t)
+	client := ts.client()
+
+	changes := make(chan *SessionChange, 1)
+	client.OnSessionChange = func(change *SessionChange) {
+		changes <- change
+	}
+	err := client.Authenticate()
+	assert.NoError(err)
+
+	ts.mu.Lock()
+	ts.session["state"] = "s2"
+	ts.session["accounts"] = map[string]interface{}{
+		"A2": map[string]interface{}{"name": "two"},
+	}
+	ts.session["capabilities"] = map[string]interface{}{
+		"urn:ietf:params:jmap:core": map[string]interface{}{
+			"maxCallsInRequest": 16,
+		},
+		"urn:ietf:params:jmap:mail": map[string]interface{}{},
+		"test:jmap:capability":      map[string]interface{}{},
+	}
+	ts.sessionState = "s2"
+	ts.mu.Unlock()
+
+	req := &Request{}
+	req.Invoke(&testMethod{Hello: "world"})
+	_, err = client.Do(req)
+	assert.NoError(err)
+
+	var change *SessionChange
+	select {
+	case change = <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for session change")
+	}
+	assert.Equal("s1", change.Old.State)
+	assert.Equal("s2", change.New.State)
+	assert.Equal([]ID{"A2"}, change.AccountsAdded)
+	assert.Equal([]ID{"A1"}, change.AccountsRemoved)
+	assert.Equal([]URI{"urn:ietf:params:jmap:mail"}, change.CapabilitiesAdded)
+	assert.Equal([]URI{"urn:ietf:params:jmap:core"}, change.CapabilitiesChanged)
+	assert.Empty(change.CapabilitiesRemoved)
+
+	client.Lock()
+	assert.Equal("s2", client.Session.State)
+	client.Unlock()
+
+	// A matching state doesn't trigger another fetch
+	_, err = client.Do(req)
+	assert.NoError(err)
+	ts.mu.Lock()
+	assert.Equal(2, ts.sessionFetches)
+	ts.mu.Unlock()
+}
+
+func TestClientContext(t *testing.T) {
+	assert := assert.New(t)
+	ts := newTestServer(t)
+	client := ts.client()
+
+	// The implicit Session fetch uses the Context of the request
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := &Request{Context: ctx}
+	req.Invoke(&testMethod{Hello: "world"})
+	_, err := client.Do(req)
+	assert.True(errors.Is(err, context.Canceled))
+	ts.mu.Lock()
+	assert.Equal(0, ts.sessionFetches)
+	ts.mu.Unlock()
+
+	assert.True(errors.Is(client.AuthenticateWithContext(ctx), context.Canceled))
+	assert.NoError(client.AuthenticateWithContext(context.Background()))
+
+	// A hung upload or download is aborted when the context is done
+	stop := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	defer hung.Close()
+	defer close(stop)
+	client.Lock()
+	client.Session.UploadURL = hung.URL + "/upload/{accountId}/"
+	client.Session.DownloadURL = hung.URL + "/download/{accountId}/{blobId}/{name}?accept={type}"
+	client.Unlock()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = client.UploadWithContext(ctx, "A1", bytes.NewReader([]byte("hello")))
+	assert.True(errors.Is(err, context.DeadlineExceeded))
+	_, err = client.DownloadWithContext(ctx, "A1", "B1")
+	assert.True(errors.Is(err, context.DeadlineExceeded))
+}
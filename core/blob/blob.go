@@ -2,6 +2,35 @@ package blob
 
 import "git.sr.ht/~rockorager/go-jmap"
 
+// The URI of the blob management capability, as defined in RFC 9404. The
+// Blob/copy method is part of the core capability and doesn't require it
+const URI jmap.URI = "urn:ietf:params:jmap:blob"
+
 func init() {
+	jmap.RegisterCapability(&Capability{})
 	jmap.RegisterMethod("Blob/copy", newCopyResponse)
+	jmap.RegisterMethod("Blob/upload", newUploadResponse)
+}
+
+// The blob management capability. In the Session capabilities it is an empty
+// object; the account capability describes the limits of the account
+type Capability struct {
+	// The maximum size of a blob, in octets, that the server will allow
+	// to be created with Blob/upload, including blobs created by
+	// concatenating other blobs. Null if there is no limit
+	MaxSizeBlobSet *uint64 `json:"maxSizeBlobSet,omitempty"`
+
+	// The maximum number of DataSources allowed per blob in a Blob/upload
+	// call
+	MaxDataSources uint64 `json:"maxDataSources,omitempty"`
+
+	// The names of data types which may be referenced by Blob/lookup
+	SupportedTypeNames []string `json:"supportedTypeNames,omitempty"`
+
+	// The digest algorithms which may be requested with Blob/get
+	SupportedDigestAlgorithms []string `json:"supportedDigestAlgorithms,omitempty"`
 }
+
+func (c *Capability) URI() jmap.URI { return URI }
+
+func (c *Capability) New() jmap.Capability { return &Capability{} }
@@ -0,0 +1,151 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+
+	"git.sr.ht/~rockorager/go-jmap"
+)
+
+// Blobs may be created in the API with the Blob/upload method, as described in
+// RFC 9404 section 4.1, rather than through the upload endpoint. The data of
+// each blob is the concatenation of its DataSources, which may be text, base64
+// encoded data or a range of an existing blob
+type Upload struct {
+	// The id of the account to create the blobs in
+	Account jmap.ID `json:"accountId,omitempty"`
+
+	// The blobs to create, by creation id
+	Create map[jmap.ID]*UploadObject `json:"create,omitempty"`
+}
+
+func (m *Upload) Name() string { return "Blob/upload" }
+
+func (m *Upload) Requires() []jmap.URI { return []jmap.URI{URI} }
+
+// A blob to create with Blob/upload
+type UploadObject struct {
+	// The sources of the data of the blob, which are concatenated
+	Data []*DataSource `json:"data"`
+
+	// The media type of the blob
+	Type string `json:"type,omitempty"`
+}
+
+// A DataSource is part of the data of a blob created with Blob/upload. Exactly
+// one of AsText, AsBase64 or BlobID must be set
+type DataSource struct {
+	// Raw data, as a UTF-8 string
+	AsText *string `json:"data:asText,omitempty"`
+
+	// Raw data, base64 encoded
+	AsBase64 *string `json:"data:asBase64,omitempty"`
+
+	// The id of an existing blob to take data from. This may be a
+	// creation id of a blob created earlier in the same request, prefixed
+	// with "#"
+	BlobID *jmap.ID `json:"blobId,omitempty"`
+
+	// The offset in octets of the data to take from the blob. Defaults to
+	// 0
+	Offset *uint64 `json:"offset,omitempty"`
+
+	// The number of octets to take from the blob. Defaults to the rest of
+	// the blob
+	Length *uint64 `json:"length,omitempty"`
+}
+
+// Text returns a DataSource of UTF-8 text
+func Text(s string) *DataSource {
+	return &DataSource{AsText: &s}
+}
+
+// Base64 returns a DataSource of base64 encoded data
+func Base64(s string) *DataSource {
+	return &DataSource{AsBase64: &s}
+}
+
+// Blob returns a DataSource of the whole of an existing blob
+func Blob(id jmap.ID) *DataSource {
+	return &DataSource{BlobID: &id}
+}
+
+// The response to a Blob/upload call
+type UploadResponse struct {
+	// The id of the account used for the call
+	Account jmap.ID `json:"accountId,omitempty"`
+
+	// The blobs which were created, by creation id
+	Created map[jmap.ID]*Created `json:"created,omitempty"`
+
+	// A map of creation id to a SetError for each blob which couldn't be
+	// created
+	NotCreated map[jmap.ID]*jmap.SetError `json:"notCreated,omitempty"`
+}
+
+// A blob created with Blob/upload
+type Created struct {
+	// The id of the blob
+	ID jmap.ID `json:"id"`
+
+	// The media type of the blob
+	Type string `json:"type,omitempty"`
+
+	// The size of the blob in octets
+	Size uint64 `json:"size"`
+}
+
+func newUploadResponse() jmap.MethodResponse { return &UploadResponse{} }
+
+// UploadData creates a blob from data sources with a Blob/upload call, for
+// servers which offer the blob capability in the account. It returns the blob
+// like an upload to the upload endpoint does. Only the Type of opts, which may
+// be nil, is used. If the server didn't create the blob, its *jmap.SetError is
+// returned
+func UploadData(ctx context.Context, client *jmap.Client, accountID jmap.ID, opts *jmap.UploadOptions, data ...*DataSource) (*jmap.UploadResponse, error) {
+	session, err := client.EnsureSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	account, ok := session.Accounts[accountID]
+	if !ok {
+		return nil, fmt.Errorf("unknown account '%s'", accountID)
+	}
+	capability, ok := account.Capabilities[URI].(*Capability)
+	if !ok {
+		return nil, fmt.Errorf("account doesn't support required capability '%s'", URI)
+	}
+	if capability.MaxDataSources > 0 && uint64(len(data)) > capability.MaxDataSources {
+		return nil, fmt.Errorf("%d data sources exceed the maximum of %d", len(data), capability.MaxDataSources)
+	}
+	object := &UploadObject{Data: data}
+	if opts != nil {
+		object.Type = opts.Type
+	}
+	req := &jmap.Request{Context: ctx}
+	callID := req.Invoke(&Upload{
+		Account: accountID,
+		Create:  map[jmap.ID]*UploadObject{"blob": object},
+	})
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	upload, err := jmap.Result[*UploadResponse](resp, callID)
+	if err != nil {
+		return nil, err
+	}
+	if setErr, ok := upload.NotCreated["blob"]; ok {
+		return nil, setErr
+	}
+	created, ok := upload.Created["blob"]
+	if !ok {
+		return nil, fmt.Errorf("the server didn't create the blob")
+	}
+	return &jmap.UploadResponse{
+		Account: accountID,
+		ID:      created.ID,
+		Type:    created.Type,
+		Size:    created.Size,
+	}, nil
+}
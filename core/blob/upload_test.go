@@ -0,0 +1,73 @@
+package blob
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.sr.ht/~rockorager/go-jmap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpload(t *testing.T) {
+	assert := assert.New(t)
+	req := &jmap.Request{}
+	req.Invoke(&Upload{
+		Account: "A1",
+		Create: map[jmap.ID]*UploadObject{
+			"b1": {
+				Data: []*DataSource{Text("hello "), Base64("d29ybGQ=")},
+				Type: "text/plain",
+			},
+		},
+	})
+	data, err := json.Marshal(req)
+	assert.NoError(err)
+	exp := `{"using":["urn:ietf:params:jmap:blob"],"methodCalls":[["Blob/upload",{"accountId":"A1","create":{"b1":{"data":[{"data:asText":"hello "},{"data:asBase64":"d29ybGQ="}],"type":"text/plain"}}},"0"]]}`
+	assert.Equal(exp, string(data))
+
+	resp := &jmap.Response{}
+	err = json.Unmarshal([]byte(`{"methodResponses":[["Blob/upload",{"accountId":"A1","created":{"b1":{"id":"G1","type":"text/plain","size":11}},"notCreated":null},"0"]],"sessionState":"s"}`), resp)
+	assert.NoError(err)
+	upload, err := jmap.Result[*UploadResponse](resp, "0")
+	if assert.NoError(err) {
+		assert.Equal(&Created{ID: "G1", Type: "text/plain", Size: 11}, upload.Created["b1"])
+	}
+}
+
+func TestUploadData(t *testing.T) {
+	assert := assert.New(t)
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"methodResponses":[["Blob/upload",{"accountId":"A1","created":{"blob":{"id":"G1","type":"text/plain","size":11}}},"0"]],"sessionState":"s"}`))
+	}))
+	defer ts.Close()
+	client := &jmap.Client{
+		HttpClient: ts.Client(),
+		Session: &jmap.Session{
+			Capabilities: map[jmap.URI]jmap.Capability{URI: &Capability{}},
+			Accounts: map[jmap.ID]jmap.Account{
+				"A1": {Capabilities: map[jmap.URI]jmap.Capability{URI: &Capability{MaxDataSources: 2}}},
+				"A2": {},
+			},
+			APIURL: ts.URL,
+			State:  "s",
+		},
+	}
+
+	upload, err := UploadData(context.Background(), client, "A1", &jmap.UploadOptions{Type: "text/plain"}, Text("hello "), Base64("d29ybGQ="))
+	if assert.NoError(err) {
+		assert.Equal(&jmap.UploadResponse{Account: "A1", ID: "G1", Type: "text/plain", Size: 11}, upload)
+	}
+	assert.JSONEq(`{"using":["urn:ietf:params:jmap:blob"],"methodCalls":[["Blob/upload",{"accountId":"A1","create":{"blob":{"data":[{"data:asText":"hello "},{"data:asBase64":"d29ybGQ="}],"type":"text/plain"}}},"0"]]}`, string(body))
+
+	_, err = UploadData(context.Background(), client, "A1", nil, Text("a"), Text("b"), Text("c"))
+	assert.Error(err)
+	_, err = UploadData(context.Background(), client, "A2", nil, Text("a"))
+	assert.Error(err)
+}
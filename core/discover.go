@@ -1,28 +1,218 @@
 package core
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"net"
+	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 )
 
-// Discover the Session Endpoint of a domain
+// A Resolver looks up SRV records. *net.Resolver is a Resolver
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// A Discoverer finds the Session Endpoint of a domain, as described in RFC 8620
+// section 2.2:
+//
+//  1. The SRV records of _jmap._tcp.<domain> are tried in order of priority,
+//     and randomly by weight within the same priority (RFC 2782). Each gives
+//     a candidate URL https://<target>:<port>/.well-known/jmap
+//  2. If there are no SRV records, or none of them lead to a Session
+//     Endpoint, https://<domain>/.well-known/jmap is tried
+//
+// Redirects from a candidate URL are followed, and the final URL is the
+// Session Endpoint. Redirects to URLs which aren't https are refused. The
+// Session Endpoint is validated: it must either require authentication (a
+// 401 status), or return a Session with the core capability and an apiUrl
+type Discoverer struct {
+	// The Resolver used to look up SRV records. Defaults to
+	// net.DefaultResolver
+	Resolver Resolver
+
+	// The HTTP client used to fetch the candidate URLs. It may authenticate
+	// its requests, in which case the Session is always validated. Defaults
+	// to http.DefaultClient
+	HttpClient *http.Client
+}
+
+// Discover the Session Endpoint of a domain with the default Discoverer
 func Discover(domain string) (string, error) {
-	// Format: https://${hostname}[:${port}]/.well-known/jmap
-	_, srvs, err := net.LookupSRV("jmap", "tcp", domain)
+	d := &Discoverer{}
+	return d.Discover(context.Background(), domain)
+}
+
+// Discover the Session Endpoint of a domain
+func (d *Discoverer) Discover(ctx context.Context, domain string) (string, error) {
+	domain = strings.TrimSuffix(domain, ".")
+	candidates, err := d.lookup(ctx, domain)
+	if err != nil {
+		return "", err
+	}
+	candidates = append(candidates, "https://"+domain+"/.well-known/jmap")
+
+	errs := []error{}
+	for _, candidate := range candidates {
+		endpoint, err := d.fetch(ctx, candidate)
+		if err == nil {
+			return endpoint, nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		errs = append(errs, err)
+	}
+	return "", fmt.Errorf("no jmap session endpoint found for %s: %w", domain, errors.Join(errs...))
+}
+
+// lookup returns the candidate URLs of the SRV records of domain, in the order
+// they should be tried. A domain without SRV records has no candidates
+func (d *Discoverer) lookup(ctx context.Context, domain string) ([]string, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	_, srvs, err := resolver.LookupSRV(ctx, "jmap", "tcp", domain)
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return nil, nil
+	case err != nil && ctx.Err() != nil:
+		return nil, ctx.Err()
+	case err != nil && len(srvs) == 0:
+		// Treat other lookup failures like a missing record, so the
+		// well-known URL of the domain is still tried
+		return nil, nil
+	}
+	// A single record with the target "." means the service is decidedly
+	// not available at this domain (RFC 2782)
+	if len(srvs) == 1 && srvs[0].Target == "." {
+		return nil, fmt.Errorf("jmap is not available for %s", domain)
+	}
+
+	candidates := []string{}
+	for _, srv := range orderSRV(srvs, rand.Intn) {
+		endpoint := strings.Builder{}
+		endpoint.WriteString("https://")
+		endpoint.WriteString(strings.TrimSuffix(srv.Target, "."))
+		if srv.Port > 0 && srv.Port != 443 {
+			endpoint.WriteString(":" + strconv.Itoa(int(srv.Port)))
+		}
+		endpoint.WriteString("/.well-known/jmap")
+		candidates = append(candidates, endpoint.String())
+	}
+	return candidates, nil
+}
+
+// orderSRV returns the SRV records in the order they should be tried: by
+// ascending priority, and within the same priority randomly with a chance
+// proportional to their weight, as described in RFC 2782. intn returns a
+// random number in [0, n)
+func orderSRV(srvs []*net.SRV, intn func(n int) int) []*net.SRV {
+	sorted := make([]*net.SRV, 0, len(srvs))
+	for _, srv := range srvs {
+		if srv != nil && srv.Target != "" && srv.Target != "." {
+			sorted = append(sorted, srv)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+
+	ordered := make([]*net.SRV, 0, len(sorted))
+	for start := 0; start < len(sorted); {
+		end := start
+		for end < len(sorted) && sorted[end].Priority == sorted[start].Priority {
+			end += 1
+		}
+		group := sorted[start:end]
+		// Records with a weight of zero have a very small chance of being
+		// selected before any with a weight, so put them first in the
+		// running sum
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].Weight == 0 && group[j].Weight != 0
+		})
+		for len(group) > 0 {
+			total := 0
+			for _, srv := range group {
+				total += int(srv.Weight)
+			}
+			i := 0
+			if total > 0 {
+				n := intn(total + 1)
+				sum := 0
+				for i = range group {
+					sum += int(group[i].Weight)
+					if sum >= n {
+						break
+					}
+				}
+			}
+			ordered = append(ordered, group[i])
+			group = append(group[:i:i], group[i+1:]...)
+		}
+		start = end
+	}
+	return ordered
+}
+
+// fetch follows a candidate URL to the Session Endpoint, and validates it
+func (d *Discoverer) fetch(ctx context.Context, candidate string) (string, error) {
+	client := http.DefaultClient
+	if d.HttpClient != nil {
+		client = d.HttpClient
+	}
+	// Copy the client to refuse redirects away from https, in addition to
+	// its own redirect policy
+	c := *client
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to %s is not https", req.URL)
+		}
+		if client.CheckRedirect != nil {
+			return client.CheckRedirect(req, via)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", candidate, nil)
 	if err != nil {
 		return "", err
 	}
-	if len(srvs) < 1 {
-		return "", fmt.Errorf("no jmap srv found")
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	endpoint := resp.Request.URL.String()
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return endpoint, nil
+	case http.StatusOK:
+	default:
+		return "", fmt.Errorf("%s: %s", endpoint, resp.Status)
+	}
+	session := struct {
+		Capabilities map[string]json.RawMessage `json:"capabilities"`
+		APIURL       string                     `json:"apiUrl"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&session); err != nil {
+		return "", fmt.Errorf("%s: invalid session: %w", endpoint, err)
 	}
-	srv := srvs[0]
-	endpoint := strings.Builder{}
-	endpoint.WriteString("https://")
-	endpoint.WriteString(strings.TrimSuffix(srv.Target, "."))
-	if srv.Port > 0 {
-		endpoint.WriteString(fmt.Sprintf(":%d", srv.Port))
+	if _, ok := session.Capabilities[string(URI)]; !ok || session.APIURL == "" {
+		return "", fmt.Errorf("%s: invalid session: missing core capability or apiUrl", endpoint)
 	}
-	endpoint.WriteString("/.well-known/jmap")
-	return endpoint.String(), nil
+	return endpoint, nil
 }
@@ -0,0 +1,125 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testResolver map[string][]*net.SRV
+
+func (r testResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	cname := fmt.Sprintf("_%s._%s.%s.", service, proto, name)
+	srvs, ok := r[name]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: cname, IsNotFound: true}
+	}
+	return cname, srvs, nil
+}
+
+// testDiscoverer returns a Discoverer which connects to a test server for
+// every host name
+func testDiscoverer(t *testing.T, resolver Resolver) *Discoverer {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/jmap", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Host {
+		case "jmap1.example.com":
+			w.WriteHeader(http.StatusNotFound)
+		case "jmap2.example.com:8443":
+			http.Redirect(w, r, "/jmap/session", http.StatusTemporaryRedirect)
+		case "insecure.example.com":
+			http.Redirect(w, r, "http://insecure.example.com/jmap/session", http.StatusTemporaryRedirect)
+		case "invalid.example.com":
+			fmt.Fprint(w, `{"capabilities":{}}`)
+		default:
+			fmt.Fprint(w, `{"capabilities":{"urn:ietf:params:jmap:core":{}},"apiUrl":"https://example.com/api"}`)
+		}
+	})
+	mux.HandleFunc("/jmap/session", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	ts := httptest.NewTLSServer(mux)
+	t.Cleanup(ts.Close)
+
+	dialer := &net.Dialer{}
+	return &Discoverer{
+		Resolver: resolver,
+		HttpClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, ts.Listener.Addr().String())
+				},
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	assert := assert.New(t)
+	d := testDiscoverer(t, testResolver{
+		"example.com": {
+			{Target: "jmap2.example.com.", Port: 8443, Priority: 20},
+			{Target: "jmap1.example.com.", Port: 443, Priority: 10},
+		},
+		"unavailable.com": {
+			{Target: "."},
+		},
+		"insecure.example.com": {
+			{Target: "insecure.example.com.", Port: 443},
+		},
+	})
+	ctx := context.Background()
+
+	// The SRV records are tried in order of priority, and redirects are
+	// followed
+	endpoint, err := d.Discover(ctx, "example.com")
+	assert.NoError(err)
+	assert.Equal("https://jmap2.example.com:8443/jmap/session", endpoint)
+
+	// Without SRV records the domain is used
+	endpoint, err = d.Discover(ctx, "fallback.example.com")
+	assert.NoError(err)
+	assert.Equal("https://fallback.example.com/.well-known/jmap", endpoint)
+
+	_, err = d.Discover(ctx, "unavailable.com")
+	assert.Error(err)
+
+	// Redirects away from https are refused
+	_, err = d.Discover(ctx, "insecure.example.com")
+	assert.ErrorContains(err, "not https")
+
+	_, err = d.Discover(ctx, "invalid.example.com")
+	assert.ErrorContains(err, "invalid session")
+}
+
+func TestOrderSRV(t *testing.T) {
+	assert := assert.New(t)
+	srvs := []*net.SRV{
+		{Target: "c.", Priority: 20, Weight: 0},
+		{Target: "a.", Priority: 10, Weight: 1},
+		{Target: "b.", Priority: 10, Weight: 3},
+		{Target: "z.", Priority: 10, Weight: 0},
+	}
+	targets := func(srvs []*net.SRV) []string {
+		result := []string{}
+		for _, srv := range srvs {
+			result = append(result, srv.Target)
+		}
+		return result
+	}
+
+	// Always select the highest number: the running sum is 0, 1, 4
+	highest := func(n int) int { return n - 1 }
+	assert.Equal([]string{"b.", "a.", "z.", "c."}, targets(orderSRV(srvs, highest)))
+
+	// Always select 0, which picks a record with no weight first
+	lowest := func(n int) int { return 0 }
+	assert.Equal([]string{"z.", "a.", "b.", "c."}, targets(orderSRV(srvs, lowest)))
+}
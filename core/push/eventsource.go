@@ -2,18 +2,23 @@ package push
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync/atomic"
 
 	"git.sr.ht/~rockorager/go-jmap"
+	"git.sr.ht/~rockorager/go-jmap/internal/uritemplate"
 )
 
 // A subscription to an event stream
 type EventSource struct {
-	// The JMAP client to use for the stream
+	// The JMAP client to use for the stream. Its Logger, if set, logs
+	// connections and state changes
 	Client *jmap.Client
 
 	// The function to pass state change events to
@@ -32,17 +37,13 @@ type EventSource struct {
 
 	// The response of the request.
 	resp *http.Response
+
+	// Whether Close has been called
+	closed atomic.Bool
 }
 
 // Connect to the server
-func (e *EventSource) connect() error {
-	// Create the URL for the subscription
-	url, err := url.Parse(e.Client.Session.EventSourceURL)
-	if err != nil {
-		return err
-	}
-	q := url.Query()
-
+func (e *EventSource) connect(ctx context.Context) error {
 	if len(e.Events) == 0 {
 		e.Events = []jmap.EventType{jmap.AllEvents}
 	}
@@ -51,38 +52,84 @@ func (e *EventSource) connect() error {
 	for _, e := range e.Events {
 		types = append(types, string(e))
 	}
-	typeStr := strings.Join(types, ",")
-	q.Set("types", typeStr)
-
-	// ping field
-	q.Set("ping", fmt.Sprintf("%d", e.Ping))
-
-	// close after field
 	closeAfter := "no"
 	if e.CloseAfterState {
 		closeAfter = "state"
 	}
-	q.Set("closeafter", closeAfter)
+	vars := map[string]string{
+		"types":      strings.Join(types, ","),
+		"closeafter": closeAfter,
+		"ping":       fmt.Sprintf("%d", e.Ping),
+	}
 
-	// set the query string
-	url.RawQuery = q.Encode()
+	// Create the URL for the subscription
+	session, err := e.Client.EnsureSession(ctx)
+	if err != nil {
+		return err
+	}
+	template := session.EventSourceURL
+	names, err := uritemplate.Variables(template)
+	if err != nil {
+		return err
+	}
+	var target string
+	if len(names) == 0 {
+		// Not a template, add the variables as query parameters
+		u, err := url.Parse(template)
+		if err != nil {
+			return err
+		}
+		q := u.Query()
+		for k, v := range vars {
+			q.Set(k, v)
+		}
+		u.RawQuery = q.Encode()
+		target = u.String()
+	} else {
+		if err := uritemplate.Require(template, "types", "closeafter", "ping"); err != nil {
+			return err
+		}
+		target, err = uritemplate.Expand(template, vars)
+		if err != nil {
+			return err
+		}
+	}
 
 	// make the request
-	e.resp, err = e.Client.HttpClient.Get(url.String())
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
 	if err != nil {
 		return err
 	}
+	// The query may hold credentials, so only the rest of the URL is
+	// logged
+	logURL := *req.URL
+	logURL.RawQuery = ""
+	e.resp, err = e.Client.HttpClient.Do(req)
+	if err != nil {
+		e.log(ctx, slog.LevelError, "jmap eventsource connect failed", slog.String("url", logURL.String()), slog.Any("error", err))
+		return err
+	}
 	if e.resp.StatusCode != 200 {
+		e.log(ctx, slog.LevelError, "jmap eventsource connect failed", slog.String("url", logURL.String()), slog.Int("status", e.resp.StatusCode))
 		return fmt.Errorf("invalid request, response code: %d", e.resp.StatusCode)
 	}
+	e.log(ctx, slog.LevelInfo, "jmap eventsource connected", slog.String("url", logURL.String()), slog.String("types", vars["types"]))
 	return nil
 }
 
 // Starts listening for events from the source. Listen will block when called
 // and return when the source has been disconnected or closed via a call to
-// Close()
+// Close(). It returns nil if the stream was closed by Close or ended by the
+// server, and an error if the connection was lost
 func (e *EventSource) Listen() error {
-	err := e.connect()
+	return e.ListenWithContext(context.Background())
+}
+
+// ListenWithContext is like Listen, but makes the request with the given
+// context. It returns the error of the context when the context is done
+func (e *EventSource) ListenWithContext(ctx context.Context) error {
+	e.closed.Store(false)
+	err := e.connect(ctx)
 	if err != nil {
 		return err
 	}
@@ -111,18 +158,48 @@ func (e *EventSource) Listen() error {
 					state := &jmap.StateChange{}
 					err := json.Unmarshal([]byte(v), state)
 					if err != nil {
+						e.log(ctx, slog.LevelError, "jmap eventsource invalid state change", slog.Any("error", err))
 						return err
 					}
+					e.logStateChange(ctx, state)
 					e.Handler(state)
 				}
 			}
 		}
 	}
-	return nil
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if e.closed.Load() {
+		return nil
+	}
+	return scanner.Err()
+}
+
+// log logs a message to the Logger of the Client, if it has one, redacted by
+// its RedactRules
+func (e *EventSource) log(ctx context.Context, level slog.Level, msg string, attrs ...slog.Attr) {
+	e.Client.Log(ctx, level, msg, attrs...)
+}
+
+// logStateChange logs the new state of each type in each account of a
+// StateChange
+func (e *EventSource) logStateChange(ctx context.Context, state *jmap.StateChange) {
+	if e.Client.Logger == nil || !e.Client.Logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	for account, types := range state.Changed {
+		attrs := []slog.Attr{slog.String("accountId", string(account))}
+		for typ, s := range types {
+			attrs = append(attrs, slog.String(typ, s))
+		}
+		e.log(ctx, slog.LevelDebug, "jmap state change", attrs...)
+	}
 }
 
 // Closes the stream
 func (e *EventSource) Close() {
+	e.closed.Store(true)
 	if e.resp != nil && e.resp.Body != nil {
 		e.resp.Body.Close()
 	}
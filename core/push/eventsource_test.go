@@ -0,0 +1,147 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.sr.ht/~rockorager/go-jmap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventSourceURL(t *testing.T) {
+	assert := assert.New(t)
+	var query string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: state\ndata: {\"@type\":\"StateChange\",\"changed\":{\"A1\":{\"Email\":\"s1\"}}}\n\n")
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{
+			template: "/events{?types,closeafter,ping}",
+			expected: "types=Email%2CMailbox&closeafter=state&ping=30",
+		},
+		{
+			template: "/events?types={types}&closeafter={closeafter}&ping={ping}",
+			expected: "types=Email%2CMailbox&closeafter=state&ping=30",
+		},
+		{
+			// No variables: they are added as query parameters
+			template: "/events",
+			expected: "closeafter=state&ping=30&types=Email%2CMailbox",
+		},
+	}
+	for _, test := range tests {
+		changes := []*jmap.StateChange{}
+		es := &EventSource{
+			Client: &jmap.Client{
+				HttpClient: ts.Client(),
+				Session:    &jmap.Session{EventSourceURL: ts.URL + test.template},
+			},
+			Handler: func(s *jmap.StateChange) {
+				changes = append(changes, s)
+			},
+			Events:          []jmap.EventType{"Email", "Mailbox"},
+			Ping:            30,
+			CloseAfterState: true,
+		}
+		assert.NoError(es.Listen())
+		assert.Equal(test.expected, query)
+		if assert.Equal(1, len(changes)) {
+			assert.Equal("s1", changes[0].Changed["A1"]["Email"])
+		}
+	}
+
+	// A template missing a required variable
+	es := &EventSource{
+		Client: &jmap.Client{
+			HttpClient: ts.Client(),
+			Session:    &jmap.Session{EventSourceURL: ts.URL + "/events{?types}"},
+		},
+		Handler: func(*jmap.StateChange) {},
+	}
+	assert.Error(es.Listen())
+}
+
+func TestEventSourceListen(t *testing.T) {
+	assert := assert.New(t)
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/session":
+			fmt.Fprintf(w, `{"apiUrl":"%[1]s/api","eventSourceUrl":"%[1]s/events","state":"s1"}`, ts.URL)
+		case "/dropped":
+			// The connection is closed before the declared length is sent
+			w.Header().Set("Content-Length", "1000")
+			fmt.Fprint(w, "event: state\ndata: {\"changed\":{}}\n\n")
+		default:
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "event: state\ndata: {\"changed\":{}}\n\n")
+			if r.URL.Path == "/events" {
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+			}
+		}
+	}))
+	defer ts.Close()
+
+	// The Session is fetched, and the stream closed by Close
+	es := &EventSource{Client: &jmap.Client{HttpClient: ts.Client(), SessionEndpoint: ts.URL + "/session"}}
+	es.Handler = func(*jmap.StateChange) { es.Close() }
+	assert.NoError(es.Listen())
+
+	// Or by the context
+	ctx, cancel := context.WithCancel(context.Background())
+	es.Handler = func(*jmap.StateChange) { cancel() }
+	assert.ErrorIs(es.ListenWithContext(ctx), context.Canceled)
+
+	// The stream ended by the server
+	es.Client.Session.EventSourceURL = ts.URL + "/ended"
+	es.Handler = func(*jmap.StateChange) {}
+	assert.NoError(es.Listen())
+
+	// A lost connection is an error
+	es.Client.Session.EventSourceURL = ts.URL + "/dropped"
+	assert.Error(es.Listen())
+}
+
+func TestEventSourceLog(t *testing.T) {
+	assert := assert.New(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: state\ndata: {\"@type\":\"StateChange\",\"changed\":{\"A1\":{\"Email\":\"s1\"}}}\n\n")
+	}))
+	defer ts.Close()
+
+	buf := &bytes.Buffer{}
+	es := &EventSource{
+		Client: &jmap.Client{
+			HttpClient: ts.Client(),
+			Session:    &jmap.Session{EventSourceURL: ts.URL + "/events?token=secret{&types,closeafter,ping}"},
+			Logger:     slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		},
+		Handler:         func(s *jmap.StateChange) {},
+		CloseAfterState: true,
+	}
+	assert.NoError(es.Listen())
+	assert.Contains(buf.String(), fmt.Sprintf(`msg="jmap eventsource connected" url=%s/events types=*`, ts.URL))
+	assert.Contains(buf.String(), `msg="jmap state change" accountId=A1 Email=s1`)
+	assert.NotContains(buf.String(), "secret")
+
+	// The RedactRules of the Client apply
+	buf.Reset()
+	es.Client.RedactRules = []jmap.RedactRule{jmap.RedactProperties("url")}
+	assert.NoError(es.Listen())
+	assert.Contains(buf.String(), `msg="jmap eventsource connected" url=[REDACTED]`)
+	assert.NotContains(buf.String(), ts.URL)
+}
@@ -25,6 +25,8 @@ func (m *Get) Name() string { return "PushSubscription/get" }
 
 func (m *Get) Requires() []jmap.URI { return []jmap.URI{core.URI} }
 
+func (m *Get) StandardGet() {}
+
 // This is a standard “/get” method as described in [@!RFC8620], Section 5.1.
 type GetResponse struct {
 	// An array of the Foo objects requested. This is the empty array
@@ -0,0 +1,247 @@
+package jmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+func (r *Response) UnmarshalJSON(data []byte) error {
+	return decodeResponse(json.NewDecoder(bytes.NewReader(data)), r, nil)
+}
+
+// DecodeResponse decodes a Response from JSON read from rd, using the methods
+// of the Registry. The arguments of each response are decoded as they are
+// read, without first reading the whole of rd into memory
+func (r *Registry) DecodeResponse(rd io.Reader, resp *Response) error {
+	return decodeResponse(json.NewDecoder(rd), resp, r)
+}
+
+// UnmarshalResponse decodes a Response from JSON, using the methods of the
+// Registry
+func (r *Registry) UnmarshalResponse(data []byte, resp *Response) error {
+	return r.DecodeResponse(bytes.NewReader(data), resp)
+}
+
+// decodeResponse decodes a Response in a single pass over the tokens of dec.
+// The arguments of each invocation are decoded directly into the
+// MethodResponse of its method, so only the value being decoded is buffered
+// rather than the whole body and a raw copy of each invocation
+func decodeResponse(dec *json.Decoder, resp *Response, r *Registry) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		// null
+		return nil
+	}
+	if tok != json.Delim('{') {
+		return fmt.Errorf("invalid response: expected an object")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case "methodResponses":
+			resp.Responses, err = decodeInvocations(dec, r)
+		case "createdIds":
+			resp.CreatedIDs = nil
+			err = dec.Decode(&resp.CreatedIDs)
+		case "sessionState":
+			err = dec.Decode(&resp.SessionState)
+		default:
+			// Skip unknown properties, eg the @type of a response
+			// received over a WebSocket
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+func decodeInvocations(dec *json.Decoder, r *Registry) ([]*Invocation, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok == nil {
+		return nil, nil
+	}
+	if tok != json.Delim('[') {
+		return nil, fmt.Errorf("invalid methodResponses: expected an array")
+	}
+	invs := []*Invocation{}
+	for dec.More() {
+		inv := &Invocation{}
+		if err := inv.decode(dec, r); err != nil {
+			return nil, err
+		}
+		invs = append(invs, inv)
+	}
+	return invs, expectDelim(dec, ']')
+}
+
+// decode decodes the invocation from dec, using the methods of the Registry to
+// create its arguments
+func (i *Invocation) decode(dec *json.Decoder, r *Registry) error {
+	if err := expectDelim(dec, '['); err != nil {
+		return err
+	}
+	if !dec.More() {
+		return fmt.Errorf("Not enough values in invocation")
+	}
+	if err := dec.Decode(&i.Name); err != nil {
+		return err
+	}
+	if !dec.More() {
+		return fmt.Errorf("Not enough values in invocation")
+	}
+	i.Args = lookupMethod(r, i.Name)()
+	if err := decodeArgs(dec, i.Args); err != nil {
+		return err
+	}
+	if !dec.More() {
+		return fmt.Errorf("Not enough values in invocation")
+	}
+	if err := dec.Decode(&i.CallID); err != nil {
+		return err
+	}
+	if dec.More() {
+		return fmt.Errorf("Too many values in invocation")
+	}
+	return expectDelim(dec, ']')
+}
+
+// decodeArgs decodes the arguments of an invocation into v. If v is a pointer
+// to a struct, the arguments are decoded property by property and the items of
+// array properties one at a time, so a large list of objects (eg the response
+// to an Email/get call) is never buffered as a whole. Other values, and structs
+// which customize their decoding, are decoded with dec.Decode
+func decodeArgs(dec *json.Decoder, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if _, ok := v.(json.Unmarshaler); ok || rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return dec.Decode(v)
+	}
+	fields, ok := jsonFields(rv.Elem().Type())
+	if !ok {
+		return dec.Decode(v)
+	}
+
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if tok != json.Delim('{') {
+		return fmt.Errorf("invalid arguments: expected an object")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+		i, ok := fields[key]
+		if !ok {
+			// Matching is case-insensitive as with json.Unmarshal
+			for name, j := range fields {
+				if strings.EqualFold(name, key) {
+					i, ok = j, true
+					break
+				}
+			}
+		}
+		if !ok {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+		field := rv.Elem().Field(i)
+		_, custom := field.Addr().Interface().(json.Unmarshaler)
+		if field.Kind() == reflect.Slice && field.Type().Elem().Kind() != reflect.Uint8 && !custom {
+			err = decodeSlice(dec, field)
+		} else {
+			err = dec.Decode(field.Addr().Interface())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// decodeSlice decodes a JSON array into a slice, one item at a time
+func decodeSlice(dec *json.Decoder, slice reflect.Value) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		slice.Set(reflect.Zero(slice.Type()))
+		return nil
+	}
+	if tok != json.Delim('[') {
+		return fmt.Errorf("invalid JSON: expected an array, got %v", tok)
+	}
+	slice.Set(reflect.MakeSlice(slice.Type(), 0, 0))
+	for dec.More() {
+		item := reflect.New(slice.Type().Elem())
+		if err := dec.Decode(item.Interface()); err != nil {
+			return err
+		}
+		slice.Set(reflect.Append(slice, item.Elem()))
+	}
+	return expectDelim(dec, ']')
+}
+
+// jsonFields returns the index of each field of a struct type by its JSON
+// name. Structs with embedded fields or the ",string" option are reported as
+// not supported, to be decoded with json.Unmarshal instead
+func jsonFields(t reflect.Type) (map[string]int, bool) {
+	fields := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			return nil, false
+		}
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+		if strings.Contains(","+opts+",", ",string,") {
+			return nil, false
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = i
+	}
+	return fields, true
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("invalid JSON: expected '%s', got %v", delim, tok)
+	}
+	return nil
+}
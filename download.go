@@ -0,0 +1,166 @@
+package jmap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DownloadOptions are the options of a download made with
+// DownloadWithOptions
+type DownloadOptions struct {
+	// The name of the file, used by the server in the Content-Disposition
+	// of the response. Defaults to the blob ID
+	Name string
+
+	// The media type the server should return the blob as, eg the Type of
+	// an email.BodyPart. Defaults to application/octet-stream
+	Type string
+
+	// The offset in octets of the first octet to download. If Offset or
+	// Length is set, a Range request is made. Neither may be negative
+	Offset int64
+
+	// The number of octets to download. If zero, the blob is downloaded
+	// to its end
+	Length int64
+
+	// If set, the range is only downloaded if the ETag of the blob is
+	// still IfRange (as returned in DownloadResponse.ETag), otherwise the
+	// whole blob is returned. Use this when resuming a download
+	IfRange string
+}
+
+// A DownloadResponse is the response to a download. The caller must close the
+// Body
+type DownloadResponse struct {
+	// The data of the blob, or the requested range of it
+	Body io.ReadCloser
+
+	// The number of octets in Body, or -1 if unknown
+	Length int64
+
+	// The media type of the data, from the Content-Type header
+	Type string
+
+	// The ETag of the blob, if the server returned one
+	ETag string
+
+	// Whether Body is a range of the blob rather than the whole blob. A
+	// server may ignore a Range request and return the whole blob, in
+	// which case Partial is false
+	Partial bool
+
+	// If Partial, the offset in octets of the range in the blob
+	Offset int64
+
+	// The size of the whole blob in octets, or -1 if unknown
+	Size int64
+}
+
+// DownloadWithOptions downloads a blob with the name, type and range given by
+// opts, which may be nil. It returns the data along with its metadata
+func (c *Client) DownloadWithOptions(ctx context.Context, accountID ID, blobID ID, opts *DownloadOptions) (*DownloadResponse, error) {
+	if opts == nil {
+		opts = &DownloadOptions{}
+	}
+	if opts.Offset < 0 || opts.Length < 0 {
+		return nil, fmt.Errorf("invalid download range: offset %d, length %d", opts.Offset, opts.Length)
+	}
+	session, err := c.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	name := opts.Name
+	if name == "" {
+		name = string(blobID)
+	}
+	mediaType := opts.Type
+	if mediaType == "" {
+		mediaType = "application/octet-stream"
+	}
+	tgtUrl, err := expandURL(session.DownloadURL, map[string]string{
+		"accountId": string(accountID),
+		"blobId":    string(blobID),
+		"type":      mediaType,
+		"name":      name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", tgtUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Offset > 0 || opts.Length > 0 {
+		rng := fmt.Sprintf("bytes=%d-", opts.Offset)
+		if opts.Length > 0 {
+			rng += strconv.FormatInt(opts.Offset+opts.Length-1, 10)
+		}
+		req.Header.Set("Range", rng)
+		if opts.IfRange != "" {
+			req.Header.Set("If-Range", opts.IfRange)
+		}
+	}
+
+	resp, err := c.send(req, true)
+	if err != nil {
+		return nil, err
+	}
+	dl := &DownloadResponse{
+		Body:   resp.Body,
+		Length: resp.ContentLength,
+		Type:   resp.Header.Get("Content-Type"),
+		ETag:   resp.Header.Get("ETag"),
+		Size:   -1,
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		dl.Size = resp.ContentLength
+	case http.StatusPartialContent:
+		dl.Partial = true
+		dl.Offset, dl.Size, err = parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	default:
+		defer resp.Body.Close()
+		return nil, decodeHttpError(resp)
+	}
+	return dl, nil
+}
+
+// parseContentRange returns the offset of the range and the size of the whole
+// blob from a Content-Range header, eg "bytes 100-199/1000". The size is -1 if
+// the server didn't include it
+func parseContentRange(header string) (int64, int64, error) {
+	rng, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range '%s'", header)
+	}
+	rng, total, ok := strings.Cut(rng, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range '%s'", header)
+	}
+	start, _, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range '%s'", header)
+	}
+	offset, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range '%s'", header)
+	}
+	if total == "*" {
+		return offset, -1, nil
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range '%s'", header)
+	}
+	return offset, size, nil
+}
@@ -0,0 +1,111 @@
+package jmap
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientDownloadWithOptions(t *testing.T) {
+	assert := assert.New(t)
+	ts := newTestServer(t)
+	client := ts.client()
+	ctx := context.Background()
+
+	dl, err := client.DownloadWithOptions(ctx, "A1", "B1", &DownloadOptions{
+		Name: "my file+1.pdf",
+		Type: "application/pdf",
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	data, err := io.ReadAll(dl.Body)
+	dl.Body.Close()
+	assert.NoError(err)
+	assert.Equal("0123456789", string(data))
+	assert.Equal(int64(10), dl.Length)
+	assert.Equal(int64(10), dl.Size)
+	assert.Equal("application/pdf", dl.Type)
+	assert.Equal(`"e1"`, dl.ETag)
+	assert.False(dl.Partial)
+	assert.Equal("/download/A1/B1/my%20file%2B1.pdf?type=application%2Fpdf", ts.downloads[0])
+
+	// Defaults
+	body, err := client.Download("A1", "B1")
+	if assert.NoError(err) {
+		body.Close()
+	}
+	assert.Equal("/download/A1/B1/B1?type=application%2Foctet-stream", ts.downloads[1])
+
+	// A range
+	dl, err = client.DownloadWithOptions(ctx, "A1", "B1", &DownloadOptions{
+		Offset:  2,
+		Length:  3,
+		IfRange: `"e1"`,
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	data, _ = io.ReadAll(dl.Body)
+	dl.Body.Close()
+	assert.Equal("234", string(data))
+	assert.True(dl.Partial)
+	assert.Equal(int64(2), dl.Offset)
+	assert.Equal(int64(3), dl.Length)
+	assert.Equal(int64(10), dl.Size)
+
+	// To the end of the blob
+	dl, err = client.DownloadWithOptions(ctx, "A1", "B1", &DownloadOptions{Offset: 7})
+	if !assert.NoError(err) {
+		return
+	}
+	data, _ = io.ReadAll(dl.Body)
+	dl.Body.Close()
+	assert.Equal("789", string(data))
+	assert.Equal(int64(7), dl.Offset)
+
+	// The ETag changed, the whole blob is returned
+	dl, err = client.DownloadWithOptions(ctx, "A1", "B1", &DownloadOptions{
+		Offset:  2,
+		IfRange: `"e0"`,
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	data, _ = io.ReadAll(dl.Body)
+	dl.Body.Close()
+	assert.Equal("0123456789", string(data))
+	assert.False(dl.Partial)
+
+	// An unsatisfiable range
+	_, err = client.DownloadWithOptions(ctx, "A1", "B1", &DownloadOptions{Offset: 20})
+	assert.Error(err)
+
+	// Negative ranges aren't requested
+	requests := len(ts.downloads)
+	_, err = client.DownloadWithOptions(ctx, "A1", "B1", &DownloadOptions{Offset: -5, Length: 10})
+	assert.Error(err)
+	_, err = client.DownloadWithOptions(ctx, "A1", "B1", &DownloadOptions{Offset: 2, Length: -1})
+	assert.Error(err)
+	assert.Equal(requests, len(ts.downloads))
+}
+
+func TestParseContentRange(t *testing.T) {
+	assert := assert.New(t)
+	offset, size, err := parseContentRange("bytes 100-199/1000")
+	assert.NoError(err)
+	assert.Equal(int64(100), offset)
+	assert.Equal(int64(1000), size)
+
+	offset, size, err = parseContentRange("bytes 0-9/*")
+	assert.NoError(err)
+	assert.Equal(int64(0), offset)
+	assert.Equal(int64(-1), size)
+
+	for _, header := range []string{"", "bytes */1000", "items 0-9/10", "bytes 0-9"} {
+		_, _, err = parseContentRange(header)
+		assert.Error(err, header)
+	}
+}
@@ -2,6 +2,174 @@ package jmap
 
 import "fmt"
 
+// An ErrorType is the type of a RequestError, MethodError or SetError. The
+// error types defined by RFC 8620 are provided as constants, specifications
+// built on it define their own. ErrorTypes implement error so they can be used
+// as sentinel values with errors.Is:
+//
+//	if errors.Is(err, jmap.ErrStateMismatch) {
+//		// refetch the state and try again
+//	}
+type ErrorType string
+
+func (e ErrorType) Error() string { return string(e) }
+
+// Request-level error types. See RFC 8620 section 3.6.1
+const (
+	// The client included a capability in the “using” property of the
+	// request that the server does not support.
+	ErrUnknownCapability ErrorType = "urn:ietf:params:jmap:error:unknownCapability"
+
+	// The content type of the request was not application/json or the
+	// request did not parse as I-JSON.
+	ErrNotJSON ErrorType = "urn:ietf:params:jmap:error:notJSON"
+
+	// The request parsed as JSON but did not match the type signature of
+	// the Request object.
+	ErrNotRequest ErrorType = "urn:ietf:params:jmap:error:notRequest"
+
+	// The request was not processed as it would have exceeded one of the
+	// request limits defined on the capability object, such as
+	// maxSizeRequest, maxCallsInRequest, or maxConcurrentRequests.
+	ErrLimit ErrorType = "urn:ietf:params:jmap:error:limit"
+)
+
+// Method-level error types which may be returned by any method. See RFC 8620
+// section 3.6.2
+const (
+	// Some internal server resource was temporarily unavailable. Attempting
+	// the same operation later (perhaps after a backoff with a random
+	// factor) may succeed.
+	ErrServerUnavailable ErrorType = "serverUnavailable"
+
+	// An unexpected or unknown error occurred during the processing of the
+	// call. A description property should provide more details about the
+	// error. The method call made no changes to the server’s state.
+	ErrServerFail ErrorType = "serverFail"
+
+	// Some, but not all, expected changes described by the method occurred.
+	// The client MUST resynchronise impacted data to determine server
+	// state. Use of this error is strongly discouraged.
+	ErrServerPartialFail ErrorType = "serverPartialFail"
+
+	// The server does not recognise this method name.
+	ErrUnknownMethod ErrorType = "unknownMethod"
+
+	// One of the arguments is of the wrong type or is otherwise invalid, or
+	// a required argument is missing. A description property MAY be
+	// present to help debug with an explanation of what the problem was.
+	ErrInvalidArguments ErrorType = "invalidArguments"
+
+	// The method used a result reference for one of its arguments, but
+	// this failed to resolve.
+	ErrInvalidResultReference ErrorType = "invalidResultReference"
+
+	// The method and arguments are valid, but executing the method would
+	// violate an Access Control List (ACL) or other permissions policy.
+	// Also used as a SetError type.
+	ErrForbidden ErrorType = "forbidden"
+
+	// The accountId does not correspond to a valid account.
+	ErrAccountNotFound ErrorType = "accountNotFound"
+
+	// The accountId given corresponds to a valid account, but the account
+	// does not support this method or data type.
+	ErrAccountNotSupportedByMethod ErrorType = "accountNotSupportedByMethod"
+
+	// This method modifies state, but the account is read-only (as
+	// returned on the corresponding Account object in the JMAP Session
+	// resource).
+	ErrAccountReadOnly ErrorType = "accountReadOnly"
+)
+
+// Method-level error types returned by the standard methods. See RFC 8620
+// section 5
+const (
+	// The number of ids requested by the client exceeds the maximum number
+	// the server is willing to process in a single method call (/get and
+	// /set).
+	ErrRequestTooLarge ErrorType = "requestTooLarge"
+
+	// An ifInState argument was supplied, and it does not match the
+	// current state (/set).
+	ErrStateMismatch ErrorType = "stateMismatch"
+
+	// The server cannot calculate the changes from the state string given
+	// by the client (/changes and /queryChanges).
+	ErrCannotCalculateChanges ErrorType = "cannotCalculateChanges"
+
+	// An anchor argument was supplied, but it cannot be found in the
+	// results of the query (/query).
+	ErrAnchorNotFound ErrorType = "anchorNotFound"
+
+	// The sort is syntactically valid, but it includes a property the
+	// server does not support sorting on, or a collation method it does
+	// not recognise (/query and /queryChanges).
+	ErrUnsupportedSort ErrorType = "unsupportedSort"
+
+	// The filter is syntactically valid, but the server cannot process it
+	// (/query and /queryChanges).
+	ErrUnsupportedFilter ErrorType = "unsupportedFilter"
+
+	// There are more changes than the client’s maxChanges argument
+	// (/queryChanges).
+	ErrTooManyChanges ErrorType = "tooManyChanges"
+
+	// The fromAccountId does not correspond to a valid account (/copy).
+	ErrFromAccountNotFound ErrorType = "fromAccountNotFound"
+
+	// The fromAccountId given corresponds to a valid account, but the
+	// account does not support this data type (/copy).
+	ErrFromAccountNotSupportedByMethod ErrorType = "fromAccountNotSupportedByMethod"
+)
+
+// SetError types which may be returned for any /set or /copy call. See RFC
+// 8620 section 5.3 and 5.4. ErrForbidden is also a SetError type
+const (
+	// The create would exceed a server-defined limit on the number or
+	// total size of objects of this type.
+	ErrOverQuota ErrorType = "overQuota"
+
+	// The create/update would result in an object that exceeds a
+	// server-defined limit for the maximum size of a single object of
+	// this type.
+	ErrTooLarge ErrorType = "tooLarge"
+
+	// Too many objects of this type have been created recently, and a
+	// server-defined rate limit has been reached. It may work if tried
+	// again later.
+	ErrRateLimit ErrorType = "rateLimit"
+
+	// The id given to update/destroy cannot be found.
+	ErrNotFound ErrorType = "notFound"
+
+	// The PatchObject given to update the record was not a valid patch.
+	ErrInvalidPatch ErrorType = "invalidPatch"
+
+	// The client requested that an object be both updated and destroyed in
+	// the same /set request, and the server has decided to therefore
+	// ignore the update.
+	ErrWillDestroy ErrorType = "willDestroy"
+
+	// The record given is invalid in some way.
+	ErrInvalidProperties ErrorType = "invalidProperties"
+
+	// This is a singleton type, so you cannot create another one or
+	// destroy the existing one.
+	ErrSingleton ErrorType = "singleton"
+
+	// The server forbids duplicates, and the record already exists in the
+	// target account. An existingId property of type Id MUST be included
+	// on the SetError object with the id of the existing record (/copy).
+	ErrAlreadyExists ErrorType = "alreadyExists"
+)
+
+// isType reports whether target is the ErrorType typ
+func isType(typ string, target error) bool {
+	t, ok := target.(ErrorType)
+	return ok && string(t) == typ
+}
+
 // A RequestError occurs when there is an error with the HTTP request
 type RequestError struct {
 	// The type of request error, eg "urn:ietf:params:jmap:error:limit"
@@ -25,6 +193,15 @@ func (e *RequestError) Error() string {
 	return fmt.Sprintf(e.Detail)
 }
 
+// Is reports whether the RequestError is of the ErrorType target, or is a
+// RequestError of the same type as target
+func (e *RequestError) Is(target error) bool {
+	if t, ok := target.(*RequestError); ok {
+		return t.Type == e.Type
+	}
+	return isType(e.Type, target)
+}
+
 // A MethodError is returned when an error occurred while the server was
 // processing a method. Instead of the Response of that method, a MethodError
 // invocation will be in it's place
@@ -44,6 +221,15 @@ func (m *MethodError) Error() string {
 	return m.Type
 }
 
+// Is reports whether the MethodError is of the ErrorType target, or is a
+// MethodError of the same type as target
+func (m *MethodError) Is(target error) bool {
+	if t, ok := target.(*MethodError); ok {
+		return t.Type == m.Type
+	}
+	return isType(m.Type, target)
+}
+
 func newMethodError() MethodResponse { return &MethodError{} }
 
 // A SetError is returned in set calls for individual record changes
@@ -59,4 +245,41 @@ type SetError struct {
 	// Properties is available on InvalidProperties SetErrors and lists the
 	// individual properties were
 	Properties *[]string `json:"properties,omitempty"`
+
+	// ExistingID is available on alreadyExists SetErrors and is the id of
+	// the existing record
+	ExistingID *ID `json:"existingId,omitempty"`
+
+	// NotFound is available on blobNotFound SetErrors and lists the blob
+	// ids which could not be found
+	NotFound []ID `json:"notFound,omitempty"`
+
+	// MaxSize is available on some tooLarge SetErrors (eg for
+	// EmailSubmission/set) and is the maximum size, in octets, the server
+	// accepts
+	MaxSize *uint64 `json:"maxSize,omitempty"`
+
+	// MaxRecipients is available on tooManyRecipients SetErrors and is the
+	// maximum number of recipients the server accepts
+	MaxRecipients *uint64 `json:"maxRecipients,omitempty"`
+
+	// InvalidRecipients is available on invalidRecipients SetErrors and
+	// lists the recipient addresses which were invalid
+	InvalidRecipients []string `json:"invalidRecipients,omitempty"`
+}
+
+func (s *SetError) Error() string {
+	if s.Description != nil {
+		return fmt.Sprintf("%s: %s", s.Type, *s.Description)
+	}
+	return s.Type
+}
+
+// Is reports whether the SetError is of the ErrorType target, or is a SetError
+// of the same type as target
+func (s *SetError) Is(target error) bool {
+	if t, ok := target.(*SetError); ok {
+		return t.Type == s.Type
+	}
+	return isType(s.Type, target)
 }
@@ -0,0 +1,46 @@
+package jmap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorsIs(t *testing.T) {
+	assert := assert.New(t)
+
+	var err error = &RequestError{Type: "urn:ietf:params:jmap:error:limit"}
+	assert.ErrorIs(err, ErrLimit)
+	assert.ErrorIs(fmt.Errorf("wrapped: %w", err), ErrLimit)
+	assert.NotErrorIs(err, ErrNotJSON)
+
+	err = &MethodError{Type: "stateMismatch"}
+	assert.ErrorIs(err, ErrStateMismatch)
+	assert.ErrorIs(err, &MethodError{Type: "stateMismatch"})
+	assert.NotErrorIs(err, &SetError{Type: "stateMismatch"})
+	assert.NotErrorIs(err, ErrForbidden)
+
+	err = &SetError{Type: "forbidden"}
+	assert.ErrorIs(err, ErrForbidden)
+	assert.NotErrorIs(err, ErrorType("urn:ietf:params:jmap:error:forbidden"))
+}
+
+func TestSetErrorUnmarshal(t *testing.T) {
+	assert := assert.New(t)
+	data := []byte(`{"type":"alreadyExists","existingId":"M1"}`)
+	setErr := &SetError{}
+	assert.NoError(json.Unmarshal(data, setErr))
+	assert.True(errors.Is(setErr, ErrAlreadyExists))
+	if assert.NotNil(setErr.ExistingID) {
+		assert.Equal(ID("M1"), *setErr.ExistingID)
+	}
+
+	data = []byte(`{"type":"blobNotFound","notFound":["B1","B2"]}`)
+	setErr = &SetError{}
+	assert.NoError(json.Unmarshal(data, setErr))
+	assert.Equal([]ID{"B1", "B2"}, setErr.NotFound)
+	assert.Equal("blobNotFound", setErr.Error())
+}
@@ -1,13 +1,17 @@
 package jmap_test
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"path/filepath"
 
 	"git.sr.ht/~rockorager/go-jmap"
 	"git.sr.ht/~rockorager/go-jmap/core/push"
 	"git.sr.ht/~rockorager/go-jmap/mail"
 	"git.sr.ht/~rockorager/go-jmap/mail/email"
 	"git.sr.ht/~rockorager/go-jmap/mail/mailbox"
+	"git.sr.ht/~rockorager/go-jmap/websocket"
 )
 
 // Basic usage of the client, with chaining of methods
@@ -42,21 +46,17 @@ func Example() {
 		Account: id,
 	})
 
-	// Invoke a changes call, let's save the callID and pass it to a Get
-	// method
-	callID := req.Invoke(&email.Changes{
+	// Invoke a changes call. InvokeChanges returns the call, which creates
+	// result references to its response
+	changes := jmap.InvokeChanges(req, &email.Changes{
 		Account:    id,
 		SinceState: "some-known-state",
 	})
 
-	// Invoke a result reference call
+	// Invoke a result reference call, using the ids of the created emails
 	req.Invoke(&email.Get{
-		Account: id,
-		ReferenceIDs: &jmap.ResultReference{
-			ResultOf: callID,          // The CallID of the referenced method
-			Name:     "Email/changes", // The name of the referenced method
-			Path:     "/created",      // JSON pointer to the location of the reference
-		},
+		Account:      id,
+		ReferenceIDs: changes.Created(),
 	})
 
 	// Make the request
@@ -89,6 +89,38 @@ func Example() {
 	}
 }
 
+// Example usage of a SessionStore. The Session object is fetched on the first
+// run, and loaded from the file on later runs
+func Example_sessionStore() {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		// Handle the error
+	}
+	client := &jmap.Client{
+		SessionEndpoint: "https://api.fastmail.com/jmap/session",
+		SessionStore: &jmap.FileSessionStore{
+			Path: filepath.Join(cache, "myapp", "session.json"),
+		},
+	}
+	client.WithAccessToken("my-access-token")
+
+	// Load the stored Session, or fetch it if there isn't one. It is
+	// refetched if a response reports a different session state
+	session, err := client.EnsureSession(context.Background())
+	if err != nil {
+		// Handle the error
+	}
+
+	req := &jmap.Request{}
+	req.Invoke(&mailbox.Get{
+		Account: session.PrimaryAccounts[mail.URI],
+	})
+	_, err = client.Do(req)
+	if err != nil {
+		// Handle the error
+	}
+}
+
 // Example usage of an eventsource push notification connection
 func Example_eventsource() {
 	client := &jmap.Client{
@@ -108,3 +140,83 @@ func Example_eventsource() {
 		// return when stream.Close is called
 	}
 }
+
+// Example usage of a WebSocket connection. Requests made on the connection
+// are sent as WebSocket messages instead of HTTP requests
+func Example_websocket() {
+	client := &jmap.Client{
+		SessionEndpoint: "https://api.fastmail.com/jmap/session",
+	}
+	client.WithAccessToken("my-access-token")
+
+	conn, err := websocket.Dial(context.Background(), client)
+	if err != nil {
+		// error occurs if the server doesn't support WebSockets or the
+		// connection couldn't be made
+	}
+	defer conn.Close()
+
+	req := &jmap.Request{}
+	req.Invoke(&mailbox.Get{
+		Account: client.Session.PrimaryAccounts[mail.URI],
+	})
+
+	// Do may be called from multiple goroutines at once
+	resp, err := conn.Do(req)
+	if err != nil {
+		// Handle the error
+	}
+	for _, inv := range resp.Responses {
+		switch r := inv.Args.(type) {
+		case *mailbox.GetResponse:
+			for _, mbox := range r.List {
+				fmt.Printf("Mailbox name: %s", mbox.Name)
+			}
+		}
+	}
+
+	// Push notifications can be received over the same connection. Leave
+	// the events empty to subscribe to all of them
+	myHandlerFunc := func(change *jmap.StateChange) {
+		// handle the change
+	}
+	err = conn.EnablePush(context.Background(), myHandlerFunc, nil, "")
+	if err != nil {
+		// error occurs if the server doesn't support push over
+		// WebSockets
+	}
+}
+
+// Example usage of the Response helpers to retrieve the result of a call
+func ExampleResult() {
+	client := &jmap.Client{
+		SessionEndpoint: "https://api.fastmail.com/jmap/session",
+	}
+	client.WithAccessToken("my-access-token")
+	id := client.Session.PrimaryAccounts[mail.URI]
+
+	req := &jmap.Request{}
+	callID := req.Invoke(&mailbox.Get{
+		Account: id,
+	})
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// Handle the error
+	}
+
+	// Err combines the MethodErrors of every call which failed
+	if err := resp.Err(); err != nil {
+		// Handle the error
+	}
+
+	// Get the result of a single call by its call ID
+	get, err := jmap.Result[*mailbox.GetResponse](resp, callID)
+	if err != nil {
+		// Handle the error, which will be a *jmap.CallError if the
+		// call failed
+	}
+	for _, mbox := range get.List {
+		fmt.Printf("Mailbox name: %s", mbox.Name)
+	}
+}
@@ -1,18 +1,15 @@
 module git.sr.ht/~rockorager/go-jmap
 
-go 1.19
+go 1.21
 
 require (
+	github.com/coder/websocket v1.8.12
 	github.com/stretchr/testify v1.8.0
-	golang.org/x/oauth2 v0.4.0
+	golang.org/x/oauth2 v0.21.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/net v0.5.0 // indirect
-	google.golang.org/appengine v1.6.7 // indirect
-	google.golang.org/protobuf v1.28.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
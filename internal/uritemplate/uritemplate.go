@@ -0,0 +1,198 @@
+// Package uritemplate expands the URI Templates (RFC 6570) used by the URLs of
+// the JMAP Session object.
+//
+// Level 1 simple string expansion ("{var}") is supported, as required by RFC
+// 8620, along with a list of variables in a simple expression ("{x,y}") and
+// form-style query expansion ("{?x,y}" and "{&x,y}"), which servers use for the
+// query parameters of the eventSourceUrl. Other operators and value modifiers
+// are rejected.
+package uritemplate
+
+import (
+	"fmt"
+	"strings"
+)
+
+// An expression of a template: the text between braces
+type expression struct {
+	// The operator, 0 for simple string expansion
+	op    byte
+	names []string
+}
+
+// parse splits a template into its literals and expressions. The literal
+// before each expression is at the same index, and the last literal follows
+// the last expression
+func parse(template string) ([]string, []expression, error) {
+	literals := []string{}
+	exprs := []expression{}
+	rest := template
+	for {
+		start := strings.IndexAny(rest, "{}")
+		if start < 0 {
+			literals = append(literals, rest)
+			return literals, exprs, nil
+		}
+		if rest[start] == '}' {
+			return nil, nil, fmt.Errorf("invalid template '%s': unmatched '}'", template)
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return nil, nil, fmt.Errorf("invalid template '%s': unclosed expression", template)
+		}
+		end += start
+		expr, err := parseExpression(rest[start+1 : end])
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid template '%s': %v", template, err)
+		}
+		literals = append(literals, rest[:start])
+		exprs = append(exprs, expr)
+		rest = rest[end+1:]
+	}
+}
+
+func parseExpression(s string) (expression, error) {
+	expr := expression{}
+	if s != "" {
+		switch s[0] {
+		case '?', '&':
+			expr.op = s[0]
+			s = s[1:]
+		case '+', '#', '.', '/', ';', '=', ',', '!', '@', '|':
+			return expr, fmt.Errorf("unsupported operator '%c'", s[0])
+		}
+	}
+	for _, name := range strings.Split(s, ",") {
+		if !validName(name) {
+			return expr, fmt.Errorf("invalid variable name '%s'", name)
+		}
+		expr.names = append(expr.names, name)
+	}
+	return expr, nil
+}
+
+// validName reports whether name is a valid variable name. Modifiers (":" and
+// "*") are not valid
+func validName(name string) bool {
+	if name == "" || name[0] == '.' || name[len(name)-1] == '.' {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		ch := name[i]
+		switch {
+		case 'a' <= ch && ch <= 'z', 'A' <= ch && ch <= 'Z', '0' <= ch && ch <= '9',
+			ch == '_', ch == '.':
+		case ch == '%' && i+2 < len(name) && isHex(name[i+1]) && isHex(name[i+2]):
+			i += 2
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func isHex(ch byte) bool {
+	return '0' <= ch && ch <= '9' || 'a' <= ch && ch <= 'f' || 'A' <= ch && ch <= 'F'
+}
+
+// Variables returns the names of the variables in template, in the order they
+// first appear
+func Variables(template string) ([]string, error) {
+	_, exprs, err := parse(template)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, expr := range exprs {
+		for _, name := range expr.names {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names, nil
+}
+
+// Require returns an error if template is invalid or any of the required
+// variables don't appear in it
+func Require(template string, required ...string) error {
+	names, err := Variables(template)
+	if err != nil {
+		return err
+	}
+	for _, req := range required {
+		found := false
+		for _, name := range names {
+			if name == req {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("template '%s' is missing the variable '%s'", template, req)
+		}
+	}
+	return nil
+}
+
+// Expand expands template with the values of vars. Variables which are not in
+// vars are undefined: a simple expression of only undefined variables expands
+// to the empty string, and undefined variables are left out of query
+// expressions
+func Expand(template string, vars map[string]string) (string, error) {
+	literals, exprs, err := parse(template)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for i, expr := range exprs {
+		b.WriteString(literals[i])
+		sep := ","
+		first := ""
+		switch expr.op {
+		case '?':
+			sep, first = "&", "?"
+		case '&':
+			sep, first = "&", "&"
+		}
+		n := 0
+		for _, name := range expr.names {
+			val, ok := vars[name]
+			if !ok {
+				continue
+			}
+			if n == 0 {
+				b.WriteString(first)
+			} else {
+				b.WriteString(sep)
+			}
+			n += 1
+			if expr.op != 0 {
+				b.WriteString(name)
+				b.WriteByte('=')
+			}
+			b.WriteString(Escape(val))
+		}
+	}
+	b.WriteString(literals[len(literals)-1])
+	return b.String(), nil
+}
+
+// Escape percent-encodes a value for expansion: every character except the
+// unreserved ones (RFC 3986 section 2.3) is encoded
+func Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case 'a' <= ch && ch <= 'z', 'A' <= ch && ch <= 'Z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '.', ch == '_', ch == '~':
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
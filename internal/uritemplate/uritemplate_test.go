@@ -0,0 +1,81 @@
+package uritemplate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpand(t *testing.T) {
+	vars := map[string]string{
+		"accountId": "A1",
+		"blobId":    "B/1",
+		"name":      "my file+1.pdf",
+		"type":      "application/pdf",
+		"types":     "Email,Mailbox",
+		"empty":     "",
+	}
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{
+			template: "https://example.com/upload/{accountId}/",
+			expected: "https://example.com/upload/A1/",
+		},
+		{
+			template: "https://example.com/download/{accountId}/{blobId}/{name}?accept={type}",
+			expected: "https://example.com/download/A1/B%2F1/my%20file%2B1.pdf?accept=application%2Fpdf",
+		},
+		{
+			template: "https://example.com/{accountId,blobId}",
+			expected: "https://example.com/A1,B%2F1",
+		},
+		{
+			template: "https://example.com/events{?types,closeafter,empty}",
+			expected: "https://example.com/events?types=Email%2CMailbox&empty=",
+		},
+		{
+			template: "https://example.com/events?v=1{&types,ping}",
+			expected: "https://example.com/events?v=1&types=Email%2CMailbox",
+		},
+		{
+			template: "https://example.com/{undefined}{?undefined}",
+			expected: "https://example.com/",
+		},
+		{
+			template: "https://example.com/no/variables",
+			expected: "https://example.com/no/variables",
+		},
+	}
+	for _, test := range tests {
+		actual, err := Expand(test.template, vars)
+		assert.NoError(t, err, test.template)
+		assert.Equal(t, test.expected, actual, test.template)
+	}
+
+	for _, template := range []string{
+		"https://example.com/{accountId",
+		"https://example.com/accountId}",
+		"https://example.com/{}",
+		"https://example.com/{+accountId}",
+		"https://example.com/{accountId*}",
+		"https://example.com/{accountId:3}",
+		"https://example.com/{?types,}",
+	} {
+		_, err := Expand(template, vars)
+		assert.Error(t, err, template)
+	}
+}
+
+func TestRequire(t *testing.T) {
+	assert := assert.New(t)
+	template := "https://example.com/download/{accountId}/{blobId}/{name}{?type}"
+	names, err := Variables(template)
+	assert.NoError(err)
+	assert.Equal([]string{"accountId", "blobId", "name", "type"}, names)
+
+	assert.NoError(Require(template, "accountId", "blobId", "name", "type"))
+	assert.Error(Require(template, "accountId", "closeafter"))
+	assert.Error(Require("https://example.com/{", "accountId"))
+}
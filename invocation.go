@@ -1,8 +1,8 @@
 package jmap
 
 import (
+	"bytes"
 	"encoding/json"
-	"fmt"
 )
 
 // An Invocation represents method calls and responses
@@ -25,28 +25,5 @@ func (i *Invocation) MarshalJSON() ([]byte, error) {
 }
 
 func (i *Invocation) UnmarshalJSON(data []byte) error {
-	raw := []json.RawMessage{}
-
-	err := json.Unmarshal(data, &raw)
-	if err != nil {
-		return err
-	}
-	if len(raw) != 3 {
-		return fmt.Errorf("Not enough values in invocation")
-	}
-	if err := json.Unmarshal(raw[0], &i.Name); err != nil {
-		return err
-	}
-	newFn, ok := methods[i.Name]
-	if !ok {
-		return fmt.Errorf("method '%s' not registered", i.Name)
-	}
-	i.Args = newFn()
-	if err := json.Unmarshal(raw[1], i.Args); err != nil {
-		return err
-	}
-	if err := json.Unmarshal(raw[2], &i.CallID); err != nil {
-		return err
-	}
-	return nil
+	return i.decode(json.NewDecoder(bytes.NewReader(data)), nil)
 }
@@ -2,6 +2,7 @@ package jmap
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -53,3 +54,43 @@ func TestInvocationUnmarshal(t *testing.T) {
 	assert.Truef(ok, "invocation arguments are not type test")
 	assert.Equal("world", test.Hello)
 }
+
+func TestInvocationUnmarshalUnregistered(t *testing.T) {
+	assert := assert.New(t)
+	raw := []byte(`["Vendor/unknown",{"Hello":"world"},"0"]`)
+	inv := &Invocation{}
+	err := json.Unmarshal(raw, inv)
+	assert.NoError(err)
+	assert.Equal("Vendor/unknown", inv.Name)
+	assert.Equal("0", inv.CallID)
+
+	args, ok := inv.Args.(*RawResponse)
+	if !assert.Truef(ok, "invocation arguments are not type *RawResponse") {
+		return
+	}
+	test := &test{}
+	assert.NoError(args.Decode(test))
+	assert.Equal("world", test.Hello)
+
+	// Marshals back to the same JSON
+	data, err := json.Marshal(inv)
+	assert.NoError(err)
+	assert.Equal(string(raw), string(data))
+}
+
+func TestInvocationUnmarshalFallback(t *testing.T) {
+	RegisterMethodFallback(func(name string) MethodResponseFactory {
+		if strings.HasPrefix(name, "Fallback/") {
+			return newTest
+		}
+		return nil
+	})
+	assert := assert.New(t)
+	raw := []byte(`["Fallback/method",{"Hello":"world"},"0"]`)
+	inv := &Invocation{}
+	err := json.Unmarshal(raw, inv)
+	assert.NoError(err)
+	test, ok := inv.Args.(*test)
+	assert.Truef(ok, "invocation arguments are not type test")
+	assert.Equal("world", test.Hello)
+}
@@ -0,0 +1,736 @@
+package jmaptest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~rockorager/go-jmap"
+)
+
+// A collection holds the objects of one data type, such as Mailbox, along with
+// the log of changes to them which /changes and /queryChanges are answered
+// from. T is a pointer to the type of the library, eg *mailbox.Mailbox, which
+// must have an ID field
+type collection[T any] struct {
+	// The name of the data type, eg "Mailbox"
+	name string
+	// The prefix of the ids of new objects
+	prefix string
+
+	// The state is the number of changes which have been made
+	state   int
+	objects map[jmap.ID]T
+	// The order objects were created in, by id
+	seq     map[jmap.ID]int
+	nextSeq int
+	log     []change
+	// Whether the state changed during the current request
+	dirty bool
+
+	// The results of queries, by the query and the state they were made
+	// in, for /queryChanges
+	queries map[string][]jmap.ID
+}
+
+// A change is an entry in the log of a collection
+type change struct {
+	state     int
+	id        jmap.ID
+	created   bool
+	destroyed bool
+}
+
+func newCollection[T any](name string, prefix string) *collection[T] {
+	return &collection[T]{
+		name:    name,
+		prefix:  prefix,
+		objects: make(map[jmap.ID]T),
+		seq:     make(map[jmap.ID]int),
+		queries: make(map[string][]jmap.ID),
+	}
+}
+
+// State returns the current state string
+func (c *collection[T]) State() string {
+	return strconv.Itoa(c.state)
+}
+
+// ids returns the ids of all objects, in the order they were created
+func (c *collection[T]) ids() []jmap.ID {
+	ids := make([]jmap.ID, 0, len(c.objects))
+	for id := range c.objects {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return c.seq[ids[i]] < c.seq[ids[j]] })
+	return ids
+}
+
+// all returns all objects, in the order they were created
+func (c *collection[T]) all() []T {
+	objs := []T{}
+	for _, id := range c.ids() {
+		objs = append(objs, c.objects[id])
+	}
+	return objs
+}
+
+func (c *collection[T]) record(id jmap.ID, created bool, destroyed bool) {
+	c.state += 1
+	c.dirty = true
+	c.log = append(c.log, change{
+		state:     c.state,
+		id:        id,
+		created:   created,
+		destroyed: destroyed,
+	})
+}
+
+// add stores a new object, assigning it an id
+func (c *collection[T]) add(obj T) jmap.ID {
+	c.nextSeq += 1
+	id := jmap.ID(fmt.Sprintf("%s%d", c.prefix, c.nextSeq))
+	setID(obj, id)
+	c.objects[id] = obj
+	c.seq[id] = c.nextSeq
+	c.record(id, true, false)
+	return id
+}
+
+// put replaces an object
+func (c *collection[T]) put(id jmap.ID, obj T) {
+	setID(obj, id)
+	c.objects[id] = obj
+	c.record(id, false, false)
+}
+
+// touch records an object as updated, eg when its computed properties changed
+func (c *collection[T]) touch(id jmap.ID) {
+	if _, ok := c.objects[id]; ok {
+		c.record(id, false, false)
+	}
+}
+
+// remove destroys an object
+func (c *collection[T]) remove(id jmap.ID) {
+	delete(c.objects, id)
+	delete(c.seq, id)
+	c.record(id, false, true)
+}
+
+// get returns the objects with the given ids, or all objects if ids is nil,
+// with only the given properties (and the id). Objects which don't exist are
+// returned as not found
+func (c *collection[T]) get(ids []jmap.ID, properties []string) ([]T, []jmap.ID, error) {
+	if ids == nil {
+		ids = c.ids()
+	}
+	list := []T{}
+	notFound := []jmap.ID{}
+	for _, id := range ids {
+		obj, ok := c.objects[id]
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+		obj, err := project(obj, properties)
+		if err != nil {
+			return nil, nil, err
+		}
+		list = append(list, obj)
+	}
+	return list, notFound, nil
+}
+
+// changes returns the ids of the objects created, updated and destroyed since
+// a state. At most max ids are returned if max is not zero, in which case
+// newState may be an intermediate state
+func (c *collection[T]) changes(since string, max uint64) (created, updated, destroyed []jmap.ID, newState string, more bool, err error) {
+	from, err := c.parseState(since)
+	if err != nil {
+		return nil, nil, nil, "", false, err
+	}
+	// The log is in state order. Changes are added a state at a time
+	// while they fit in max
+	type status struct {
+		created   bool
+		destroyed bool
+	}
+	changed := map[jmap.ID]*status{}
+	order := []jmap.ID{}
+	to := c.state
+	for _, entry := range c.log {
+		if entry.state <= from {
+			continue
+		}
+		if _, ok := changed[entry.id]; !ok {
+			if max > 0 && uint64(len(changed)) >= max {
+				to = entry.state - 1
+				more = true
+				break
+			}
+			changed[entry.id] = &status{}
+			order = append(order, entry.id)
+		}
+		st := changed[entry.id]
+		st.created = st.created || entry.created
+		st.destroyed = st.destroyed || entry.destroyed
+	}
+	created, updated, destroyed = []jmap.ID{}, []jmap.ID{}, []jmap.ID{}
+	for _, id := range order {
+		st := changed[id]
+		switch {
+		case st.created && st.destroyed:
+			// Never seen by the client
+		case st.created:
+			created = append(created, id)
+		case st.destroyed:
+			destroyed = append(destroyed, id)
+		default:
+			updated = append(updated, id)
+		}
+	}
+	return created, updated, destroyed, strconv.Itoa(to), more, nil
+}
+
+// changedSince returns the ids of the objects changed in any way since a state
+func (c *collection[T]) changedSince(from int) map[jmap.ID]bool {
+	changed := map[jmap.ID]bool{}
+	for _, entry := range c.log {
+		if entry.state > from {
+			changed[entry.id] = true
+		}
+	}
+	return changed
+}
+
+// parseState parses a state string of the collection
+func (c *collection[T]) parseState(state string) (int, error) {
+	n, err := strconv.Atoi(state)
+	if err != nil || n < 0 || n > c.state {
+		return 0, methodError(jmap.ErrCannotCalculateChanges, "unknown state "+strconv.Quote(state))
+	}
+	return n, nil
+}
+
+// checkState returns a stateMismatch error if ifInState is set and isn't the
+// current state
+func (c *collection[T]) checkState(ifInState string) error {
+	if ifInState != "" && ifInState != c.State() {
+		return methodError(jmap.ErrStateMismatch, "")
+	}
+	return nil
+}
+
+// setHooks validate and complete the objects of a /set call. Each returns a
+// SetError to reject the object
+type setHooks[T any] struct {
+	// create completes an object before it is stored, eg by setting the
+	// server-set properties
+	create func(obj T) *jmap.SetError
+	// update checks an updated object before it is stored
+	update func(old T, obj T, patch jmap.Patch) *jmap.SetError
+	// destroy checks an object before it is destroyed
+	destroy func(obj T) *jmap.SetError
+	// created, updated and destroyed are called after the change is
+	// stored
+	created   func(obj T)
+	updated   func(old T, obj T)
+	destroyed func(obj T)
+}
+
+// setResult is the result of a /set call, to be copied to the response type
+// of the library
+type setResult[T any] struct {
+	oldState     string
+	newState     string
+	created      map[jmap.ID]T
+	updated      map[jmap.ID]T
+	destroyed    []jmap.ID
+	notCreated   map[jmap.ID]*jmap.SetError
+	notUpdated   map[jmap.ID]*jmap.SetError
+	notDestroyed map[jmap.ID]*jmap.SetError
+}
+
+// set performs a /set call. The ids of created objects are added to created,
+// by their creation id
+func (c *collection[T]) set(ifInState string, create map[jmap.ID]T, update map[jmap.ID]jmap.Patch, destroy []jmap.ID, hooks setHooks[T], createdIDs map[jmap.ID]jmap.ID) (*setResult[T], error) {
+	if err := c.checkState(ifInState); err != nil {
+		return nil, err
+	}
+	result := &setResult[T]{
+		oldState: c.State(),
+	}
+
+	cids := make([]jmap.ID, 0, len(create))
+	for cid := range create {
+		cids = append(cids, cid)
+	}
+	sort.Slice(cids, func(i, j int) bool { return cids[i] < cids[j] })
+	for _, cid := range cids {
+		obj := create[cid]
+		if reflect.ValueOf(obj).IsNil() {
+			setErr(&result.notCreated, cid, invalidProperties())
+			continue
+		}
+		if hooks.create != nil {
+			if err := hooks.create(obj); err != nil {
+				setErr(&result.notCreated, cid, err)
+				continue
+			}
+		}
+		id := c.add(obj)
+		createdIDs[cid] = id
+		if hooks.created != nil {
+			hooks.created(obj)
+		}
+		if result.created == nil {
+			result.created = make(map[jmap.ID]T)
+		}
+		// The server-set properties are returned
+		result.created[cid], _ = clone(obj)
+	}
+
+	ids := make([]jmap.ID, 0, len(update))
+	for id := range update {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		old, ok := c.objects[id]
+		if !ok {
+			setErr(&result.notUpdated, id, &jmap.SetError{Type: string(jmap.ErrNotFound)})
+			continue
+		}
+		obj, err := applyPatch(old, update[id])
+		if err != nil {
+			desc := err.Error()
+			setErr(&result.notUpdated, id, &jmap.SetError{Type: string(jmap.ErrInvalidPatch), Description: &desc})
+			continue
+		}
+		if hooks.update != nil {
+			if err := hooks.update(old, obj, update[id]); err != nil {
+				setErr(&result.notUpdated, id, err)
+				continue
+			}
+		}
+		c.put(id, obj)
+		if hooks.updated != nil {
+			hooks.updated(old, obj)
+		}
+		if result.updated == nil {
+			result.updated = make(map[jmap.ID]T)
+		}
+		var none T
+		result.updated[id] = none
+	}
+
+	for _, id := range destroy {
+		obj, ok := c.objects[id]
+		if !ok {
+			setErr(&result.notDestroyed, id, &jmap.SetError{Type: string(jmap.ErrNotFound)})
+			continue
+		}
+		if hooks.destroy != nil {
+			if err := hooks.destroy(obj); err != nil {
+				setErr(&result.notDestroyed, id, err)
+				continue
+			}
+		}
+		c.remove(id)
+		if hooks.destroyed != nil {
+			hooks.destroyed(obj)
+		}
+		result.destroyed = append(result.destroyed, id)
+	}
+	result.newState = c.State()
+	return result, nil
+}
+
+func setErr(m *map[jmap.ID]*jmap.SetError, id jmap.ID, err *jmap.SetError) {
+	if *m == nil {
+		*m = make(map[jmap.ID]*jmap.SetError)
+	}
+	(*m)[id] = err
+}
+
+func invalidProperties(props ...string) *jmap.SetError {
+	err := &jmap.SetError{Type: string(jmap.ErrInvalidProperties)}
+	if len(props) > 0 {
+		err.Properties = &props
+	}
+	return err
+}
+
+// queryResult is the result of a /query call, to be copied to the response
+// type of the library
+type queryResult struct {
+	queryState string
+	position   uint64
+	ids        []jmap.ID
+	total      uint64
+}
+
+// A querySpec is the filter and sort of a query
+type querySpec[T any] struct {
+	// key identifies the filter and sort, to answer /queryChanges
+	key   string
+	match func(T) (bool, error)
+	less  func(a, b T) int
+	// If collapse is set, only the first object with each collapse key
+	// is kept (eg an Email of each Thread)
+	collapse func(T) jmap.ID
+}
+
+// query performs a /query call: the ids of the objects which match are sorted,
+// and the window given by position or anchor and limit is returned
+func (c *collection[T]) query(q querySpec[T], position int64, anchor jmap.ID, anchorOffset int64, limit uint64) (*queryResult, error) {
+	ids, err := c.queryIDs(q)
+	if err != nil {
+		return nil, err
+	}
+	c.queries[q.key+"@"+c.State()] = ids
+
+	start := int64(0)
+	switch {
+	case anchor != "":
+		i := indexOf(ids, anchor)
+		if i < 0 {
+			return nil, methodError(jmap.ErrAnchorNotFound, "")
+		}
+		start = int64(i) + anchorOffset
+	case position < 0:
+		start = int64(len(ids)) + position
+	default:
+		start = position
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > int64(len(ids)) {
+		start = int64(len(ids))
+	}
+	end := int64(len(ids))
+	if limit > 0 && start+int64(limit) < end {
+		end = start + int64(limit)
+	}
+	return &queryResult{
+		queryState: c.State(),
+		position:   uint64(start),
+		ids:        append([]jmap.ID{}, ids[start:end]...),
+		total:      uint64(len(ids)),
+	}, nil
+}
+
+func (c *collection[T]) queryIDs(q querySpec[T]) ([]jmap.ID, error) {
+	objs := []T{}
+	for _, obj := range c.all() {
+		ok, err := q.match(obj)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			objs = append(objs, obj)
+		}
+	}
+	sort.SliceStable(objs, func(i, j int) bool { return q.less(objs[i], objs[j]) < 0 })
+	ids := make([]jmap.ID, 0, len(objs))
+	seen := map[jmap.ID]bool{}
+	for _, obj := range objs {
+		if q.collapse != nil {
+			key := q.collapse(obj)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		ids = append(ids, getID(obj))
+	}
+	return ids, nil
+}
+
+// queryChangesResult is the result of a /queryChanges call
+type queryChangesResult struct {
+	oldQueryState string
+	newQueryState string
+	removed       []jmap.ID
+	added         []*jmap.AddedItem
+	total         uint64
+}
+
+// queryChanges performs a /queryChanges call. The results of the query in
+// sinceQueryState must be known from an earlier /query or /queryChanges
+// call. Every object which changed since then is removed, and added again if
+// it is in the results
+func (c *collection[T]) queryChanges(q querySpec[T], sinceQueryState string, maxChanges uint64) (*queryChangesResult, error) {
+	from, err := c.parseState(sinceQueryState)
+	if err != nil {
+		return nil, err
+	}
+	old, ok := c.queries[q.key+"@"+sinceQueryState]
+	if !ok {
+		return nil, methodError(jmap.ErrCannotCalculateChanges, "unknown query state")
+	}
+	ids, err := c.queryIDs(q)
+	if err != nil {
+		return nil, err
+	}
+	c.queries[q.key+"@"+c.State()] = ids
+
+	changed := c.changedSince(from)
+	inNew := make(map[jmap.ID]bool, len(ids))
+	for _, id := range ids {
+		inNew[id] = true
+	}
+	inOld := make(map[jmap.ID]bool, len(old))
+	result := &queryChangesResult{
+		oldQueryState: sinceQueryState,
+		newQueryState: c.State(),
+		removed:       []jmap.ID{},
+		added:         []*jmap.AddedItem{},
+		total:         uint64(len(ids)),
+	}
+	for _, id := range old {
+		inOld[id] = true
+		if changed[id] || !inNew[id] {
+			result.removed = append(result.removed, id)
+		}
+	}
+	for i, id := range ids {
+		if changed[id] || !inOld[id] {
+			result.added = append(result.added, &jmap.AddedItem{ID: id, Index: uint64(i)})
+		}
+	}
+	if maxChanges > 0 && uint64(len(result.removed)+len(result.added)) > maxChanges {
+		return nil, methodError(jmap.ErrTooManyChanges, "")
+	}
+	return result, nil
+}
+
+func indexOf(ids []jmap.ID, id jmap.ID) int {
+	for i, v := range ids {
+		if v == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// queryKey identifies the filter and sort of a query
+func queryKey(filter json.RawMessage, sort interface{}) string {
+	data, _ := json.Marshal(sort)
+	var v interface{}
+	if len(filter) > 0 {
+		json.Unmarshal(filter, &v)
+	}
+	f, _ := json.Marshal(v)
+	return string(f) + "|" + string(data)
+}
+
+// matchFilter evaluates a filter of a /query call. FilterOperators are
+// evaluated here, and each FilterCondition with cond. An empty filter matches
+// everything
+func matchFilter(filter json.RawMessage, cond func(json.RawMessage) (bool, error)) (bool, error) {
+	if len(filter) == 0 || string(filter) == "null" {
+		return true, nil
+	}
+	op := struct {
+		Operator   jmap.Operator     `json:"operator"`
+		Conditions []json.RawMessage `json:"conditions"`
+	}{}
+	if err := json.Unmarshal(filter, &op); err != nil {
+		return false, methodError(jmap.ErrInvalidArguments, err.Error())
+	}
+	if op.Operator == "" {
+		return cond(filter)
+	}
+	for _, c := range op.Conditions {
+		ok, err := matchFilter(c, cond)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case op.Operator == jmap.OperatorAND && !ok:
+			return false, nil
+		case op.Operator == jmap.OperatorOR && ok:
+			return true, nil
+		case op.Operator == jmap.OperatorNOT && ok:
+			return false, nil
+		}
+	}
+	switch op.Operator {
+	case jmap.OperatorAND, jmap.OperatorNOT:
+		return true, nil
+	case jmap.OperatorOR:
+		return false, nil
+	}
+	return false, methodError(jmap.ErrUnsupportedFilter, "unknown operator "+string(op.Operator))
+}
+
+// decodeCondition decodes a FilterCondition, and rejects properties the
+// condition type doesn't have
+func decodeCondition(data json.RawMessage, cond interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cond); err != nil {
+		return methodError(jmap.ErrUnsupportedFilter, err.Error())
+	}
+	return nil
+}
+
+// getID returns the ID field of an object
+func getID[T any](obj T) jmap.ID {
+	return jmap.ID(reflect.ValueOf(obj).Elem().FieldByName("ID").String())
+}
+
+// setID sets the ID field of an object
+func setID[T any](obj T, id jmap.ID) {
+	reflect.ValueOf(obj).Elem().FieldByName("ID").SetString(string(id))
+}
+
+// newObject returns a new zero object of type T, which is a pointer
+func newObject[T any]() T {
+	var obj T
+	return reflect.New(reflect.TypeOf(obj).Elem()).Interface().(T)
+}
+
+// clone returns a deep copy of an object
+func clone[T any](obj T) (T, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return obj, err
+	}
+	c := newObject[T]()
+	err = json.Unmarshal(data, c)
+	return c, err
+}
+
+// project returns a copy of an object with only the given properties, and the
+// id. If properties is nil, all properties are kept
+func project[T any](obj T, properties []string) (T, error) {
+	if properties == nil {
+		return clone(obj)
+	}
+	m := map[string]json.RawMessage{}
+	if err := toJSON(obj, &m); err != nil {
+		return obj, err
+	}
+	keep := map[string]json.RawMessage{"id": m["id"]}
+	for _, prop := range properties {
+		if v, ok := m[prop]; ok {
+			keep[prop] = v
+		}
+	}
+	p := newObject[T]()
+	err := toJSON(keep, p)
+	return p, err
+}
+
+// toJSON converts v to dst by way of JSON
+func toJSON(v interface{}, dst interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
+
+// applyPatch returns a copy of an object with a PatchObject applied
+func applyPatch[T any](obj T, patch jmap.Patch) (T, error) {
+	var generic map[string]interface{}
+	if err := toJSON(obj, &generic); err != nil {
+		return obj, err
+	}
+	paths := make([]string, 0, len(patch))
+	for path := range patch {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if path == "id" {
+			return obj, fmt.Errorf("id can't be changed")
+		}
+		parts := strings.Split(path, "/")
+		parent := generic
+		for _, part := range parts[:len(parts)-1] {
+			part = unescapePointer(part)
+			next, ok := parent[part].(map[string]interface{})
+			if !ok {
+				if parent[part] != nil {
+					return obj, fmt.Errorf("%s is not an object", path)
+				}
+				// Empty maps are omitted when encoded
+				next = map[string]interface{}{}
+				parent[part] = next
+			}
+			parent = next
+		}
+		last := unescapePointer(parts[len(parts)-1])
+		if patch[path] == nil {
+			delete(parent, last)
+		} else {
+			parent[last] = patch[path]
+		}
+	}
+	p := newObject[T]()
+	if err := toJSON(generic, p); err != nil {
+		return obj, err
+	}
+	return p, nil
+}
+
+func unescapePointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~1", "/"), "~0", "~")
+}
+
+// compare compares values for sorting
+func compare[V ~string | ~uint64 | ~int64](a V, b V) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// A comparator is a sort comparator of a /query call
+type comparator struct {
+	property  string
+	ascending bool
+}
+
+// sorter returns the function which sorts objects by comparators, using the
+// compare function of each property in fields. Objects which compare equal
+// stay in the order they were created
+func sorter[T any](comparators []comparator, fields map[string]func(a, b T) int) (func(a, b T) int, error) {
+	cmps := make([]func(a, b T) int, 0, len(comparators))
+	for _, c := range comparators {
+		fn, ok := fields[c.property]
+		if !ok {
+			return nil, methodError(jmap.ErrUnsupportedSort, "can't sort by "+c.property)
+		}
+		if !c.ascending {
+			asc := fn
+			fn = func(a, b T) int { return -asc(a, b) }
+		}
+		cmps = append(cmps, fn)
+	}
+	return func(a, b T) int {
+		for _, cmp := range cmps {
+			if n := cmp(a, b); n != 0 {
+				return n
+			}
+		}
+		return 0
+	}, nil
+}
+
+// containsFold reports whether substr is in s, ignoring case
+func containsFold(s string, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
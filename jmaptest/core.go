@@ -0,0 +1,132 @@
+package jmaptest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.sr.ht/~rockorager/go-jmap"
+	"git.sr.ht/~rockorager/go-jmap/core"
+	"git.sr.ht/~rockorager/go-jmap/core/blob"
+)
+
+// A storedBlob is binary data uploaded to the Server, or the message of an
+// Email or one of its parts
+type storedBlob struct {
+	data      []byte
+	mediaType string
+}
+
+func (s *Server) registerCore() {
+	s.handle("Core/echo", core.URI, func(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+		return args, nil
+	})
+	s.handle("Blob/copy", core.URI, s.blobCopy)
+}
+
+// addBlob stores binary data, and returns its id
+func (s *Server) addBlob(data []byte, mediaType string) jmap.ID {
+	s.nextBlob += 1
+	id := jmap.ID(fmt.Sprintf("B%d", s.nextBlob))
+	s.blobs[id] = &storedBlob{data: data, mediaType: mediaType}
+	return id
+}
+
+// Blobs can only be copied within the account of the Server
+func (s *Server) blobCopy(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &blob.Copy{}
+	if err := decodeArgs(args, req, nil); err != nil {
+		return nil, err
+	}
+	if req.FromAccount != AccountID {
+		return nil, methodError(jmap.ErrFromAccountNotFound, "")
+	}
+	if req.Account != AccountID {
+		return nil, methodError(jmap.ErrAccountNotFound, "")
+	}
+	resp := &blob.CopyResponse{
+		FromAccount: req.FromAccount,
+		Account:     req.Account,
+	}
+	for _, id := range req.IDs {
+		if _, ok := s.blobs[id]; !ok {
+			setErr(&resp.NotCopied, id, &jmap.SetError{Type: string(jmap.ErrNotFound)})
+			continue
+		}
+		if resp.Copied == nil {
+			resp.Copied = make(map[jmap.ID]jmap.ID)
+		}
+		resp.Copied[id] = id
+	}
+	return resp, nil
+}
+
+// accountPath returns the account id and the rest of the path of a request to
+// an endpoint with the given prefix
+func accountPath(r *http.Request, prefix string) (jmap.ID, []string) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	return jmap.ID(parts[0]), parts[1:]
+}
+
+func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	account, _ := accountPath(r, "/jmap/upload/")
+	if account != AccountID {
+		http.Error(w, "account not found", http.StatusNotFound)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mediaType := r.Header.Get("Content-Type")
+	if mediaType == "" {
+		mediaType = "application/octet-stream"
+	}
+	s.mu.Lock()
+	id := s.addBlob(data, mediaType)
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, &jmap.UploadResponse{
+		Account: account,
+		ID:      id,
+		Type:    mediaType,
+		Size:    uint64(len(data)),
+	})
+}
+
+func (s *Server) serveDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	account, rest := accountPath(r, "/jmap/download/")
+	if account != AccountID || len(rest) != 2 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	s.mu.Lock()
+	b, ok := s.blobs[jmap.ID(rest[0])]
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "blob not found", http.StatusNotFound)
+		return
+	}
+	mediaType := r.URL.Query().Get("accept")
+	if mediaType == "" {
+		mediaType = b.mediaType
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": rest[1]}))
+	// Blobs are immutable, so their id is a strong ETag
+	w.Header().Set("ETag", `"`+rest[0]+`"`)
+	http.ServeContent(w, r, rest[1], time.Time{}, bytes.NewReader(b.data))
+}
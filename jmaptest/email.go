@@ -0,0 +1,607 @@
+package jmaptest
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"git.sr.ht/~rockorager/go-jmap"
+	"git.sr.ht/~rockorager/go-jmap/mail"
+	"git.sr.ht/~rockorager/go-jmap/mail/email"
+	"git.sr.ht/~rockorager/go-jmap/mail/mailbox"
+	"git.sr.ht/~rockorager/go-jmap/mail/thread"
+)
+
+// The properties returned by Email/get when none are given, as listed in RFC
+// 8621 section 4.2
+var defaultEmailProperties = []string{
+	"id", "blobId", "threadId", "mailboxIds", "keywords", "size",
+	"receivedAt", "messageId", "inReplyTo", "references", "sender", "from",
+	"to", "cc", "bcc", "replyTo", "subject", "sentAt", "hasAttachment",
+	"preview", "bodyValues", "textBody", "htmlBody", "attachments",
+}
+
+// emailQuery decodes the filter of an Email/query or queryChanges call, which
+// the library types only encode
+type emailQuery struct {
+	email.Query
+	Filter json.RawMessage `json:"filter,omitempty"`
+}
+
+type emailQueryChanges struct {
+	email.QueryChanges
+	Filter json.RawMessage `json:"filter,omitempty"`
+}
+
+// Deliver delivers an RFC 5322 message to the Inbox, as if it was received
+// from another server. Clients connected to the EventSource are notified of
+// the changes, with an EmailDelivery event. It returns the id of the new Email
+func (s *Server) Deliver(message []byte) (jmap.ID, error) {
+	s.mu.Lock()
+	e, err := s.parseMessage(message)
+	if err != nil {
+		s.mu.Unlock()
+		return "", err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	e.ReceivedAt = &now
+	e.MailboxIDs = map[jmap.ID]bool{s.mailboxRole(mailbox.RoleInbox): true}
+	id := s.addEmail(e)
+	s.delivered = true
+	change := s.stateChange()
+	s.mu.Unlock()
+	s.broadcast(change)
+	return id, nil
+}
+
+// addEmail stores a new Email in its Thread
+func (s *Server) addEmail(e *email.Email) jmap.ID {
+	s.assignThread(e)
+	id := s.emails.add(e)
+	s.emailAdded(e)
+	return id
+}
+
+// assignThread sets the Thread of a new Email: the Thread of an Email it
+// replies to or references, or a new one
+func (s *Server) assignThread(e *email.Email) {
+	related := map[string]bool{}
+	for _, id := range append(append([]string{}, e.InReplyTo...), e.References...) {
+		related[id] = true
+	}
+	for _, other := range s.emails.all() {
+		for _, id := range other.MessageID {
+			if related[id] {
+				e.ThreadID = other.ThreadID
+				return
+			}
+		}
+	}
+	e.ThreadID = s.threads.add(&thread.Thread{})
+}
+
+// emailAdded adds a new Email to its Thread, and records the change of the
+// counts of its Mailboxes
+func (s *Server) emailAdded(e *email.Email) {
+	t, _ := clone(s.threads.objects[e.ThreadID])
+	t.EmailIDs = append(t.EmailIDs, e.ID)
+	// Threads are sorted by receivedAt, oldest first
+	sort.SliceStable(t.EmailIDs, func(i, j int) bool {
+		return receivedAt(s.emails.objects[t.EmailIDs[i]]) < receivedAt(s.emails.objects[t.EmailIDs[j]])
+	})
+	s.threads.put(t.ID, t)
+	s.touchMailboxes(e.MailboxIDs)
+}
+
+// destroyEmail destroys an Email
+func (s *Server) destroyEmail(e *email.Email) {
+	s.emails.remove(e.ID)
+	s.emailDestroyed(e)
+}
+
+// emailDestroyed removes a destroyed Email from its Thread, which is
+// destroyed if it is empty
+func (s *Server) emailDestroyed(e *email.Email) {
+	t, _ := clone(s.threads.objects[e.ThreadID])
+	ids := []jmap.ID{}
+	for _, id := range t.EmailIDs {
+		if id != e.ID {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		s.threads.remove(t.ID)
+	} else {
+		t.EmailIDs = ids
+		s.threads.put(t.ID, t)
+	}
+	s.touchMailboxes(e.MailboxIDs)
+}
+
+// touchMailboxes records Mailboxes as updated, as their counts changed
+func (s *Server) touchMailboxes(ids ...map[jmap.ID]bool) {
+	touched := map[jmap.ID]bool{}
+	for _, m := range ids {
+		for id := range m {
+			touched[id] = true
+		}
+	}
+	for _, id := range sortedIDs(touched) {
+		s.mailboxes.touch(id)
+	}
+}
+
+// checkMailboxes returns a SetError if an Email isn't in any Mailbox, or in
+// one which doesn't exist
+func (s *Server) checkMailboxes(ids map[jmap.ID]bool) *jmap.SetError {
+	if len(ids) == 0 {
+		return invalidProperties("mailboxIds")
+	}
+	for id, in := range ids {
+		if !in || s.mailboxes.objects[id] == nil {
+			return invalidProperties("mailboxIds")
+		}
+	}
+	return nil
+}
+
+func receivedAt(e *email.Email) int64 {
+	return unixNano(e.ReceivedAt)
+}
+
+func unixNano(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func (s *Server) emailGet(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &email.Get{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	properties := req.Properties
+	if properties == nil {
+		properties = defaultEmailProperties
+	}
+	list, notFound, err := s.emails.get(req.IDs, properties)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range list {
+		e.BodyValues = nil
+		for _, prop := range properties {
+			if prop == "bodyValues" {
+				e.BodyValues = s.bodyValues(s.emails.objects[e.ID], req)
+			}
+		}
+	}
+	resp := &email.GetResponse{
+		Account: req.Account,
+		State:   s.emails.State(),
+		List:    list,
+	}
+	if len(notFound) > 0 {
+		resp.NotFound = notFound
+	}
+	return resp, nil
+}
+
+// bodyValues returns the bodyValues of an Email requested by the fetch
+// arguments of an Email/get call
+func (s *Server) bodyValues(e *email.Email, req *email.Get) map[string]*email.BodyValue {
+	parts := []*email.BodyPart{}
+	if req.FetchTextBodyValues || req.FetchAllBodyValues {
+		parts = append(parts, e.TextBody...)
+	}
+	if req.FetchHTMLBodyValues || req.FetchAllBodyValues {
+		parts = append(parts, e.HTMLBody...)
+	}
+	values := map[string]*email.BodyValue{}
+	add := func(partID string) {
+		value, ok := e.BodyValues[partID]
+		if !ok {
+			return
+		}
+		v := *value
+		if req.MaxBodyValueBytes > 0 && uint64(len(v.Value)) > req.MaxBodyValueBytes {
+			// Truncate at a character boundary
+			end := int(req.MaxBodyValueBytes)
+			for end > 0 && !utf8.RuneStart(v.Value[end]) {
+				end -= 1
+			}
+			v.Value = v.Value[:end]
+			v.IsTruncated = true
+		}
+		values[partID] = &v
+	}
+	for _, part := range parts {
+		add(part.PartID)
+	}
+	if req.FetchAllBodyValues {
+		for partID := range e.BodyValues {
+			add(partID)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return values
+}
+
+func (s *Server) emailChanges(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &email.Changes{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	created, updated, destroyed, newState, more, err := s.emails.changes(req.SinceState, req.MaxChanges)
+	if err != nil {
+		return nil, err
+	}
+	return &email.ChangesResponse{
+		Account:        req.Account,
+		OldState:       req.SinceState,
+		NewState:       newState,
+		HasMoreChanges: more,
+		Created:        created,
+		Updated:        updated,
+		Destroyed:      destroyed,
+	}, nil
+}
+
+// emailQuerySpec returns the querySpec of an Email/query or queryChanges call
+func (s *Server) emailQuerySpec(filter json.RawMessage, comparators []*email.SortComparator, collapseThreads bool) (querySpec[*email.Email], error) {
+	match := func(e *email.Email) (bool, error) {
+		return matchFilter(filter, func(data json.RawMessage) (bool, error) {
+			cond := &email.FilterCondition{}
+			if err := decodeCondition(data, cond); err != nil {
+				return false, err
+			}
+			// hasAttachment may be false, which the library type
+			// doesn't tell apart from a missing value
+			raw := map[string]json.RawMessage{}
+			json.Unmarshal(data, &raw)
+			var hasAttachment *bool
+			if v, ok := raw["hasAttachment"]; ok {
+				hasAttachment = new(bool)
+				json.Unmarshal(v, hasAttachment)
+			}
+			return s.matchEmail(e, cond, hasAttachment)
+		})
+	}
+	address := func(addrs []*mail.Address) string {
+		if len(addrs) == 0 {
+			return ""
+		}
+		if addrs[0].Name != "" {
+			return strings.ToLower(addrs[0].Name)
+		}
+		return strings.ToLower(addrs[0].Email)
+	}
+	fields := map[string]func(a, b *email.Email) int{
+		"receivedAt": func(a, b *email.Email) int { return compare(unixNano(a.ReceivedAt), unixNano(b.ReceivedAt)) },
+		"sentAt":     func(a, b *email.Email) int { return compare(unixNano(a.SentAt), unixNano(b.SentAt)) },
+		"size":       func(a, b *email.Email) int { return compare(a.Size, b.Size) },
+		"subject":    func(a, b *email.Email) int { return compare(strings.ToLower(a.Subject), strings.ToLower(b.Subject)) },
+		"from":       func(a, b *email.Email) int { return compare(address(a.From), address(b.From)) },
+		"to":         func(a, b *email.Email) int { return compare(address(a.To), address(b.To)) },
+	}
+	cmps := []comparator{}
+	for _, c := range comparators {
+		cmps = append(cmps, comparator{property: c.Property, ascending: c.IsAscending})
+	}
+	less, err := sorter(cmps, fields)
+	q := querySpec[*email.Email]{
+		key:   queryKey(filter, comparators),
+		match: match,
+		less:  less,
+	}
+	if collapseThreads {
+		q.key += "|collapse"
+		q.collapse = func(e *email.Email) jmap.ID { return e.ThreadID }
+	}
+	return q, err
+}
+
+// matchEmail evaluates an Email/query FilterCondition
+func (s *Server) matchEmail(e *email.Email, cond *email.FilterCondition, hasAttachment *bool) (bool, error) {
+	if cond.HasSMIME || cond.HasVerifiedSMIME || cond.HasVerifiedSMIMEAtDelivery {
+		return false, methodError(jmap.ErrUnsupportedFilter, "S/MIME filters are not supported")
+	}
+	addresses := func(addrs []*mail.Address) string {
+		list := []string{}
+		for _, addr := range addrs {
+			list = append(list, addr.String())
+		}
+		return strings.Join(list, ", ")
+	}
+	body := func() string {
+		text := []string{}
+		for _, value := range e.BodyValues {
+			text = append(text, value.Value)
+		}
+		return strings.Join(text, "\n")
+	}
+	inThread := func(keyword string) (some bool, all bool) {
+		all = true
+		for _, id := range s.threads.objects[e.ThreadID].EmailIDs {
+			if s.emails.objects[id].Keywords[keyword] {
+				some = true
+			} else {
+				all = false
+			}
+		}
+		return some, all
+	}
+	checks := []func() bool{
+		func() bool { return cond.InMailbox == "" || e.MailboxIDs[cond.InMailbox] },
+		func() bool {
+			if cond.InMailboxOtherThan == nil {
+				return true
+			}
+			for id := range e.MailboxIDs {
+				if indexOf(cond.InMailboxOtherThan, id) < 0 {
+					return true
+				}
+			}
+			return false
+		},
+		func() bool { return cond.Before == nil || receivedAt(e) < cond.Before.UnixNano() },
+		func() bool { return cond.After == nil || receivedAt(e) >= cond.After.UnixNano() },
+		func() bool { return cond.MinSize == 0 || e.Size >= cond.MinSize },
+		func() bool { return cond.MaxSize == 0 || e.Size < cond.MaxSize },
+		func() bool {
+			_, all := inThread(cond.AllInThreadHaveKeyword)
+			return cond.AllInThreadHaveKeyword == "" || all
+		},
+		func() bool {
+			some, _ := inThread(cond.SomeInThreadHaveKeyword)
+			return cond.SomeInThreadHaveKeyword == "" || some
+		},
+		func() bool {
+			some, _ := inThread(cond.NoneInThreadHaveKeyword)
+			return cond.NoneInThreadHaveKeyword == "" || !some
+		},
+		func() bool { return cond.HasKeyword == "" || e.Keywords[cond.HasKeyword] },
+		func() bool { return cond.NotKeyword == "" || !e.Keywords[cond.NotKeyword] },
+		func() bool { return hasAttachment == nil || e.HasAttachment == *hasAttachment },
+		func() bool { return cond.From == "" || containsFold(addresses(e.From), cond.From) },
+		func() bool { return cond.To == "" || containsFold(addresses(e.To), cond.To) },
+		func() bool { return cond.Cc == "" || containsFold(addresses(e.CC), cond.Cc) },
+		func() bool { return cond.Bcc == "" || containsFold(addresses(e.BCC), cond.Bcc) },
+		func() bool { return cond.Subject == "" || containsFold(e.Subject, cond.Subject) },
+		func() bool { return cond.Body == "" || containsFold(body(), cond.Body) },
+		func() bool {
+			if cond.Text == "" {
+				return true
+			}
+			text := strings.Join([]string{
+				addresses(e.From), addresses(e.To), addresses(e.CC),
+				addresses(e.BCC), e.Subject, body(),
+			}, "\n")
+			return containsFold(text, cond.Text)
+		},
+		func() bool {
+			if len(cond.Header) == 0 {
+				return true
+			}
+			for _, h := range e.Headers {
+				if !strings.EqualFold(h.Name, cond.Header[0]) {
+					continue
+				}
+				if len(cond.Header) < 2 || containsFold(h.Value, cond.Header[1]) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+	for _, check := range checks {
+		if !check() {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (s *Server) emailQuery(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &emailQuery{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	q, err := s.emailQuerySpec(req.Filter, req.Sort, req.CollapseThreads)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.emails.query(q, req.Position, req.Anchor, req.AnchorOffset, req.Limit)
+	if err != nil {
+		return nil, err
+	}
+	resp := &email.QueryResponse{
+		Account:             req.Account,
+		QueryState:          result.queryState,
+		CanCalculateChanges: true,
+		Position:            result.position,
+		IDs:                 result.ids,
+		Limit:               req.Limit,
+	}
+	if req.CalculateTotal {
+		resp.Total = result.total
+	}
+	return resp, nil
+}
+
+func (s *Server) emailQueryChanges(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &emailQueryChanges{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	q, err := s.emailQuerySpec(req.Filter, req.Sort, req.CollapseThreads)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.emails.queryChanges(q, req.SinceQueryState, req.MaxChanges)
+	if err != nil {
+		return nil, err
+	}
+	resp := &email.QueryChangesResponse{
+		Account:       req.Account,
+		OldQueryState: result.oldQueryState,
+		NewQueryState: result.newQueryState,
+		Removed:       result.removed,
+	}
+	for _, item := range result.added {
+		resp.Added = append(resp.Added, *item)
+	}
+	return resp, nil
+}
+
+func (s *Server) emailSet(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &email.Set{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	return s.setEmails(r, req)
+}
+
+// setEmails performs an Email/set call. Only the mailboxIds and keywords of an
+// Email can be updated
+func (s *Server) setEmails(r *jmap.MethodCall, req *email.Set) (*email.SetResponse, error) {
+	hooks := setHooks[*email.Email]{
+		create: func(e *email.Email) *jmap.SetError {
+			if err := s.checkMailboxes(e.MailboxIDs); err != nil {
+				return err
+			}
+			raw, err := s.renderMessage(e)
+			if err != nil {
+				var setErr *jmap.SetError
+				if errors.As(err, &setErr) {
+					return setErr
+				}
+				desc := err.Error()
+				return &jmap.SetError{Type: string(jmap.ErrInvalidProperties), Description: &desc}
+			}
+			parsed, err := s.parseMessage(raw)
+			if err != nil {
+				desc := err.Error()
+				return &jmap.SetError{Type: string(mail.ErrInvalidEmail), Description: &desc}
+			}
+			parsed.MailboxIDs = e.MailboxIDs
+			parsed.Keywords = e.Keywords
+			parsed.ReceivedAt = e.ReceivedAt
+			if parsed.ReceivedAt == nil {
+				now := time.Now().UTC().Truncate(time.Second)
+				parsed.ReceivedAt = &now
+			}
+			*e = *parsed
+			s.assignThread(e)
+			return nil
+		},
+		created: s.emailAdded,
+		update: func(old *email.Email, e *email.Email, patch jmap.Patch) *jmap.SetError {
+			for path := range patch {
+				prop, _, _ := strings.Cut(path, "/")
+				if prop != "mailboxIds" && prop != "keywords" {
+					return invalidProperties(prop)
+				}
+			}
+			return s.checkMailboxes(e.MailboxIDs)
+		},
+		updated: func(old *email.Email, e *email.Email) {
+			s.touchMailboxes(old.MailboxIDs, e.MailboxIDs)
+		},
+		destroyed: s.emailDestroyed,
+	}
+	result, err := s.emails.set(req.IfInState, req.Create, req.Update, req.Destroy, hooks, r.CreatedIDs)
+	if err != nil {
+		return nil, err
+	}
+	// Only the server-set properties of created Emails are returned
+	for cid, e := range result.created {
+		result.created[cid] = &email.Email{
+			ID:       e.ID,
+			BlobID:   e.BlobID,
+			ThreadID: e.ThreadID,
+			Size:     e.Size,
+		}
+	}
+	return &email.SetResponse{
+		Account:      req.Account,
+		OldState:     result.oldState,
+		NewState:     result.newState,
+		Created:      result.created,
+		Updated:      result.updated,
+		Destroyed:    result.destroyed,
+		NotCreated:   result.notCreated,
+		NotUpdated:   result.notUpdated,
+		NotDestroyed: result.notDestroyed,
+	}, nil
+}
+
+func (s *Server) emailImport(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &email.Import{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	if err := s.emails.checkState(req.IfInState); err != nil {
+		return nil, err
+	}
+	resp := &email.ImportResponse{
+		Account:  req.Account,
+		OldState: s.emails.State(),
+	}
+	cids := make([]string, 0, len(req.Emails))
+	for cid := range req.Emails {
+		cids = append(cids, cid)
+	}
+	sort.Strings(cids)
+	for _, cid := range cids {
+		imp := req.Emails[cid]
+		if imp == nil {
+			setErr(&resp.NotCreated, jmap.ID(cid), invalidProperties())
+			continue
+		}
+		b, ok := s.blobs[imp.BlobID]
+		if !ok {
+			setErr(&resp.NotCreated, jmap.ID(cid), &jmap.SetError{
+				Type:     string(mail.ErrBlobNotFound),
+				NotFound: []jmap.ID{imp.BlobID},
+			})
+			continue
+		}
+		if err := s.checkMailboxes(imp.MailboxIDs); err != nil {
+			setErr(&resp.NotCreated, jmap.ID(cid), err)
+			continue
+		}
+		e, err := s.parseMessage(b.data)
+		if err != nil {
+			desc := err.Error()
+			setErr(&resp.NotCreated, jmap.ID(cid), &jmap.SetError{Type: string(mail.ErrInvalidEmail), Description: &desc})
+			continue
+		}
+		e.MailboxIDs = imp.MailboxIDs
+		e.Keywords = imp.Keywords
+		e.ReceivedAt = imp.ReceivedAt
+		if e.ReceivedAt == nil {
+			now := time.Now().UTC().Truncate(time.Second)
+			e.ReceivedAt = &now
+		}
+		id := s.addEmail(e)
+		r.CreatedIDs[jmap.ID(cid)] = id
+		if resp.Created == nil {
+			resp.Created = make(map[jmap.ID]*email.Email)
+		}
+		resp.Created[jmap.ID(cid)] = &email.Email{
+			ID:       id,
+			BlobID:   e.BlobID,
+			ThreadID: e.ThreadID,
+			Size:     e.Size,
+		}
+	}
+	resp.NewState = s.emails.State()
+	return resp, nil
+}
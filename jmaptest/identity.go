@@ -0,0 +1,96 @@
+package jmaptest
+
+import (
+	"encoding/json"
+
+	"git.sr.ht/~rockorager/go-jmap"
+	"git.sr.ht/~rockorager/go-jmap/mail/identity"
+)
+
+func (s *Server) identityGet(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &identity.Get{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	list, notFound, err := s.identities.get(req.IDs, req.Properties)
+	if err != nil {
+		return nil, err
+	}
+	resp := &identity.GetResponse{
+		Account: req.Account,
+		State:   s.identities.State(),
+		List:    list,
+	}
+	if len(notFound) > 0 {
+		resp.NotFound = notFound
+	}
+	return resp, nil
+}
+
+func (s *Server) identityChanges(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &identity.Changes{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	created, updated, destroyed, newState, more, err := s.identities.changes(req.SinceState, req.MaxChanges)
+	if err != nil {
+		return nil, err
+	}
+	return &identity.ChangesResponse{
+		Account:        req.Account,
+		OldState:       req.SinceState,
+		NewState:       newState,
+		HasMoreChanges: more,
+		Created:        created,
+		Updated:        updated,
+		Destroyed:      destroyed,
+	}, nil
+}
+
+// The email of an Identity can't be changed, and the default Identity can't be
+// destroyed
+func (s *Server) identitySet(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &identity.Set{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	hooks := setHooks[*identity.Identity]{
+		create: func(i *identity.Identity) *jmap.SetError {
+			if i.Email == "" {
+				return invalidProperties("email")
+			}
+			i.MayDelete = true
+			return nil
+		},
+		update: func(old *identity.Identity, i *identity.Identity, patch jmap.Patch) *jmap.SetError {
+			if i.Email != old.Email {
+				return invalidProperties("email")
+			}
+			if i.MayDelete != old.MayDelete {
+				return invalidProperties("mayDelete")
+			}
+			return nil
+		},
+		destroy: func(i *identity.Identity) *jmap.SetError {
+			if !i.MayDelete {
+				return &jmap.SetError{Type: string(jmap.ErrForbidden)}
+			}
+			return nil
+		},
+	}
+	result, err := s.identities.set(req.IfInState, req.Create, req.Update, req.Destroy, hooks, r.CreatedIDs)
+	if err != nil {
+		return nil, err
+	}
+	return &identity.SetResponse{
+		Account:      req.Account,
+		OldState:     result.oldState,
+		NewState:     result.newState,
+		Created:      result.created,
+		Updated:      result.updated,
+		Destroyed:    result.destroyed,
+		NotCreated:   result.notCreated,
+		NotUpdated:   result.notUpdated,
+		NotDestroyed: result.notDestroyed,
+	}, nil
+}
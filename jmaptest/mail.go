@@ -0,0 +1,203 @@
+package jmaptest
+
+import (
+	"encoding/json"
+	"html"
+	"regexp"
+	"strings"
+
+	"git.sr.ht/~rockorager/go-jmap"
+	"git.sr.ht/~rockorager/go-jmap/mail"
+	"git.sr.ht/~rockorager/go-jmap/mail/emailsubmission"
+	"git.sr.ht/~rockorager/go-jmap/mail/identity"
+	"git.sr.ht/~rockorager/go-jmap/mail/mailbox"
+	"git.sr.ht/~rockorager/go-jmap/mail/searchsnippet"
+	"git.sr.ht/~rockorager/go-jmap/mail/thread"
+	"git.sr.ht/~rockorager/go-jmap/mail/vacationresponse"
+)
+
+// The number of characters around the first match in the preview of a
+// SearchSnippet
+const snippetContext = 40
+
+func (s *Server) registerMail() {
+	s.handle("Mailbox/get", mail.URI, s.mailboxGet)
+	s.handle("Mailbox/changes", mail.URI, s.mailboxChanges)
+	s.handle("Mailbox/query", mail.URI, s.mailboxQuery)
+	s.handle("Mailbox/queryChanges", mail.URI, s.mailboxQueryChanges)
+	s.handle("Mailbox/set", mail.URI, s.mailboxSet)
+	s.handle("Email/get", mail.URI, s.emailGet)
+	s.handle("Email/changes", mail.URI, s.emailChanges)
+	s.handle("Email/query", mail.URI, s.emailQuery)
+	s.handle("Email/queryChanges", mail.URI, s.emailQueryChanges)
+	s.handle("Email/set", mail.URI, s.emailSet)
+	s.handle("Email/import", mail.URI, s.emailImport)
+	s.handle("Thread/get", mail.URI, s.threadGet)
+	s.handle("Thread/changes", mail.URI, s.threadChanges)
+	s.handle("SearchSnippet/get", mail.URI, s.searchSnippetGet)
+	s.handle("Identity/get", emailsubmission.URI, s.identityGet)
+	s.handle("Identity/changes", emailsubmission.URI, s.identityChanges)
+	s.handle("Identity/set", emailsubmission.URI, s.identitySet)
+	s.handle("EmailSubmission/get", emailsubmission.URI, s.submissionGet)
+	s.handle("EmailSubmission/changes", emailsubmission.URI, s.submissionChanges)
+	s.handle("EmailSubmission/query", emailsubmission.URI, s.submissionQuery)
+	s.handle("EmailSubmission/queryChanges", emailsubmission.URI, s.submissionQueryChanges)
+	s.handle("EmailSubmission/set", emailsubmission.URI, s.submissionSet)
+	s.handle("VacationResponse/get", vacationresponse.URI, s.vacationGet)
+	s.handle("VacationResponse/set", vacationresponse.URI, s.vacationSet)
+
+	s.addMailbox("Inbox", mailbox.RoleInbox, 1)
+	s.addMailbox("Drafts", mailbox.RoleDrafts, 2)
+	s.addMailbox("Sent", mailbox.RoleSent, 3)
+	s.addMailbox("Trash", mailbox.RoleTrash, 4)
+	s.identities.add(&identity.Identity{
+		Name:  "Test",
+		Email: Username,
+	})
+	s.vacation.put(vacationID, &vacationresponse.VacationResponse{})
+}
+
+func (s *Server) threadGet(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &thread.Get{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	list, notFound, err := s.threads.get(req.IDs, req.Properties)
+	if err != nil {
+		return nil, err
+	}
+	resp := &thread.GetResponse{
+		Account: req.Account,
+		State:   s.threads.State(),
+		List:    list,
+	}
+	if len(notFound) > 0 {
+		resp.NotFound = notFound
+	}
+	return resp, nil
+}
+
+func (s *Server) threadChanges(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &thread.Changes{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	created, updated, destroyed, newState, more, err := s.threads.changes(req.SinceState, req.MaxChanges)
+	if err != nil {
+		return nil, err
+	}
+	return &thread.ChangesResponse{
+		Account:        req.Account,
+		OldState:       req.SinceState,
+		NewState:       newState,
+		HasMoreChanges: more,
+		Created:        created,
+		Updated:        updated,
+		Destroyed:      destroyed,
+	}, nil
+}
+
+// SearchSnippets highlight the terms of the text, subject and body conditions
+// of the filter
+func (s *Server) searchSnippetGet(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := struct {
+		searchsnippet.Get
+		Filter json.RawMessage `json:"filter,omitempty"`
+	}{}
+	if err := decodeArgs(args, &req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	terms := snippetTerms(req.Filter)
+	resp := &searchsnippet.GetResponse{Account: req.Account}
+	for _, id := range req.EmailIDs {
+		e, ok := s.emails.objects[id]
+		if !ok {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+		snippet := &searchsnippet.SearchSnippet{Email: id}
+		if subject, ok := highlight(e.Subject, terms); ok {
+			snippet.Subject = subject
+		}
+		for _, part := range e.TextBody {
+			value, ok := e.BodyValues[part.PartID]
+			if !ok {
+				continue
+			}
+			text := strings.Join(strings.Fields(value.Value), " ")
+			if preview, ok := highlight(excerpt(text, terms), terms); ok {
+				snippet.Preview = preview
+				break
+			}
+		}
+		resp.List = append(resp.List, snippet)
+	}
+	return resp, nil
+}
+
+// snippetTerms returns the terms to highlight in SearchSnippets, from the
+// conditions of a filter which aren't negated
+func snippetTerms(filter json.RawMessage) []string {
+	op := struct {
+		Operator   jmap.Operator     `json:"operator"`
+		Conditions []json.RawMessage `json:"conditions"`
+		Text       string            `json:"text"`
+		Subject    string            `json:"subject"`
+		Body       string            `json:"body"`
+	}{}
+	if json.Unmarshal(filter, &op) != nil || op.Operator == jmap.OperatorNOT {
+		return nil
+	}
+	terms := []string{}
+	for _, term := range []string{op.Text, op.Subject, op.Body} {
+		if term != "" {
+			terms = append(terms, term)
+		}
+	}
+	for _, cond := range op.Conditions {
+		terms = append(terms, snippetTerms(cond)...)
+	}
+	return terms
+}
+
+// highlight escapes text as HTML, and marks the terms in it. It reports
+// whether any term was found
+func highlight(text string, terms []string) (string, bool) {
+	if len(terms) == 0 || text == "" {
+		return "", false
+	}
+	quoted := make([]string, 0, len(terms))
+	for _, term := range terms {
+		quoted = append(quoted, regexp.QuoteMeta(html.EscapeString(term)))
+	}
+	re := regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+	escaped := html.EscapeString(text)
+	if !re.MatchString(escaped) {
+		return "", false
+	}
+	return re.ReplaceAllString(escaped, "<mark>$0</mark>"), true
+}
+
+// excerpt returns the part of text around the first term found in it
+func excerpt(text string, terms []string) string {
+	lower := strings.ToLower(text)
+	start := -1
+	for _, term := range terms {
+		if i := strings.Index(lower, strings.ToLower(term)); i >= 0 && (start < 0 || i < start) {
+			start = i
+		}
+	}
+	if start < 0 {
+		return text
+	}
+	runes := []rune(text)
+	from := len([]rune(text[:start])) - snippetContext
+	if from < 0 {
+		from = 0
+	}
+	to := from + 2*snippetContext + previewLength/4
+	if to > len(runes) {
+		to = len(runes)
+	}
+	return string(runes[from:to])
+}
@@ -0,0 +1,323 @@
+package jmaptest
+
+import (
+	"encoding/json"
+	"strings"
+
+	"git.sr.ht/~rockorager/go-jmap"
+	"git.sr.ht/~rockorager/go-jmap/mail"
+	"git.sr.ht/~rockorager/go-jmap/mail/mailbox"
+)
+
+// Properties of a Mailbox which are set by the server
+var mailboxServerSet = []string{"totalEmails", "unreadEmails", "totalThreads", "unreadThreads", "myRights"}
+
+// mailboxQuery decodes the filter of a Mailbox/query or queryChanges call,
+// which the library types only encode
+type mailboxQuery struct {
+	mailbox.Query
+	Filter json.RawMessage `json:"filter,omitempty"`
+}
+
+type mailboxQueryChanges struct {
+	mailbox.QueryChanges
+	Filter json.RawMessage `json:"filter,omitempty"`
+}
+
+// addMailbox creates a Mailbox, when the Server is created
+func (s *Server) addMailbox(name string, role mailbox.Role, sortOrder uint64) {
+	s.mailboxes.add(&mailbox.Mailbox{
+		Name:         name,
+		Role:         role,
+		SortOrder:    sortOrder,
+		Rights:       allRights(),
+		IsSubscribed: true,
+	})
+}
+
+func allRights() *mailbox.Rights {
+	return &mailbox.Rights{
+		MayReadItems:   true,
+		MayAddItems:    true,
+		MayRemoveItems: true,
+		MaySetSeen:     true,
+		MaySetKeywords: true,
+		MayCreateChild: true,
+		MayRename:      true,
+		MayDelete:      true,
+		MaySubmit:      true,
+	}
+}
+
+// mailboxRole returns the id of the Mailbox with a role, if there is one
+func (s *Server) mailboxRole(role mailbox.Role) jmap.ID {
+	for _, m := range s.mailboxes.all() {
+		if m.Role == role {
+			return m.ID
+		}
+	}
+	return ""
+}
+
+// countMailboxes sets the counts of each Mailbox from the Emails in it
+func (s *Server) countMailboxes() {
+	for _, m := range s.mailboxes.all() {
+		m.TotalEmails, m.UnreadEmails = 0, 0
+		threads := map[jmap.ID]bool{}
+		unread := map[jmap.ID]bool{}
+		for _, e := range s.emails.all() {
+			if !e.MailboxIDs[m.ID] {
+				continue
+			}
+			m.TotalEmails += 1
+			threads[e.ThreadID] = true
+			if !e.Keywords["$seen"] {
+				m.UnreadEmails += 1
+				unread[e.ThreadID] = true
+			}
+		}
+		m.TotalThreads = uint64(len(threads))
+		m.UnreadThreads = uint64(len(unread))
+	}
+}
+
+func (s *Server) mailboxGet(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &mailbox.Get{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	s.countMailboxes()
+	list, notFound, err := s.mailboxes.get(req.IDs, req.Properties)
+	if err != nil {
+		return nil, err
+	}
+	resp := &mailbox.GetResponse{
+		Account: req.Account,
+		State:   s.mailboxes.State(),
+		List:    list,
+	}
+	for _, id := range notFound {
+		resp.NotFound = append(resp.NotFound, string(id))
+	}
+	return resp, nil
+}
+
+func (s *Server) mailboxChanges(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &mailbox.Changes{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	created, updated, destroyed, newState, more, err := s.mailboxes.changes(req.SinceState, req.MaxChanges)
+	if err != nil {
+		return nil, err
+	}
+	return &mailbox.ChangesResponse{
+		Account:        req.Account,
+		OldState:       req.SinceState,
+		NewState:       newState,
+		HasMoreChanges: more,
+		Created:        created,
+		Updated:        updated,
+		Destroyed:      destroyed,
+	}, nil
+}
+
+// mailboxQuerySpec returns the querySpec of a Mailbox/query or queryChanges
+// call
+func mailboxQuerySpec(filter json.RawMessage, comparators []*mailbox.SortComparator) (querySpec[*mailbox.Mailbox], error) {
+	match := func(m *mailbox.Mailbox) (bool, error) {
+		return matchFilter(filter, func(data json.RawMessage) (bool, error) {
+			// Properties which may be null are decoded separately
+			cond := struct {
+				mailbox.FilterCondition
+				ParentID json.RawMessage `json:"parentId,omitempty"`
+				Role     json.RawMessage `json:"role,omitempty"`
+			}{}
+			if err := decodeCondition(data, &cond); err != nil {
+				return false, err
+			}
+			raw := map[string]json.RawMessage{}
+			json.Unmarshal(data, &raw)
+			if v, ok := raw["parentId"]; ok {
+				var parent jmap.ID
+				json.Unmarshal(v, &parent)
+				if m.ParentID != parent {
+					return false, nil
+				}
+			}
+			if v, ok := raw["role"]; ok {
+				var role mailbox.Role
+				json.Unmarshal(v, &role)
+				if m.Role != role {
+					return false, nil
+				}
+			}
+			if v, ok := raw["hasAnyRole"]; ok {
+				var hasRole bool
+				json.Unmarshal(v, &hasRole)
+				if (m.Role != "") != hasRole {
+					return false, nil
+				}
+			}
+			if v, ok := raw["isSubscribed"]; ok {
+				var subscribed bool
+				json.Unmarshal(v, &subscribed)
+				if m.IsSubscribed != subscribed {
+					return false, nil
+				}
+			}
+			if cond.Name != "" && !containsFold(m.Name, cond.Name) {
+				return false, nil
+			}
+			return true, nil
+		})
+	}
+	fields := map[string]func(a, b *mailbox.Mailbox) int{
+		"sortOrder": func(a, b *mailbox.Mailbox) int { return compare(a.SortOrder, b.SortOrder) },
+		"name":      func(a, b *mailbox.Mailbox) int { return compare(strings.ToLower(a.Name), strings.ToLower(b.Name)) },
+	}
+	cmps := []comparator{}
+	for _, c := range comparators {
+		cmps = append(cmps, comparator{property: c.Property, ascending: c.IsAscending})
+	}
+	less, err := sorter(cmps, fields)
+	return querySpec[*mailbox.Mailbox]{
+		key:   queryKey(filter, comparators),
+		match: match,
+		less:  less,
+	}, err
+}
+
+func (s *Server) mailboxQuery(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &mailboxQuery{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	q, err := mailboxQuerySpec(req.Filter, req.Sort)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.mailboxes.query(q, req.Position, req.Anchor, req.AnchorOffset, req.Limit)
+	if err != nil {
+		return nil, err
+	}
+	resp := &mailbox.QueryResponse{
+		Account:             req.Account,
+		QueryState:          result.queryState,
+		CanCalculateChanges: true,
+		Position:            result.position,
+		IDs:                 result.ids,
+		Limit:               req.Limit,
+	}
+	if req.CalculateTotal {
+		resp.Total = int64(result.total)
+	}
+	return resp, nil
+}
+
+func (s *Server) mailboxQueryChanges(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &mailboxQueryChanges{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	q, err := mailboxQuerySpec(req.Filter, req.Sort)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.mailboxes.queryChanges(q, req.SinceQueryState, req.MaxChanges)
+	if err != nil {
+		return nil, err
+	}
+	return &mailbox.QueryChangesResponse{
+		Account:       req.Account,
+		OldQueryState: result.oldQueryState,
+		NewQueryState: result.newQueryState,
+		Removed:       result.removed,
+		Added:         result.added,
+	}, nil
+}
+
+func (s *Server) mailboxSet(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &mailbox.Set{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	hooks := setHooks[*mailbox.Mailbox]{
+		create: func(m *mailbox.Mailbox) *jmap.SetError {
+			if m.Name == "" {
+				return invalidProperties("name")
+			}
+			if m.ParentID != "" && s.mailboxes.objects[m.ParentID] == nil {
+				return invalidProperties("parentId")
+			}
+			m.TotalEmails, m.UnreadEmails, m.TotalThreads, m.UnreadThreads = 0, 0, 0, 0
+			m.Rights = allRights()
+			return nil
+		},
+		update: func(old *mailbox.Mailbox, m *mailbox.Mailbox, patch jmap.Patch) *jmap.SetError {
+			for path := range patch {
+				prop, _, _ := strings.Cut(path, "/")
+				for _, serverSet := range mailboxServerSet {
+					if prop == serverSet {
+						return invalidProperties(prop)
+					}
+				}
+			}
+			if m.Name == "" {
+				return invalidProperties("name")
+			}
+			// The parent must exist, and not be the Mailbox or one of
+			// its descendants
+			for parent := m.ParentID; parent != ""; parent = s.mailboxes.objects[parent].ParentID {
+				if parent == m.ID || s.mailboxes.objects[parent] == nil {
+					return invalidProperties("parentId")
+				}
+			}
+			return nil
+		},
+		destroy: func(m *mailbox.Mailbox) *jmap.SetError {
+			for _, child := range s.mailboxes.all() {
+				if child.ParentID == m.ID {
+					return &jmap.SetError{Type: string(mail.ErrMailboxHasChild)}
+				}
+			}
+			for _, e := range s.emails.all() {
+				if e.MailboxIDs[m.ID] && !req.OnDestroyRemoveEmails {
+					return &jmap.SetError{Type: string(mail.ErrMailboxHasEmail)}
+				}
+			}
+			return nil
+		},
+		destroyed: func(m *mailbox.Mailbox) {
+			// Emails only in the Mailbox are destroyed, and the others
+			// removed from it
+			for _, e := range s.emails.all() {
+				if !e.MailboxIDs[m.ID] {
+					continue
+				}
+				if len(e.MailboxIDs) == 1 {
+					s.destroyEmail(e)
+					continue
+				}
+				updated, _ := clone(e)
+				delete(updated.MailboxIDs, m.ID)
+				s.emails.put(e.ID, updated)
+			}
+		},
+	}
+	result, err := s.mailboxes.set(req.IfInState, req.Create, req.Update, req.Destroy, hooks, r.CreatedIDs)
+	if err != nil {
+		return nil, err
+	}
+	return &mailbox.SetResponse{
+		Account:      req.Account,
+		OldState:     result.oldState,
+		NewState:     result.newState,
+		Created:      result.created,
+		Updated:      result.updated,
+		Destroyed:    result.destroyed,
+		NotCreated:   result.notCreated,
+		NotUpdated:   result.notUpdated,
+		NotDestroyed: result.notDestroyed,
+	}, nil
+}
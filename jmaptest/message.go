@@ -0,0 +1,459 @@
+package jmaptest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"git.sr.ht/~rockorager/go-jmap"
+	"git.sr.ht/~rockorager/go-jmap/mail"
+	"git.sr.ht/~rockorager/go-jmap/mail/email"
+)
+
+// Length of the preview of an Email, in characters
+const previewLength = 256
+
+var (
+	messageIDRegexp = regexp.MustCompile(`<[^<>]+>`)
+	tagRegexp       = regexp.MustCompile(`<[^>]*>`)
+)
+
+// parseMessage parses an RFC 5322 message into an Email. The blobs of the
+// message and of each of its leaf parts are stored
+func (s *Server) parseMessage(raw []byte) (*email.Email, error) {
+	header, body := splitMessage(raw)
+	headers := parseHeaders(header)
+	if len(headers) == 0 {
+		return nil, errors.New("message has no header fields")
+	}
+	e := &email.Email{
+		BlobID:     s.addBlob(raw, "message/rfc822"),
+		Size:       uint64(len(raw)),
+		Headers:    headers,
+		MessageID:  messageIDs(headerValue(headers, "Message-ID")),
+		InReplyTo:  messageIDs(headerValue(headers, "In-Reply-To")),
+		References: messageIDs(headerValue(headers, "References")),
+		Sender:     addresses(headerValue(headers, "Sender")),
+		From:       addresses(headerValue(headers, "From")),
+		To:         addresses(headerValue(headers, "To")),
+		CC:         addresses(headerValue(headers, "Cc")),
+		BCC:        addresses(headerValue(headers, "Bcc")),
+		ReplyTo:    addresses(headerValue(headers, "Reply-To")),
+		Subject:    decodeHeader(headerValue(headers, "Subject")),
+		BodyValues: map[string]*email.BodyValue{},
+	}
+	if date, err := netmail.ParseDate(headerValue(headers, "Date")); err == nil {
+		e.SentAt = &date
+	}
+
+	part := &partParser{s: s, email: e}
+	e.BodyStructure = part.parse(headers, body)
+	part.classify(e.BodyStructure, "")
+	if len(e.HTMLBody) == 0 {
+		e.HTMLBody = e.TextBody
+	}
+	if len(e.TextBody) == 0 {
+		e.TextBody = e.HTMLBody
+	}
+	e.HasAttachment = len(e.Attachments) > 0
+	if len(e.TextBody) > 0 {
+		e.Preview = preview(e.TextBody[0], e.BodyValues[e.TextBody[0].PartID])
+	}
+	return e, nil
+}
+
+// splitMessage splits a message into its header and body
+func splitMessage(raw []byte) ([]byte, []byte) {
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(raw, []byte(sep)); i >= 0 {
+			return raw[:i], raw[i+len(sep):]
+		}
+	}
+	return raw, nil
+}
+
+// parseHeaders parses the header fields of a message or part, in order. The
+// values are in raw form
+func parseHeaders(header []byte) []*email.Header {
+	headers := []*email.Header{}
+	for _, line := range strings.Split(string(header), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(headers) > 0 {
+			last := headers[len(headers)-1]
+			last.Value += "\r\n" + line
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		headers = append(headers, &email.Header{Name: name, Value: value})
+	}
+	return headers
+}
+
+// headerValue returns the unfolded value of the last header field with name
+func headerValue(headers []*email.Header, name string) string {
+	for i := len(headers) - 1; i >= 0; i-- {
+		if strings.EqualFold(headers[i].Name, name) {
+			return strings.TrimSpace(strings.ReplaceAll(headers[i].Value, "\r\n", ""))
+		}
+	}
+	return ""
+}
+
+func decodeHeader(value string) string {
+	dec := &mime.WordDecoder{}
+	decoded, err := dec.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+func messageIDs(value string) []string {
+	ids := []string{}
+	for _, id := range messageIDRegexp.FindAllString(value, -1) {
+		ids = append(ids, strings.Trim(id, "<>"))
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return ids
+}
+
+func addresses(value string) []*mail.Address {
+	if value == "" {
+		return nil
+	}
+	list, err := (&netmail.AddressParser{WordDecoder: &mime.WordDecoder{}}).ParseList(value)
+	if err != nil {
+		return nil
+	}
+	addrs := make([]*mail.Address, 0, len(list))
+	for _, addr := range list {
+		addrs = append(addrs, &mail.Address{Name: addr.Name, Email: addr.Address})
+	}
+	return addrs
+}
+
+// A partParser parses the body of a message into BodyParts
+type partParser struct {
+	s      *Server
+	email  *email.Email
+	partID int
+}
+
+// parse parses a part, and the parts inside it
+func (p *partParser) parse(headers []*email.Header, body []byte) *email.BodyPart {
+	part := &email.BodyPart{Headers: headers}
+	mediaType, params, err := mime.ParseMediaType(headerValue(headers, "Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	part.Type = mediaType
+	if disposition, dparams, err := mime.ParseMediaType(headerValue(headers, "Content-Disposition")); err == nil {
+		part.Disposition = disposition
+		part.Name = dparams["filename"]
+	}
+	if part.Name == "" {
+		part.Name = params["name"]
+	}
+	part.CID = strings.Trim(headerValue(headers, "Content-ID"), "<>")
+	part.Location = headerValue(headers, "Content-Location")
+	if lang := headerValue(headers, "Content-Language"); lang != "" {
+		for _, tag := range strings.Split(lang, ",") {
+			part.Language = append(part.Language, strings.TrimSpace(tag))
+		}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		r := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			sub, err := r.NextRawPart()
+			if err != nil {
+				break
+			}
+			data, _ := io.ReadAll(sub)
+			part.SubParts = append(part.SubParts, p.parse(mimeHeaders(sub), data))
+		}
+		return part
+	}
+
+	data := decodeTransfer(headerValue(headers, "Content-Transfer-Encoding"), body)
+	p.partID += 1
+	part.PartID = fmt.Sprint(p.partID)
+	part.BlobID = p.s.addBlob(data, mediaType)
+	part.Size = uint64(len(data))
+	if strings.HasPrefix(mediaType, "text/") {
+		part.Charset = params["charset"]
+		if part.Charset == "" {
+			part.Charset = "us-ascii"
+		}
+		value := &email.BodyValue{Value: string(data)}
+		if !utf8.Valid(data) {
+			value.Value = strings.ToValidUTF8(value.Value, "�")
+			value.IsEncodingProblem = true
+		}
+		p.email.BodyValues[part.PartID] = value
+	}
+	return part
+}
+
+// mimeHeaders returns the header fields of a part of a multipart body, in a
+// stable order
+func mimeHeaders(part *multipart.Part) []*email.Header {
+	names := make([]string, 0, len(part.Header))
+	for name := range part.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	headers := []*email.Header{}
+	for _, name := range names {
+		for _, value := range part.Header[name] {
+			headers = append(headers, &email.Header{Name: name, Value: " " + value})
+		}
+	}
+	return headers
+}
+
+func decodeTransfer(encoding string, body []byte) []byte {
+	switch strings.ToLower(encoding) {
+	case "base64":
+		clean := strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, string(body))
+		data, err := base64.StdEncoding.DecodeString(clean)
+		if err == nil {
+			return data
+		}
+	case "quoted-printable":
+		data, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		if err == nil {
+			return data
+		}
+	}
+	return body
+}
+
+// classify adds the leaf parts inside part to the textBody, htmlBody and
+// attachments of the Email. alternative is the type of text part being
+// looked for inside a multipart/alternative part, if any
+func (p *partParser) classify(part *email.BodyPart, alternative string) {
+	e := p.email
+	if part.SubParts != nil {
+		for _, sub := range part.SubParts {
+			alt := alternative
+			if part.Type == "multipart/alternative" {
+				alt = sub.Type
+			}
+			p.classify(sub, alt)
+		}
+		return
+	}
+	inline := part.Disposition != "attachment"
+	switch {
+	case inline && part.Type == "text/plain" && alternative != "text/html":
+		e.TextBody = append(e.TextBody, part)
+	case inline && part.Type == "text/html" && alternative != "text/plain":
+		e.HTMLBody = append(e.HTMLBody, part)
+	default:
+		e.Attachments = append(e.Attachments, part)
+	}
+}
+
+// preview returns the start of the text of a part, with whitespace collapsed
+func preview(part *email.BodyPart, value *email.BodyValue) string {
+	if value == nil {
+		return ""
+	}
+	text := value.Value
+	if part.Type == "text/html" {
+		text = tagRegexp.ReplaceAllString(text, " ")
+	}
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) > previewLength {
+		text = string([]rune(text)[:previewLength])
+	}
+	return text
+}
+
+// renderMessage creates the RFC 5322 message of an Email created with
+// Email/set. The body is taken from the bodyStructure if it is set, and
+// otherwise from textBody, htmlBody and attachments
+func (s *Server) renderMessage(e *email.Email) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	writeAddresses := func(name string, addrs []*mail.Address) {
+		if len(addrs) == 0 {
+			return
+		}
+		list := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			list = append(list, (&netmail.Address{Name: addr.Name, Address: addr.Email}).String())
+		}
+		fmt.Fprintf(buf, "%s: %s\r\n", name, strings.Join(list, ", "))
+	}
+	writeIDs := func(name string, ids []string) {
+		if len(ids) == 0 {
+			return
+		}
+		fmt.Fprintf(buf, "%s: <%s>\r\n", name, strings.Join(ids, "> <"))
+	}
+	writeAddresses("From", e.From)
+	writeAddresses("Sender", e.Sender)
+	writeAddresses("To", e.To)
+	writeAddresses("Cc", e.CC)
+	writeAddresses("Bcc", e.BCC)
+	writeAddresses("Reply-To", e.ReplyTo)
+	if e.Subject != "" {
+		fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", e.Subject))
+	}
+	sentAt := time.Now()
+	if e.SentAt != nil {
+		sentAt = *e.SentAt
+	}
+	fmt.Fprintf(buf, "Date: %s\r\n", sentAt.Format(time.RFC1123Z))
+	messageID := e.MessageID
+	if len(messageID) == 0 {
+		messageID = []string{fmt.Sprintf("%d.%d@jmaptest", time.Now().UnixNano(), s.nextBlob)}
+	}
+	writeIDs("Message-ID", messageID)
+	writeIDs("In-Reply-To", e.InReplyTo)
+	writeIDs("References", e.References)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	root := e.BodyStructure
+	if root == nil {
+		root = bodyStructure(e)
+	}
+	if err := s.renderPart(buf, e, root); err != nil {
+		return nil, err
+	}
+	if len(root.SubParts) == 0 {
+		// The line break ending the body of a part belongs to the
+		// delimiter which follows it, so a message of a single part
+		// doesn't need it
+		return bytes.TrimSuffix(buf.Bytes(), []byte("\r\n")), nil
+	}
+	return buf.Bytes(), nil
+}
+
+// bodyStructure builds the structure of the body of an Email from its
+// textBody, htmlBody and attachments
+func bodyStructure(e *email.Email) *email.BodyPart {
+	parts := []*email.BodyPart{}
+	switch {
+	case len(e.TextBody) > 0 && len(e.HTMLBody) > 0:
+		parts = append(parts, &email.BodyPart{
+			Type:     "multipart/alternative",
+			SubParts: []*email.BodyPart{e.TextBody[0], e.HTMLBody[0]},
+		})
+	case len(e.TextBody) > 0:
+		parts = append(parts, e.TextBody[0])
+	case len(e.HTMLBody) > 0:
+		parts = append(parts, e.HTMLBody[0])
+	}
+	parts = append(parts, e.Attachments...)
+	switch len(parts) {
+	case 0:
+		return &email.BodyPart{Type: "text/plain"}
+	case 1:
+		return parts[0]
+	}
+	return &email.BodyPart{Type: "multipart/mixed", SubParts: parts}
+}
+
+// renderPart writes the header fields and body of a part
+func (s *Server) renderPart(buf *bytes.Buffer, e *email.Email, part *email.BodyPart) error {
+	if len(part.SubParts) > 0 {
+		mediaType := part.Type
+		if !strings.HasPrefix(mediaType, "multipart/") {
+			mediaType = "multipart/mixed"
+		}
+		boundary := multipart.NewWriter(nil).Boundary()
+		fmt.Fprintf(buf, "Content-Type: %s\r\n\r\n", mime.FormatMediaType(mediaType, map[string]string{"boundary": boundary}))
+		for _, sub := range part.SubParts {
+			fmt.Fprintf(buf, "--%s\r\n", boundary)
+			if err := s.renderPart(buf, e, sub); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(buf, "--%s--\r\n", boundary)
+		return nil
+	}
+
+	var data []byte
+	mediaType := part.Type
+	switch {
+	case part.PartID != "":
+		value, ok := e.BodyValues[part.PartID]
+		if !ok {
+			return fmt.Errorf("no bodyValue for partId %s", part.PartID)
+		}
+		data = []byte(value.Value)
+		if mediaType == "" {
+			mediaType = "text/plain"
+		}
+	case part.BlobID != "":
+		b, ok := s.blobs[part.BlobID]
+		if !ok {
+			return &jmap.SetError{Type: string(mail.ErrBlobNotFound), NotFound: []jmap.ID{part.BlobID}}
+		}
+		data = b.data
+		if mediaType == "" {
+			mediaType = b.mediaType
+		}
+	}
+	if mediaType == "" {
+		mediaType = "text/plain"
+	}
+	params := map[string]string{}
+	if strings.HasPrefix(mediaType, "text/") {
+		params["charset"] = "utf-8"
+	}
+	fmt.Fprintf(buf, "Content-Type: %s\r\n", mime.FormatMediaType(mediaType, params))
+	if part.Disposition != "" || part.Name != "" {
+		disposition := part.Disposition
+		if disposition == "" {
+			disposition = "attachment"
+		}
+		dparams := map[string]string{}
+		if part.Name != "" {
+			dparams["filename"] = part.Name
+		}
+		fmt.Fprintf(buf, "Content-Disposition: %s\r\n", mime.FormatMediaType(disposition, dparams))
+	}
+	if part.CID != "" {
+		fmt.Fprintf(buf, "Content-ID: <%s>\r\n", part.CID)
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		w := quotedprintable.NewWriter(buf)
+		w.Write(data)
+		w.Close()
+		buf.WriteString("\r\n")
+		return nil
+	}
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+	return nil
+}
@@ -0,0 +1,455 @@
+// Package jmaptest provides utilities for testing JMAP clients.
+//
+// A Recorder captures the HTTP traffic of a jmap.Client (the Session, API
+// requests, uploads, downloads and EventSource streams) to a fixture file, and
+// replays it offline:
+//
+//	client := &jmap.Client{SessionEndpoint: endpoint}
+//	client.WithAccessToken(token)
+//	rec, err := jmaptest.Record("testdata/sync.jsonl", client)
+//	// Use the client against a live server
+//	rec.Close()
+//
+// Later, the same test runs without a server:
+//
+//	client := &jmap.Client{SessionEndpoint: endpoint}
+//	rec, err := jmaptest.Replay("testdata/sync.jsonl", client)
+//
+// A Server is an in-memory JMAP server, for tests which need one that keeps
+// state:
+//
+//	s := jmaptest.NewServer()
+//	defer s.Close()
+//	client := s.Client()
+package jmaptest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"git.sr.ht/~rockorager/go-jmap"
+)
+
+// DefaultIgnoreFields are the properties ignored when matching requests with
+// a Recorder made by Replay: timestamps which are usually set by the client
+// when the request is made
+var DefaultIgnoreFields = []string{"receivedAt", "sentAt"}
+
+// An Exchange is a recorded HTTP request and its response. Fixture files hold
+// one Exchange per line, as JSON
+type Exchange struct {
+	// The method and URL of the request
+	Method string `json:"method"`
+	URL    string `json:"url"`
+
+	// The body of the request
+	RequestBody Body `json:"requestBody,omitempty"`
+
+	// The status, headers and body of the response
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   Body        `json:"body,omitempty"`
+}
+
+// A Body is the body of a request or response. Compact JSON bodies are stored
+// as JSON, other text as a string and binary data as base64
+type Body []byte
+
+func (b Body) MarshalJSON() ([]byte, error) {
+	switch {
+	case isCompactJSON(b):
+		data := append([]byte(`{"json":`), b...)
+		return append(data, '}'), nil
+	case utf8.Valid(b):
+		return json.Marshal(map[string]string{"text": string(b)})
+	default:
+		return json.Marshal(map[string][]byte{"base64": b})
+	}
+}
+
+// isCompactJSON reports whether b is JSON without insignificant whitespace, so
+// it is stored unchanged
+func isCompactJSON(b []byte) bool {
+	if !json.Valid(b) {
+		return false
+	}
+	buf := &bytes.Buffer{}
+	if err := json.Compact(buf, b); err != nil {
+		return false
+	}
+	return bytes.Equal(buf.Bytes(), b)
+}
+
+func (b *Body) UnmarshalJSON(data []byte) error {
+	raw := struct {
+		JSON   json.RawMessage `json:"json"`
+		Text   *string         `json:"text"`
+		Base64 []byte          `json:"base64"`
+	}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	switch {
+	case raw.JSON != nil:
+		*b = Body(raw.JSON)
+	case raw.Text != nil:
+		*b = Body(*raw.Text)
+	default:
+		*b = Body(raw.Base64)
+	}
+	return nil
+}
+
+// Response headers which aren't recorded, because they hold credentials or
+// change on every request
+var skipHeaders = map[string]bool{
+	"Date":             true,
+	"Set-Cookie":       true,
+	"Www-Authenticate": true,
+}
+
+// Query parameters which are removed from recorded URLs, because they hold
+// credentials. Names are compared case-insensitively
+var skipParams = map[string]bool{
+	"access_token": true,
+	"token":        true,
+	"auth":         true,
+	"password":     true,
+	"secret":       true,
+	"key":          true,
+	"api_key":      true,
+	"apikey":       true,
+}
+
+// A Recorder is an http.RoundTripper which records or replays the HTTP
+// traffic of a jmap.Client. Request headers and query parameters which hold
+// credentials are never recorded, so fixtures don't hold credentials
+type Recorder struct {
+	// Properties of JSON request bodies which are ignored when matching
+	// requests to recorded Exchanges, at any depth. The order of the
+	// "using" capabilities of a request is always ignored
+	IgnoreFields []string
+
+	// The transport requests are recorded from. Nil when replaying
+	transport http.RoundTripper
+
+	mu sync.Mutex
+	// The fixture file being recorded to
+	file *os.File
+	enc  *json.Encoder
+	// The first error writing to the fixture file
+	err error
+	// The Exchanges being replayed, and whether each has been used
+	exchanges []*Exchange
+	used      []bool
+}
+
+// Record wraps the HttpClient of c (http.DefaultClient if it is nil) to record
+// each exchange to the fixture file at path, which is replaced. Exchanges are
+// written as their responses are read to the end or closed, so EventSource
+// streams are recorded once the stream is closed. Close the Recorder when done
+func Record(path string, c *jmap.Client) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	client := http.DefaultClient
+	if c.HttpClient != nil {
+		client = c.HttpClient
+	}
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	enc := json.NewEncoder(f)
+	enc.SetEscapeHTML(false)
+	r := &Recorder{
+		transport: transport,
+		file:      f,
+		enc:       enc,
+	}
+	wrapped := *client
+	wrapped.Transport = r
+	c.HttpClient = &wrapped
+	return r, nil
+}
+
+// Replay sets the HttpClient of c to one which responds with the Exchanges
+// recorded in the fixture file at path, without making any requests. Each
+// request is matched to the first unused Exchange with the same method, URL
+// and body. If they have all been used, the last of them is used again. A
+// request which matches no Exchange fails.
+//
+// The IgnoreFields of the Recorder are set to DefaultIgnoreFields
+func Replay(path string, c *jmap.Client) (*Recorder, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		IgnoreFields: append([]string{}, DefaultIgnoreFields...),
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		ex := &Exchange{}
+		err := dec.Decode(ex)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		r.exchanges = append(r.exchanges, ex)
+	}
+	r.used = make([]bool, len(r.exchanges))
+	c.HttpClient = &http.Client{Transport: r}
+	return r, nil
+}
+
+// Exchanges returns the recorded Exchanges being replayed
+func (r *Recorder) Exchanges() []*Exchange {
+	return r.exchanges
+}
+
+// Close stops recording, and closes the fixture file. It returns the first
+// error writing an Exchange, if there was one
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return r.err
+	}
+	err := r.file.Close()
+	r.file = nil
+	if r.err != nil {
+		return r.err
+	}
+	return err
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if r.transport == nil {
+		return r.replay(req, body)
+	}
+	return r.record(req, body)
+}
+
+// readBody reads the body of req, and closes it
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	defer req.Body.Close()
+	return io.ReadAll(req.Body)
+}
+
+func (r *Recorder) record(req *http.Request, body []byte) (*http.Response, error) {
+	// A RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	resp, err := r.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	ex := &Exchange{
+		Method:      req.Method,
+		URL:         recordedURL(req.URL),
+		RequestBody: body,
+		Status:      resp.StatusCode,
+		Header:      http.Header{},
+	}
+	for k, v := range resp.Header {
+		if !skipHeaders[k] {
+			ex.Header[k] = v
+		}
+	}
+	resp.Body = &recordingBody{
+		ReadCloser: resp.Body,
+		recorder:   r,
+		exchange:   ex,
+	}
+	return resp, nil
+}
+
+// recordedURL returns u as it is recorded, without the query parameters which
+// hold credentials
+func recordedURL(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.String()
+	}
+	query := u.Query()
+	for name := range query {
+		if skipParams[strings.ToLower(name)] {
+			query.Del(name)
+		}
+	}
+	clean := *u
+	clean.RawQuery = query.Encode()
+	return clean.String()
+}
+
+// write appends an Exchange to the fixture file. The first error is kept, and
+// returned by Close
+func (r *Recorder) write(ex *Exchange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	if r.file == nil {
+		r.err = errors.New("jmaptest: recorder is closed")
+		return
+	}
+	r.err = r.enc.Encode(ex)
+}
+
+// recordingBody records the body of a response as it is read, and writes the
+// Exchange once it has been read to the end or closed
+type recordingBody struct {
+	io.ReadCloser
+	recorder *Recorder
+	exchange *Exchange
+	buf      bytes.Buffer
+	once     sync.Once
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if errors.Is(err, io.EOF) {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish()
+	return err
+}
+
+func (b *recordingBody) finish() {
+	b.once.Do(func() {
+		b.exchange.Body = b.buf.Bytes()
+		b.recorder.write(b.exchange)
+	})
+}
+
+func (r *Recorder) replay(req *http.Request, body []byte) (*http.Response, error) {
+	key, err := r.matchKey(body)
+	if err != nil {
+		return nil, err
+	}
+	url := recordedURL(req.URL)
+
+	r.mu.Lock()
+	match := -1
+	for i, ex := range r.exchanges {
+		if ex.Method != req.Method || ex.URL != url {
+			continue
+		}
+		exKey, err := r.matchKey(ex.RequestBody)
+		if err != nil || exKey != key {
+			continue
+		}
+		match = i
+		if !r.used[i] {
+			break
+		}
+	}
+	if match >= 0 {
+		r.used[match] = true
+	}
+	r.mu.Unlock()
+	if match < 0 {
+		return nil, fmt.Errorf("jmaptest: no recorded response to %s %s", req.Method, url)
+	}
+
+	ex := r.exchanges[match]
+	header := http.Header{}
+	for k, v := range ex.Header {
+		header[k] = append([]string{}, v...)
+	}
+	header.Set("Content-Length", strconv.Itoa(len(ex.Body)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", ex.Status, http.StatusText(ex.Status)),
+		StatusCode:    ex.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(ex.Body)),
+		ContentLength: int64(len(ex.Body)),
+		Request:       req,
+	}, nil
+}
+
+// matchKey returns the form of a request body which is compared when matching
+// requests. JSON bodies are normalized: the IgnoreFields are removed, the
+// "using" capabilities sorted and the properties of objects sorted
+func (r *Recorder) matchKey(body []byte) (string, error) {
+	if !json.Valid(body) {
+		return string(body), nil
+	}
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+	if obj, ok := v.(map[string]interface{}); ok {
+		if using, ok := obj["using"].([]interface{}); ok {
+			sort.Slice(using, func(i, j int) bool {
+				return fmt.Sprint(using[i]) < fmt.Sprint(using[j])
+			})
+		}
+	}
+	ignore := make(map[string]bool, len(r.IgnoreFields))
+	for _, field := range r.IgnoreFields {
+		ignore[field] = true
+	}
+	data, err := json.Marshal(removeFields(v, ignore))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// removeFields removes the properties in ignore from v, at any depth
+func removeFields(v interface{}, ignore map[string]bool) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, item := range val {
+			if ignore[k] || ignore[strings.TrimPrefix(k, "#")] {
+				delete(val, k)
+				continue
+			}
+			val[k] = removeFields(item, ignore)
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = removeFields(item, ignore)
+		}
+	}
+	return v
+}
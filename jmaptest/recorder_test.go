@@ -0,0 +1,243 @@
+package jmaptest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~rockorager/go-jmap"
+	"git.sr.ht/~rockorager/go-jmap/core"
+	"git.sr.ht/~rockorager/go-jmap/core/push"
+	"github.com/stretchr/testify/assert"
+)
+
+// A binary blob, which isn't valid UTF-8
+var testBlob = []byte{0x00, 0xff, 0xfe, 'b', 'l', 'o', 'b'}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	var ts *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{
+			"capabilities": {"urn:ietf:params:jmap:core": {}},
+			"accounts": {"A1": {"name": "test"}},
+			"apiUrl": "%[1]s/api",
+			"downloadUrl": "%[1]s/download/{accountId}/{blobId}/{name}?type={type}",
+			"uploadUrl": "%[1]s/upload/{accountId}",
+			"eventSourceUrl": "%[1]s/events{?types,closeafter,ping}",
+			"state": "s1"
+		}`, ts.URL)
+	})
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		req := struct {
+			Calls [][]json.RawMessage `json:"methodCalls"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"methodResponses": req.Calls,
+			"sessionState":    "s1",
+		})
+	})
+	mux.HandleFunc("/upload/", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"accountId":"A1","blobId":"B%d","type":"application/octet-stream","size":%d}`, len(data), len(data))
+	})
+	mux.HandleFunc("/download/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(testBlob)
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: state\ndata: {\"@type\":\"StateChange\",\"changed\":{\"A1\":{\"Email\":\"s2\"}}}\n\n")
+	})
+	ts = httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// useClient exercises each endpoint with client
+func useClient(t *testing.T, client *jmap.Client) {
+	assert := assert.New(t)
+	if !assert.NoError(client.Authenticate()) {
+		return
+	}
+
+	req := &jmap.Request{}
+	req.Invoke(&core.Echo{Hello: "world"})
+	resp, err := client.Do(req)
+	if assert.NoError(err) && assert.Equal(1, len(resp.Responses)) {
+		assert.Equal(&core.Echo{Hello: "world"}, resp.Responses[0].Args)
+	}
+
+	upload, err := client.Upload("A1", bytes.NewReader([]byte("hello")))
+	if assert.NoError(err) {
+		assert.Equal(jmap.ID("B5"), upload.ID)
+	}
+
+	body, err := client.Download("A1", "B1")
+	if assert.NoError(err) {
+		data, err := io.ReadAll(body)
+		body.Close()
+		assert.NoError(err)
+		assert.Equal(testBlob, data)
+	}
+
+	changes := []*jmap.StateChange{}
+	es := &push.EventSource{
+		Client:          client,
+		Handler:         func(s *jmap.StateChange) { changes = append(changes, s) },
+		CloseAfterState: true,
+	}
+	assert.NoError(es.Listen())
+	es.Close()
+	if assert.Equal(1, len(changes)) {
+		assert.Equal("s2", changes[0].Changed["A1"]["Email"])
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	assert := assert.New(t)
+	ts := newTestServer(t)
+	path := filepath.Join(t.TempDir(), "fixture.jsonl")
+
+	client := &jmap.Client{SessionEndpoint: ts.URL + "/session"}
+	client.WithAccessToken("secret-token")
+	rec, err := Record(path, client)
+	if !assert.NoError(err) {
+		return
+	}
+	useClient(t, client)
+	assert.NoError(rec.Close())
+	ts.Close()
+
+	data, err := os.ReadFile(path)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NotContains(string(data), "secret-token")
+	assert.Equal(5, strings.Count(string(data), "\n"))
+
+	client = &jmap.Client{SessionEndpoint: ts.URL + "/session"}
+	rec, err = Replay(path, client)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(5, len(rec.Exchanges()))
+	useClient(t, client)
+
+	// Requests which weren't recorded fail
+	req := &jmap.Request{}
+	req.Invoke(&core.Echo{Hello: "other"})
+	_, err = client.Do(req)
+	assert.ErrorContains(err, "no recorded response")
+
+	// Unless their differences are ignored
+	rec.IgnoreFields = []string{"Hello"}
+	resp, err := client.Do(req)
+	if assert.NoError(err) {
+		assert.Equal(&core.Echo{Hello: "world"}, resp.Responses[0].Args)
+	}
+}
+
+func TestRecordQueryCredentials(t *testing.T) {
+	assert := assert.New(t)
+	ts := newTestServer(t)
+	path := filepath.Join(t.TempDir(), "fixture.jsonl")
+
+	client := &jmap.Client{SessionEndpoint: ts.URL + "/session"}
+	rec, err := Record(path, client)
+	if !assert.NoError(err) {
+		return
+	}
+	resp, err := client.HttpClient.Get(ts.URL + "/download/A1/B1/blob?type=text%2Fplain&access_token=secret-token")
+	if !assert.NoError(err) {
+		return
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(rec.Close())
+
+	data, err := os.ReadFile(path)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NotContains(string(data), "secret-token")
+	assert.Contains(string(data), "type=text%2Fplain")
+
+	// Requests are matched without their credentials
+	client = &jmap.Client{SessionEndpoint: ts.URL + "/session"}
+	if _, err := Replay(path, client); !assert.NoError(err) {
+		return
+	}
+	resp, err = client.HttpClient.Get(ts.URL + "/download/A1/B1/blob?type=text%2Fplain&access_token=other-token")
+	if assert.NoError(err) {
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(testBlob, body)
+	}
+}
+
+func TestRecordWriteError(t *testing.T) {
+	assert := assert.New(t)
+	ts := newTestServer(t)
+	path := filepath.Join(t.TempDir(), "fixture.jsonl")
+
+	client := &jmap.Client{SessionEndpoint: ts.URL + "/session"}
+	rec, err := Record(path, client)
+	if !assert.NoError(err) {
+		return
+	}
+	// Writing the Exchange fails
+	rec.file.Close()
+	resp, err := client.HttpClient.Get(ts.URL + "/session")
+	if !assert.NoError(err) {
+		return
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.ErrorIs(rec.Close(), os.ErrClosed)
+}
+
+func TestBody(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		body     Body
+		expected string
+	}{
+		{
+			body:     Body(`{"a":[1,2]}`),
+			expected: `{"json":{"a":[1,2]}}`,
+		},
+		{
+			// Not compact, so stored as text to keep it unchanged
+			body:     Body(`{"a": 1}`),
+			expected: `{"text":"{\"a\": 1}"}`,
+		},
+		{
+			body:     Body("event: state\n"),
+			expected: `{"text":"event: state\n"}`,
+		},
+		{
+			body:     Body{0xff, 0x00},
+			expected: `{"base64":"/wA="}`,
+		},
+	}
+	for _, test := range tests {
+		data, err := json.Marshal(test.body)
+		assert.NoError(err)
+		assert.JSONEq(test.expected, string(data))
+
+		var body Body
+		assert.NoError(json.Unmarshal(data, &body))
+		assert.Equal(test.body, body)
+	}
+}
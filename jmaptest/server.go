@@ -0,0 +1,423 @@
+package jmaptest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~rockorager/go-jmap"
+	"git.sr.ht/~rockorager/go-jmap/core"
+	"git.sr.ht/~rockorager/go-jmap/mail"
+	"git.sr.ht/~rockorager/go-jmap/mail/email"
+	"git.sr.ht/~rockorager/go-jmap/mail/emailsubmission"
+	"git.sr.ht/~rockorager/go-jmap/mail/identity"
+	"git.sr.ht/~rockorager/go-jmap/mail/mailbox"
+	"git.sr.ht/~rockorager/go-jmap/mail/thread"
+	"git.sr.ht/~rockorager/go-jmap/mail/vacationresponse"
+)
+
+const (
+	// The id of the account of a Server
+	AccountID jmap.ID = "A1"
+
+	// The username of the account of a Server, and the email address of
+	// its default Identity
+	Username = "test@example.com"
+)
+
+// The state of the Session of a Server, which never changes
+const sessionState = "0"
+
+// The request limits of a Server, which the API endpoint enforces
+const (
+	maxSizeRequest    = 10000000
+	maxCallsInRequest = 64
+)
+
+// A Server is an in-memory JMAP server for tests. It serves the Session
+// resource, the API, upload, download and EventSource endpoints of a single
+// account (AccountID), and implements these methods:
+//
+//   - Core/echo and Blob/copy
+//   - Mailbox/get, changes, query, queryChanges and set
+//   - Email/get, changes, query, queryChanges, set and import
+//   - Thread/get and changes
+//   - Identity/get, changes and set
+//   - EmailSubmission/get, changes, query, queryChanges and set. Submissions
+//     are delivered at once, and not sent anywhere
+//   - SearchSnippet/get
+//   - VacationResponse/get and set
+//
+// Each data type has a real state string, so /changes and /queryChanges work.
+// The /queryChanges methods can calculate changes from any query state
+// returned by /query or /queryChanges. Arguments are decoded with the types of
+// this module, and responses encoded with them, so the Server understands
+// exactly what the client sends.
+//
+// A new Server has the mailboxes Inbox, Drafts, Sent and Trash, and an
+// Identity for Username. Requests aren't authenticated
+type Server struct {
+	*httptest.Server
+
+	mu  sync.Mutex
+	api *jmap.Server
+
+	mailboxes   *collection[*mailbox.Mailbox]
+	emails      *collection[*email.Email]
+	threads     *collection[*thread.Thread]
+	identities  *collection[*identity.Identity]
+	submissions *collection[*emailsubmission.EmailSubmission]
+	vacation    *collection[*vacationresponse.VacationResponse]
+
+	blobs    map[jmap.ID]*storedBlob
+	nextBlob int
+	// Whether an email was delivered since the last StateChange
+	delivered bool
+
+	subscribers map[*subscriber]bool
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewServer starts a Server. Close it when done
+func NewServer() *Server {
+	s := &Server{
+		api:         jmap.NewServer(),
+		mailboxes:   newCollection[*mailbox.Mailbox]("Mailbox", "M"),
+		emails:      newCollection[*email.Email]("Email", "E"),
+		threads:     newCollection[*thread.Thread]("Thread", "T"),
+		identities:  newCollection[*identity.Identity]("Identity", "I"),
+		submissions: newCollection[*emailsubmission.EmailSubmission]("EmailSubmission", "S"),
+		vacation:    newCollection[*vacationresponse.VacationResponse]("VacationResponse", "V"),
+		blobs:       make(map[jmap.ID]*storedBlob),
+		subscribers: make(map[*subscriber]bool),
+		done:        make(chan struct{}),
+	}
+	s.api.SessionState = func() string { return sessionState }
+	s.api.MaxSizeRequest = maxSizeRequest
+	s.api.MaxCallsInRequest = maxCallsInRequest
+	s.registerCore()
+	s.registerMail()
+	// The objects the Server starts with aren't changes
+	s.stateChange()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jmap/session", s.serveSession)
+	mux.HandleFunc("/jmap/api/", s.serveAPI)
+	mux.HandleFunc("/jmap/upload/", s.serveUpload)
+	mux.HandleFunc("/jmap/download/", s.serveDownload)
+	mux.HandleFunc("/jmap/eventsource/", s.serveEventSource)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Close ends any EventSource streams, and shuts down the Server
+func (s *Server) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.Server.Close()
+}
+
+// Client returns a jmap.Client for the Server
+func (s *Server) Client() *jmap.Client {
+	return &jmap.Client{
+		SessionEndpoint: s.URL + "/jmap/session",
+		HttpClient:      s.Server.Client(),
+	}
+}
+
+// SessionEndpoint returns the URL of the Session resource
+func (s *Server) SessionEndpoint() string {
+	return s.URL + "/jmap/session"
+}
+
+// handle registers the handler of a method. The lists of its response are
+// always encoded, see encodeLists
+func (s *Server) handle(name string, capability jmap.URI, fn func(r *jmap.MethodCall, args json.RawMessage) (interface{}, error)) {
+	s.api.Handle(name, capability, func(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+		resp, err := fn(r, args)
+		if err != nil {
+			return nil, err
+		}
+		return encodeLists(name, resp)
+	})
+}
+
+// The lists of the responses to the standard methods, by method. Result
+// references point into these, so they are encoded even if empty
+var responseLists = map[string][]string{
+	"get":          {"list", "notFound"},
+	"changes":      {"created", "updated", "destroyed"},
+	"query":        {"ids"},
+	"queryChanges": {"removed", "added"},
+}
+
+// encodeLists returns the response to the method name, with the lists the
+// response types omit when empty set to empty arrays
+func encodeLists(name string, resp interface{}) (interface{}, error) {
+	lists := responseLists[name[strings.LastIndex(name, "/")+1:]]
+	if len(lists) == 0 {
+		return resp, nil
+	}
+	obj := map[string]json.RawMessage{}
+	if err := toJSON(resp, &obj); err != nil {
+		return nil, err
+	}
+	for _, prop := range lists {
+		if _, ok := obj[prop]; !ok {
+			obj[prop] = json.RawMessage("[]")
+		}
+	}
+	return obj, nil
+}
+
+// session returns the Session object of the Server
+func (s *Server) session() *jmap.Session {
+	mailCapability := &mail.Mail{
+		MaxSizeMailboxName:         255,
+		MaxSizeAttachmentsPerEmail: 50000000,
+		EmailQuerySortOptions:      []string{"receivedAt", "sentAt", "size", "from", "to", "subject"},
+		MayCreateTopLevelMailbox:   true,
+	}
+	return &jmap.Session{
+		Capabilities: map[jmap.URI]jmap.Capability{
+			core.URI: &core.Core{
+				MaxSizeUpload:         50000000,
+				MaxConcurrentUpload:   4,
+				MaxSizeRequest:        maxSizeRequest,
+				MaxConcurrentRequests: 4,
+				MaxCallsInRequest:     maxCallsInRequest,
+				MaxObjectsInGet:       1000,
+				MaxObjectsInSet:       1000,
+				CollationAlgorithms:   []jmap.CollationAlgo{"i;ascii-casemap", "i;octet"},
+			},
+		},
+		RawCapabilities: map[jmap.URI]json.RawMessage{
+			mail.URI:             json.RawMessage(`{}`),
+			emailsubmission.URI:  json.RawMessage(`{}`),
+			vacationresponse.URI: json.RawMessage(`{}`),
+		},
+		Accounts: map[jmap.ID]jmap.Account{
+			AccountID: {
+				Name:       Username,
+				IsPersonal: true,
+				Capabilities: map[jmap.URI]jmap.Capability{
+					mail.URI:             mailCapability,
+					emailsubmission.URI:  &emailsubmission.Capability{},
+					vacationresponse.URI: &vacationresponse.Capability{},
+				},
+			},
+		},
+		PrimaryAccounts: map[jmap.URI]jmap.ID{
+			core.URI:             AccountID,
+			mail.URI:             AccountID,
+			emailsubmission.URI:  AccountID,
+			vacationresponse.URI: AccountID,
+		},
+		Username:       Username,
+		APIURL:         s.URL + "/jmap/api/",
+		DownloadURL:    s.URL + "/jmap/download/{accountId}/{blobId}/{name}?accept={type}",
+		UploadURL:      s.URL + "/jmap/upload/{accountId}/",
+		EventSourceURL: s.URL + "/jmap/eventsource/?types={types}&closeafter={closeafter}&ping={ping}",
+		State:          sessionState,
+	}
+}
+
+func (s *Server) serveSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.session())
+}
+
+// serveAPI performs requests one at a time, and sends the changes they made
+// to the EventSource streams
+func (s *Server) serveAPI(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.api.ServeHTTP(w, r)
+	change := s.stateChange()
+	s.mu.Unlock()
+	if change != nil {
+		s.broadcast(change)
+	}
+}
+
+// decodeArgs decodes the arguments of a call, and checks its account
+func decodeArgs(args json.RawMessage, v interface{}, account func() jmap.ID) error {
+	if err := json.Unmarshal(args, v); err != nil {
+		return methodError(jmap.ErrInvalidArguments, err.Error())
+	}
+	if account != nil && account() != AccountID {
+		return methodError(jmap.ErrAccountNotFound, "")
+	}
+	return nil
+}
+
+func methodError(typ jmap.ErrorType, desc string) error {
+	err := &jmap.MethodError{Type: string(typ)}
+	if desc != "" {
+		err.Description = &desc
+	}
+	return err
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// A subscriber is an open EventSource stream
+type subscriber struct {
+	types   map[string]bool
+	changes chan *jmap.StateChange
+}
+
+// stateChange returns the StateChange of the types whose state changed since
+// the last call, or nil if there are none
+func (s *Server) stateChange() *jmap.StateChange {
+	states := jmap.TypeState{}
+	for _, c := range []interface {
+		name() string
+		flush() (string, bool)
+	}{
+		dirtyState[*mailbox.Mailbox]{s.mailboxes},
+		dirtyState[*email.Email]{s.emails},
+		dirtyState[*thread.Thread]{s.threads},
+		dirtyState[*identity.Identity]{s.identities},
+		dirtyState[*emailsubmission.EmailSubmission]{s.submissions},
+		dirtyState[*vacationresponse.VacationResponse]{s.vacation},
+	} {
+		if state, ok := c.flush(); ok {
+			states[c.name()] = state
+		}
+	}
+	if s.delivered {
+		s.delivered = false
+		states[string(mail.EmailDeliveryEvent)] = s.emails.State()
+	}
+	if len(states) == 0 {
+		return nil
+	}
+	return &jmap.StateChange{
+		Type:    "StateChange",
+		Changed: map[jmap.ID]jmap.TypeState{AccountID: states},
+	}
+}
+
+// dirtyState reports the state of a collection if it changed
+type dirtyState[T any] struct {
+	c *collection[T]
+}
+
+func (d dirtyState[T]) name() string { return d.c.name }
+
+func (d dirtyState[T]) flush() (string, bool) {
+	dirty := d.c.dirty
+	d.c.dirty = false
+	return d.c.State(), dirty
+}
+
+// broadcast sends a StateChange to each EventSource subscribed to any of its
+// types
+func (s *Server) broadcast(change *jmap.StateChange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub := range s.subscribers {
+		filtered := jmap.TypeState{}
+		for typ, state := range change.Changed[AccountID] {
+			if sub.types == nil || sub.types[typ] {
+				filtered[typ] = state
+			}
+		}
+		if len(filtered) == 0 {
+			continue
+		}
+		select {
+		case sub.changes <- &jmap.StateChange{
+			Type:    "StateChange",
+			Changed: map[jmap.ID]jmap.TypeState{AccountID: filtered},
+		}:
+		default:
+			// The subscriber isn't keeping up
+		}
+	}
+}
+
+func (s *Server) serveEventSource(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	query := r.URL.Query()
+	sub := &subscriber{changes: make(chan *jmap.StateChange, 16)}
+	if types := query.Get("types"); types != "" && types != "*" {
+		sub.types = make(map[string]bool)
+		for _, typ := range strings.Split(types, ",") {
+			sub.types[typ] = true
+		}
+	}
+	closeAfter := query.Get("closeafter") == "state"
+	var ping <-chan time.Time
+	if n, err := strconv.Atoi(query.Get("ping")); err == nil && n > 0 {
+		ticker := time.NewTicker(time.Duration(n) * time.Second)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	s.mu.Lock()
+	s.subscribers[sub] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.subscribers, sub)
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case change := <-sub.changes:
+			data, _ := json.Marshal(change)
+			fmt.Fprintf(w, "event: state\ndata: %s\n\n", data)
+			flusher.Flush()
+			if closeAfter {
+				return
+			}
+		case <-ping:
+			fmt.Fprintf(w, "event: ping\ndata: {\"interval\":%s}\n\n", query.Get("ping"))
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// subscribed returns the number of open EventSource streams
+func (s *Server) subscribed() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscribers)
+}
+
+// sortedIDs returns the keys of a map of ids, sorted
+func sortedIDs[V any](m map[jmap.ID]V) []jmap.ID {
+	ids := make([]jmap.ID, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
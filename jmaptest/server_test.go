@@ -0,0 +1,402 @@
+package jmaptest
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"git.sr.ht/~rockorager/go-jmap"
+	"git.sr.ht/~rockorager/go-jmap/core"
+	"git.sr.ht/~rockorager/go-jmap/core/push"
+	"git.sr.ht/~rockorager/go-jmap/mail"
+	"git.sr.ht/~rockorager/go-jmap/mail/email"
+	"git.sr.ht/~rockorager/go-jmap/mail/emailsubmission"
+	"git.sr.ht/~rockorager/go-jmap/mail/mailbox"
+	"git.sr.ht/~rockorager/go-jmap/mail/searchsnippet"
+	"git.sr.ht/~rockorager/go-jmap/mail/thread"
+	"git.sr.ht/~rockorager/go-jmap/mail/vacationresponse"
+	"github.com/stretchr/testify/assert"
+)
+
+var testMessage = []byte("From: Alice <alice@example.com>\r\n" +
+	"To: test@example.com\r\n" +
+	"Subject: Lunch\r\n" +
+	"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+	"Message-ID: <lunch@example.com>\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Shall we have lunch tomorrow?")
+
+var testReply = []byte("From: Test <test@example.com>\r\n" +
+	"To: alice@example.com\r\n" +
+	"Subject: Re: Lunch\r\n" +
+	"Message-ID: <reply@example.com>\r\n" +
+	"In-Reply-To: <lunch@example.com>\r\n" +
+	"\r\n" +
+	"Yes, at noon")
+
+// do makes a request, and fails the test if it fails
+func do(t *testing.T, client *jmap.Client, methods ...jmap.Method) *jmap.Response {
+	t.Helper()
+	req := &jmap.Request{}
+	for _, m := range methods {
+		req.Invoke(m)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestServerMailbox(t *testing.T) {
+	assert := assert.New(t)
+	s := NewServer()
+	defer s.Close()
+	client := s.Client()
+
+	resp := do(t, client, &mailbox.Get{Account: AccountID})
+	get, err := jmap.Result[*mailbox.GetResponse](resp, "0")
+	if !assert.NoError(err) || !assert.Equal(4, len(get.List)) {
+		return
+	}
+	assert.Equal(mailbox.RoleInbox, get.List[0].Role)
+	state := get.State
+
+	resp = do(t, client, &mailbox.Query{
+		Account: AccountID,
+		Sort:    []*mailbox.SortComparator{{Property: "name", IsAscending: true}},
+	})
+	query, err := jmap.Result[*mailbox.QueryResponse](resp, "0")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal([]jmap.ID{"M2", "M1", "M3", "M4"}, query.IDs)
+
+	resp = do(t, client, &mailbox.Set{
+		Account: AccountID,
+		Create: map[jmap.ID]*mailbox.Mailbox{
+			"new":    {Name: "Archive", Role: mailbox.RoleArchive},
+			"noname": {},
+		},
+		Destroy: []jmap.ID{"M9"},
+	})
+	set, err := jmap.Result[*mailbox.SetResponse](resp, "0")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(jmap.ID("M5"), set.Created["new"].ID)
+	assert.True(set.Created["new"].Rights.MayDelete)
+	assert.Equal(string(jmap.ErrInvalidProperties), set.NotCreated["noname"].Type)
+	assert.Equal(string(jmap.ErrNotFound), set.NotDestroyed["M9"].Type)
+
+	resp = do(t, client,
+		&mailbox.Changes{Account: AccountID, SinceState: state},
+		&mailbox.QueryChanges{
+			Account:         AccountID,
+			Sort:            []*mailbox.SortComparator{{Property: "name", IsAscending: true}},
+			SinceQueryState: query.QueryState,
+		},
+	)
+	changes, err := jmap.Result[*mailbox.ChangesResponse](resp, "0")
+	if assert.NoError(err) {
+		assert.Equal([]jmap.ID{"M5"}, changes.Created)
+		assert.Equal(set.NewState, changes.NewState)
+	}
+	queryChanges, err := jmap.Result[*mailbox.QueryChangesResponse](resp, "1")
+	if assert.NoError(err) {
+		assert.Equal([]*jmap.AddedItem{{ID: "M5", Index: 0}}, queryChanges.Added)
+	}
+
+	resp = do(t, client, &mailbox.Changes{Account: AccountID, SinceState: "bogus"})
+	_, err = jmap.Result[*mailbox.ChangesResponse](resp, "0")
+	assert.ErrorIs(err, jmap.ErrCannotCalculateChanges)
+}
+
+func TestServerEmail(t *testing.T) {
+	assert := assert.New(t)
+	s := NewServer()
+	defer s.Close()
+	client := s.Client()
+
+	_, err := s.Deliver(testMessage)
+	if !assert.NoError(err) {
+		return
+	}
+	resp := do(t, client, &email.Get{Account: AccountID, IDs: []jmap.ID{"E1"}})
+	get, err := jmap.Result[*email.GetResponse](resp, "0")
+	if !assert.NoError(err) || !assert.Equal(1, len(get.List)) {
+		return
+	}
+	state := get.State
+
+	// A reply, created as a draft, joins the Thread of the Email
+	resp = do(t, client, &email.Set{
+		Account: AccountID,
+		Create: map[jmap.ID]*email.Email{
+			"draft": {
+				MailboxIDs: map[jmap.ID]bool{"M2": true},
+				Keywords:   map[string]bool{"$draft": true, "$seen": true},
+				From:       []*mail.Address{{Email: Username}},
+				To:         []*mail.Address{{Name: "Alice", Email: "alice@example.com"}},
+				Subject:    "Re: Lunch",
+				InReplyTo:  []string{"lunch@example.com"},
+				TextBody:   []*email.BodyPart{{PartID: "1", Type: "text/plain"}},
+				BodyValues: map[string]*email.BodyValue{"1": {Value: "Noon works"}},
+			},
+		},
+	})
+	set, err := jmap.Result[*email.SetResponse](resp, "0")
+	if !assert.NoError(err) || !assert.Contains(set.Created, jmap.ID("draft")) {
+		return
+	}
+	assert.Equal(get.List[0].ThreadID, set.Created["draft"].ThreadID)
+
+	req := &jmap.Request{}
+	q := jmap.InvokeQuery(req, &email.Query{
+		Account: AccountID,
+		Filter:  &email.FilterCondition{Text: "noon"},
+	})
+	g := jmap.InvokeGet(req, &email.Get{
+		Account:             AccountID,
+		ReferenceIDs:        q.IDs(),
+		Properties:          []string{"threadId", "subject", "bodyValues", "textBody"},
+		FetchTextBodyValues: true,
+	})
+	jmap.InvokeGet(req, &thread.Get{Account: AccountID, ReferenceIDs: email.ThreadIDs(g)})
+	req.Invoke(&searchsnippet.Get{
+		Account:      AccountID,
+		Filter:       &email.FilterCondition{Text: "noon"},
+		ReferenceIDs: q.IDs(),
+	})
+	resp, err = client.Do(req)
+	if !assert.NoError(err) {
+		return
+	}
+	get, err = jmap.Result[*email.GetResponse](resp, "1")
+	if assert.NoError(err) && assert.Equal(1, len(get.List)) {
+		e := get.List[0]
+		assert.Equal("Re: Lunch", e.Subject)
+		assert.Equal("Noon works", e.BodyValues[e.TextBody[0].PartID].Value)
+	}
+	threads, err := jmap.Result[*thread.GetResponse](resp, "2")
+	if assert.NoError(err) && assert.Equal(1, len(threads.List)) {
+		assert.Equal(2, len(threads.List[0].EmailIDs))
+	}
+	snippets, err := jmap.Result[*searchsnippet.GetResponse](resp, "3")
+	if assert.NoError(err) && assert.Equal(1, len(snippets.List)) {
+		assert.Equal("<mark>Noon</mark> works", snippets.List[0].Preview)
+	}
+
+	// A reference to a query without results gets no Emails
+	req = &jmap.Request{}
+	q = jmap.InvokeQuery(req, &email.Query{
+		Account: AccountID,
+		Filter:  &email.FilterCondition{Text: "dinner"},
+	})
+	jmap.InvokeGet(req, &email.Get{Account: AccountID, ReferenceIDs: q.IDs()})
+	resp, err = client.Do(req)
+	if !assert.NoError(err) {
+		return
+	}
+	get, err = jmap.Result[*email.GetResponse](resp, "1")
+	if assert.NoError(err) {
+		assert.Empty(get.List)
+	}
+
+	resp = do(t, client,
+		&email.Set{
+			Account: AccountID,
+			Update: map[jmap.ID]jmap.Patch{
+				"E1": {"keywords/$seen": true},
+				"E2": {"subject": "Changed"},
+			},
+		},
+		&email.Changes{Account: AccountID, SinceState: state},
+		&mailbox.Get{Account: AccountID, IDs: []jmap.ID{"M1"}},
+	)
+	set, err = jmap.Result[*email.SetResponse](resp, "0")
+	if assert.NoError(err) {
+		assert.Contains(set.Updated, jmap.ID("E1"))
+		assert.Equal(string(jmap.ErrInvalidProperties), set.NotUpdated["E2"].Type)
+	}
+	changes, err := jmap.Result[*email.ChangesResponse](resp, "1")
+	if assert.NoError(err) {
+		assert.Equal([]jmap.ID{"E2"}, changes.Created)
+		assert.Equal([]jmap.ID{"E1"}, changes.Updated)
+	}
+	mailboxes, err := jmap.Result[*mailbox.GetResponse](resp, "2")
+	if assert.NoError(err) {
+		assert.Equal(uint64(1), mailboxes.List[0].TotalEmails)
+		assert.Equal(uint64(0), mailboxes.List[0].UnreadEmails)
+	}
+}
+
+func TestServerImport(t *testing.T) {
+	assert := assert.New(t)
+	s := NewServer()
+	defer s.Close()
+	client := s.Client()
+
+	upload, err := client.Upload(AccountID, bytes.NewReader(testReply))
+	if !assert.NoError(err) {
+		return
+	}
+	resp := do(t, client, &email.Import{
+		Account: AccountID,
+		Emails: map[string]*email.EmailImport{
+			"reply": {BlobID: upload.ID, MailboxIDs: map[jmap.ID]bool{"M3": true}},
+			"bad":   {BlobID: "missing", MailboxIDs: map[jmap.ID]bool{"M3": true}},
+		},
+	})
+	imp, err := jmap.Result[*email.ImportResponse](resp, "0")
+	if !assert.NoError(err) || !assert.Contains(imp.Created, jmap.ID("reply")) {
+		return
+	}
+	assert.Equal(string(mail.ErrBlobNotFound), imp.NotCreated["bad"].Type)
+
+	resp = do(t, client, &email.Get{Account: AccountID, IDs: []jmap.ID{imp.Created["reply"].ID}})
+	get, err := jmap.Result[*email.GetResponse](resp, "0")
+	if !assert.NoError(err) || !assert.Equal(1, len(get.List)) {
+		return
+	}
+	e := get.List[0]
+	assert.Equal("Re: Lunch", e.Subject)
+	assert.Equal([]string{"lunch@example.com"}, e.InReplyTo)
+	assert.Equal("Yes, at noon", e.Preview)
+
+	body, err := client.Download(AccountID, e.BlobID)
+	if assert.NoError(err) {
+		data, err := io.ReadAll(body)
+		body.Close()
+		assert.NoError(err)
+		assert.Equal(testReply, data)
+	}
+}
+
+func TestServerSubmission(t *testing.T) {
+	assert := assert.New(t)
+	s := NewServer()
+	defer s.Close()
+	client := s.Client()
+
+	resp := do(t, client,
+		&email.Set{
+			Account: AccountID,
+			Create: map[jmap.ID]*email.Email{
+				"draft": {
+					MailboxIDs: map[jmap.ID]bool{"M2": true},
+					Keywords:   map[string]bool{"$draft": true},
+					From:       []*mail.Address{{Email: Username}},
+					To:         []*mail.Address{{Email: "alice@example.com"}},
+					Subject:    "Hello",
+				},
+			},
+		},
+		&emailsubmission.Set{
+			Account: AccountID,
+			Create: map[jmap.ID]*emailsubmission.EmailSubmission{
+				"send": {IdentityID: "I1", EmailID: "#draft"},
+			},
+			OnSuccessUpdateEmail: map[jmap.ID]jmap.Patch{
+				"#send": {"mailboxIds/M2": nil, "mailboxIds/M3": true, "keywords/$draft": nil},
+			},
+		},
+	)
+	assert.Equal(3, len(resp.Responses))
+	sub, err := jmap.Result[*emailsubmission.SetResponse](resp, "1")
+	if assert.NoError(err) && assert.Contains(sub.Created, jmap.ID("send")) {
+		assert.Equal("final", sub.Created["send"].UndoStatus)
+		assert.Equal("alice@example.com", sub.Created["send"].Envelope.RcptTo[0].Email)
+	}
+	set, err := jmap.Result[*email.SetResponse](resp, "1")
+	if assert.NoError(err) {
+		assert.Contains(set.Updated, jmap.ID("E1"))
+	}
+
+	resp = do(t, client, &email.Get{Account: AccountID, IDs: []jmap.ID{"E1"}})
+	get, err := jmap.Result[*email.GetResponse](resp, "0")
+	if assert.NoError(err) && assert.Equal(1, len(get.List)) {
+		assert.Equal(map[jmap.ID]bool{"M3": true}, get.List[0].MailboxIDs)
+		assert.Empty(get.List[0].Keywords)
+	}
+}
+
+func TestServerEventSource(t *testing.T) {
+	assert := assert.New(t)
+	s := NewServer()
+	defer s.Close()
+	client := s.Client()
+	if err := client.Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := make(chan *jmap.StateChange, 1)
+	es := &push.EventSource{
+		Client:          client,
+		Handler:         func(c *jmap.StateChange) { changes <- c },
+		Events:          []jmap.EventType{mail.EmailEvent, mail.EmailDeliveryEvent},
+		CloseAfterState: true,
+	}
+	done := make(chan error, 1)
+	go func() { done <- es.Listen() }()
+	for s.subscribed() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err := s.Deliver(testMessage)
+	if !assert.NoError(err) {
+		return
+	}
+	select {
+	case change := <-changes:
+		assert.Equal(jmap.TypeState{"Email": "1", "EmailDelivery": "1"}, change.Changed[AccountID])
+	case <-time.After(5 * time.Second):
+		t.Fatal("no state change")
+	}
+	assert.NoError(<-done)
+}
+
+func TestServerErrors(t *testing.T) {
+	assert := assert.New(t)
+	s := NewServer()
+	defer s.Close()
+	client := s.Client()
+
+	// Methods of capabilities the request doesn't use are unknown
+	req := &jmap.Request{Using: []jmap.URI{core.URI}}
+	req.Calls = append(req.Calls, &jmap.Invocation{
+		Name:   "Mailbox/get",
+		Args:   &mailbox.Get{Account: AccountID},
+		CallID: "0",
+	})
+	req.Invoke(&core.Echo{Hello: "world"})
+	resp, err := client.Do(req)
+	if assert.NoError(err) {
+		assert.ErrorIs(resp.Err(), jmap.ErrUnknownMethod)
+		echo, err := jmap.Result[*core.Echo](resp, "1")
+		if assert.NoError(err) {
+			assert.Equal("world", echo.Hello)
+		}
+	}
+
+	resp = do(t, client,
+		&mailbox.Set{Account: AccountID, IfInState: "bogus"},
+		&mailbox.Get{Account: "other"},
+		&vacationresponse.Set{
+			Account: AccountID,
+			Create:  map[jmap.ID]*vacationresponse.VacationResponse{"v": {}},
+			Update:  map[jmap.ID]jmap.Patch{"singleton": {"isEnabled": true}},
+		},
+	)
+	_, err = jmap.Result[*mailbox.SetResponse](resp, "0")
+	assert.ErrorIs(err, jmap.ErrStateMismatch)
+	_, err = jmap.Result[*mailbox.GetResponse](resp, "1")
+	assert.ErrorIs(err, jmap.ErrAccountNotFound)
+	vacation, err := jmap.Result[*vacationresponse.SetResponse](resp, "2")
+	if assert.NoError(err) {
+		assert.Equal(string(jmap.ErrSingleton), vacation.NotCreated["v"].Type)
+		assert.Contains(vacation.Updated, jmap.ID("singleton"))
+	}
+}
@@ -0,0 +1,278 @@
+package jmaptest
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"git.sr.ht/~rockorager/go-jmap"
+	"git.sr.ht/~rockorager/go-jmap/mail"
+	"git.sr.ht/~rockorager/go-jmap/mail/email"
+	"git.sr.ht/~rockorager/go-jmap/mail/emailsubmission"
+)
+
+// submissionQuery decodes the filter of an EmailSubmission/query or
+// queryChanges call, which the library types only encode
+type submissionQuery struct {
+	emailsubmission.Query
+	Filter json.RawMessage `json:"filter,omitempty"`
+}
+
+type submissionQueryChanges struct {
+	emailsubmission.QueryChanges
+	Filter json.RawMessage `json:"filter,omitempty"`
+}
+
+func (s *Server) submissionGet(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &emailsubmission.Get{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	list, notFound, err := s.submissions.get(req.IDs, req.Properties)
+	if err != nil {
+		return nil, err
+	}
+	resp := &emailsubmission.GetResponse{
+		Account: req.Account,
+		State:   s.submissions.State(),
+		List:    list,
+	}
+	if len(notFound) > 0 {
+		resp.NotFound = notFound
+	}
+	return resp, nil
+}
+
+func (s *Server) submissionChanges(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &emailsubmission.Changes{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	created, updated, destroyed, newState, more, err := s.submissions.changes(req.SinceState, req.MaxChanges)
+	if err != nil {
+		return nil, err
+	}
+	return &emailsubmission.ChangesResponse{
+		Account:        req.Account,
+		OldState:       req.SinceState,
+		NewState:       newState,
+		HasMoreChanges: more,
+		Created:        created,
+		Updated:        updated,
+		Destroyed:      destroyed,
+	}, nil
+}
+
+// submissionQuerySpec returns the querySpec of an EmailSubmission/query or
+// queryChanges call
+func submissionQuerySpec(filter json.RawMessage, comparators []*emailsubmission.SortComparator) (querySpec[*emailsubmission.EmailSubmission], error) {
+	match := func(sub *emailsubmission.EmailSubmission) (bool, error) {
+		return matchFilter(filter, func(data json.RawMessage) (bool, error) {
+			cond := &emailsubmission.FilterCondition{}
+			if err := decodeCondition(data, cond); err != nil {
+				return false, err
+			}
+			switch {
+			case cond.IdentityIDs != nil && indexOf(cond.IdentityIDs, sub.IdentityID) < 0:
+				return false, nil
+			case cond.EmailIDs != nil && indexOf(cond.EmailIDs, sub.EmailID) < 0:
+				return false, nil
+			case cond.ThreadIDs != nil && indexOf(cond.ThreadIDs, sub.ThreadID) < 0:
+				return false, nil
+			case cond.UndoStatus != "" && sub.UndoStatus != cond.UndoStatus:
+				return false, nil
+			case cond.Before != nil && unixNano(sub.SendAt) >= cond.Before.UnixNano():
+				return false, nil
+			case cond.After != nil && unixNano(sub.SendAt) < cond.After.UnixNano():
+				return false, nil
+			}
+			return true, nil
+		})
+	}
+	fields := map[string]func(a, b *emailsubmission.EmailSubmission) int{
+		"emailId":  func(a, b *emailsubmission.EmailSubmission) int { return compare(a.EmailID, b.EmailID) },
+		"threadId": func(a, b *emailsubmission.EmailSubmission) int { return compare(a.ThreadID, b.ThreadID) },
+		"sentAt": func(a, b *emailsubmission.EmailSubmission) int {
+			return compare(unixNano(a.SendAt), unixNano(b.SendAt))
+		},
+	}
+	cmps := []comparator{}
+	for _, c := range comparators {
+		cmps = append(cmps, comparator{property: c.Property, ascending: c.IsAscending})
+	}
+	less, err := sorter(cmps, fields)
+	return querySpec[*emailsubmission.EmailSubmission]{
+		key:   queryKey(filter, comparators),
+		match: match,
+		less:  less,
+	}, err
+}
+
+func (s *Server) submissionQuery(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &submissionQuery{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	q, err := submissionQuerySpec(req.Filter, req.Sort)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.submissions.query(q, req.Position, req.Anchor, req.AnchorOffset, req.Limit)
+	if err != nil {
+		return nil, err
+	}
+	resp := &emailsubmission.QueryResponse{
+		Account:             req.Account,
+		QueryState:          result.queryState,
+		CanCalculateChanges: true,
+		Position:            result.position,
+		IDs:                 result.ids,
+		Limit:               req.Limit,
+	}
+	if req.CalculateTotal {
+		resp.Total = int64(result.total)
+	}
+	return resp, nil
+}
+
+func (s *Server) submissionQueryChanges(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &submissionQueryChanges{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	q, err := submissionQuerySpec(req.Filter, req.Sort)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.submissions.queryChanges(q, req.SinceQueryState, req.MaxChanges)
+	if err != nil {
+		return nil, err
+	}
+	return &emailsubmission.QueryChangesResponse{
+		Account:       req.Account,
+		OldQueryState: result.oldQueryState,
+		NewQueryState: result.newQueryState,
+		Removed:       result.removed,
+		Added:         result.added,
+	}, nil
+}
+
+// Submissions are sent at once: their undoStatus is final, and each recipient
+// is reported as delivered. Only their undoStatus can be updated, and only to
+// the same value, as a sent submission can't be canceled. The Email/set made
+// by onSuccessUpdateEmail and onSuccessDestroyEmail is an implicit response
+func (s *Server) submissionSet(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &emailsubmission.Set{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	hooks := setHooks[*emailsubmission.EmailSubmission]{
+		create: func(sub *emailsubmission.EmailSubmission) *jmap.SetError {
+			if s.identities.objects[sub.IdentityID] == nil {
+				return invalidProperties("identityId")
+			}
+			e, ok := s.emails.objects[sub.EmailID]
+			if !ok {
+				return invalidProperties("emailId")
+			}
+			if sub.Envelope == nil {
+				sub.Envelope = &emailsubmission.Envelope{
+					MailFrom: &emailsubmission.Address{Email: s.identities.objects[sub.IdentityID].Email},
+				}
+				for _, addrs := range [][]*mail.Address{e.To, e.CC, e.BCC} {
+					for _, addr := range addrs {
+						sub.Envelope.RcptTo = append(sub.Envelope.RcptTo, &emailsubmission.Address{Email: addr.Email})
+					}
+				}
+			}
+			if len(sub.Envelope.RcptTo) == 0 {
+				return &jmap.SetError{Type: string(mail.ErrNoRecipients)}
+			}
+			now := time.Now().UTC().Truncate(time.Second)
+			sub.ThreadID = e.ThreadID
+			sub.SendAt = &now
+			sub.UndoStatus = "final"
+			sub.DeliveryStatus = map[string]*emailsubmission.DeliveryStatus{}
+			for _, rcpt := range sub.Envelope.RcptTo {
+				sub.DeliveryStatus[rcpt.Email] = &emailsubmission.DeliveryStatus{
+					SMTPReply: "250 2.0.0 OK",
+					Delivered: "yes",
+					Displayed: "unknown",
+				}
+			}
+			return nil
+		},
+		update: func(old *emailsubmission.EmailSubmission, sub *emailsubmission.EmailSubmission, patch jmap.Patch) *jmap.SetError {
+			for path := range patch {
+				prop, _, _ := strings.Cut(path, "/")
+				if prop != "undoStatus" {
+					return invalidProperties(prop)
+				}
+			}
+			if sub.UndoStatus != old.UndoStatus {
+				return &jmap.SetError{Type: string(mail.ErrCannotUnsend)}
+			}
+			return nil
+		},
+	}
+	result, err := s.submissions.set(req.IfInState, req.Create, req.Update, req.Destroy, hooks, r.CreatedIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// The changes to make to the Emails of submissions which succeeded,
+	// which are referenced by the id of the submission or "#" and its
+	// creation id
+	succeeded := func(ref jmap.ID) (jmap.ID, bool) {
+		if cid, ok := strings.CutPrefix(string(ref), "#"); ok {
+			sub, ok := result.created[jmap.ID(cid)]
+			if !ok {
+				return "", false
+			}
+			return sub.EmailID, true
+		}
+		if _, ok := result.updated[ref]; !ok {
+			return "", false
+		}
+		return s.submissions.objects[ref].EmailID, true
+	}
+	emailSet := &email.Set{Account: req.Account}
+	refs := make([]jmap.ID, 0, len(req.OnSuccessUpdateEmail))
+	for ref := range req.OnSuccessUpdateEmail {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i] < refs[j] })
+	for _, ref := range refs {
+		if id, ok := succeeded(ref); ok {
+			if emailSet.Update == nil {
+				emailSet.Update = make(map[jmap.ID]jmap.Patch)
+			}
+			emailSet.Update[id] = req.OnSuccessUpdateEmail[ref]
+		}
+	}
+	for _, ref := range req.OnSuccessDestroyEmail {
+		if id, ok := succeeded(ref); ok {
+			emailSet.Destroy = append(emailSet.Destroy, id)
+		}
+	}
+	resp := &emailsubmission.SetResponse{
+		Account:      req.Account,
+		OldState:     result.oldState,
+		NewState:     result.newState,
+		Created:      result.created,
+		Updated:      result.updated,
+		Destroyed:    result.destroyed,
+		NotCreated:   result.notCreated,
+		NotUpdated:   result.notUpdated,
+		NotDestroyed: result.notDestroyed,
+	}
+	if emailSet.Update != nil || emailSet.Destroy != nil {
+		setResp, err := s.setEmails(r, emailSet)
+		if err != nil {
+			return nil, err
+		}
+		r.Respond("Email/set", setResp)
+	}
+	return resp, nil
+}
@@ -0,0 +1,61 @@
+package jmaptest
+
+import (
+	"encoding/json"
+
+	"git.sr.ht/~rockorager/go-jmap"
+	"git.sr.ht/~rockorager/go-jmap/mail/vacationresponse"
+)
+
+// The id of the VacationResponse, of which there is only one
+const vacationID jmap.ID = "singleton"
+
+func (s *Server) vacationGet(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &vacationresponse.Get{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	list, notFound, err := s.vacation.get(req.IDs, req.Properties)
+	if err != nil {
+		return nil, err
+	}
+	resp := &vacationresponse.GetResponse{
+		Account: req.Account,
+		State:   s.vacation.State(),
+		List:    list,
+	}
+	if len(notFound) > 0 {
+		resp.NotFound = notFound
+	}
+	return resp, nil
+}
+
+// The VacationResponse can only be updated
+func (s *Server) vacationSet(r *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+	req := &vacationresponse.Set{}
+	if err := decodeArgs(args, req, func() jmap.ID { return req.Account }); err != nil {
+		return nil, err
+	}
+	singleton := func(*vacationresponse.VacationResponse) *jmap.SetError {
+		return &jmap.SetError{Type: string(jmap.ErrSingleton)}
+	}
+	hooks := setHooks[*vacationresponse.VacationResponse]{
+		create:  singleton,
+		destroy: singleton,
+	}
+	result, err := s.vacation.set(req.IfInState, req.Create, req.Update, req.Destroy, hooks, r.CreatedIDs)
+	if err != nil {
+		return nil, err
+	}
+	return &vacationresponse.SetResponse{
+		Account:      req.Account,
+		OldState:     result.oldState,
+		NewState:     result.newState,
+		Created:      result.created,
+		Updated:      result.updated,
+		Destroyed:    result.destroyed,
+		NotCreated:   result.notCreated,
+		NotUpdated:   result.notUpdated,
+		NotDestroyed: result.notDestroyed,
+	}, nil
+}
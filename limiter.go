@@ -0,0 +1,68 @@
+package jmap
+
+import (
+	"context"
+	"sync"
+)
+
+// A limiter limits the number of operations in progress at once. The limit
+// may be changed while the limiter is in use. The zero value is a limiter with
+// no limit
+type limiter struct {
+	mu sync.Mutex
+	// The maximum number of operations in progress, or 0 for no limit
+	limit int
+	// The number of operations in progress
+	active int
+	// Closed (and replaced) whenever an operation finishes or the limit
+	// changes, to wake any waiting goroutines
+	wait chan struct{}
+}
+
+// acquire blocks until an operation may start, or until ctx is done. Each
+// successful call must be followed by a call to release
+func (l *limiter) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.limit <= 0 || l.active < l.limit {
+			l.active += 1
+			l.mu.Unlock()
+			return nil
+		}
+		if l.wait == nil {
+			l.wait = make(chan struct{})
+		}
+		wait := l.wait
+		l.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release marks an operation as finished
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active -= 1
+	l.wake()
+}
+
+// setLimit changes the limit. Operations already in progress are not
+// affected, even if there are now more than the limit
+func (l *limiter) setLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.wake()
+}
+
+func (l *limiter) wake() {
+	if l.wait != nil {
+		close(l.wait)
+		l.wait = nil
+	}
+}
@@ -0,0 +1,73 @@
+package jmap
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	assert := assert.New(t)
+	l := &limiter{}
+	l.setLimit(2)
+
+	ctx := context.Background()
+	assert.NoError(l.acquire(ctx))
+	assert.NoError(l.acquire(ctx))
+
+	// The limit has been reached
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(l.acquire(timeout), context.DeadlineExceeded)
+
+	// Releasing wakes a waiter
+	acquired := make(chan error)
+	go func() {
+		acquired <- l.acquire(ctx)
+	}()
+	l.release()
+	assert.NoError(<-acquired)
+
+	// Raising the limit wakes a waiter
+	go func() {
+		acquired <- l.acquire(ctx)
+	}()
+	l.setLimit(3)
+	assert.NoError(<-acquired)
+
+	// No limit
+	l.setLimit(0)
+	for i := 0; i < 10; i++ {
+		assert.NoError(l.acquire(ctx))
+	}
+}
+
+func TestClientConcurrentRequests(t *testing.T) {
+	assert := assert.New(t)
+	ts := newTestServer(t)
+	ts.session["capabilities"].(map[string]interface{})["urn:ietf:params:jmap:core"] = map[string]interface{}{
+		"maxConcurrentRequests": 1,
+	}
+	client := ts.client()
+	assert.NoError(client.Authenticate())
+
+	// Hold the only request slot: Do must wait for it
+	ctx := context.Background()
+	_, err := client.session(context.Background())
+	assert.NoError(err)
+	assert.NoError(client.requests.acquire(ctx))
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	req := &Request{Context: timeout}
+	req.Invoke(&testMethod{Hello: "world"})
+	_, err = client.Do(req)
+	assert.ErrorIs(err, context.DeadlineExceeded)
+
+	client.requests.release()
+	req.Context = ctx
+	_, err = client.Do(req)
+	assert.NoError(err)
+}
@@ -0,0 +1,32 @@
+package jmap
+
+import "encoding/json"
+
+// The URI of the core capability. Package core defines the Capability itself,
+// but it imports this package so the limits the client needs are decoded here
+// from the raw capability
+const coreURI URI = "urn:ietf:params:jmap:core"
+
+// The limits advertised by the server in the core capability. A zero value
+// means the server didn't advertise the limit
+type coreLimits struct {
+	MaxSizeUpload         uint64 `json:"maxSizeUpload"`
+	MaxConcurrentUpload   uint64 `json:"maxConcurrentUpload"`
+	MaxSizeRequest        uint64 `json:"maxSizeRequest"`
+	MaxConcurrentRequests uint64 `json:"maxConcurrentRequests"`
+	MaxCallsInRequest     uint64 `json:"maxCallsInRequest"`
+	MaxObjectsInGet       uint64 `json:"maxObjectsInGet"`
+	MaxObjectsInSet       uint64 `json:"maxObjectsInSet"`
+}
+
+// limits returns the limits of the core capability of the Session
+func (s *Session) limits() coreLimits {
+	l := coreLimits{}
+	raw, ok := s.RawCapabilities[coreURI]
+	if !ok {
+		return l
+	}
+	// An invalid capability is treated as having no limits
+	json.Unmarshal(raw, &l)
+	return l
+}
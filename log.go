@@ -0,0 +1,315 @@
+package jmap
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Redacted is logged in place of the values removed by a RedactRule
+const Redacted = "[REDACTED]"
+
+// A RedactRule returns the value to log in place of value, which is the value
+// of the property key in the arguments of a logged call or response. Values
+// are in their generic JSON representation: maps, slices, strings, bool,
+// json.Number and nil. The items of an array have the key of the array. A rule
+// returns value itself to keep it.
+//
+// Rules are applied to each value before its contents, so a rule which
+// redacts a whole object never sees the values inside it
+type RedactRule func(key string, value interface{}) interface{}
+
+// RedactProperties returns a rule which redacts the values of the properties
+// with the given names
+func RedactProperties(names ...string) RedactRule {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return func(key string, value interface{}) interface{} {
+		if set[key] {
+			return Redacted
+		}
+		return value
+	}
+}
+
+var bearerToken = regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9\-._~+/]+=*`)
+
+// RedactBearerTokens redacts bearer tokens ("Bearer <token>") in string values
+func RedactBearerTokens(key string, value interface{}) interface{} {
+	s, ok := value.(string)
+	if !ok {
+		return value
+	}
+	return bearerToken.ReplaceAllString(s, "Bearer "+Redacted)
+}
+
+var (
+	// RedactCredentials redacts passwords, tokens, the encryption keys
+	// and verification codes of push subscriptions, and other secrets
+	RedactCredentials = RedactProperties(
+		"password",
+		"accessToken",
+		"refreshToken",
+		"authorization",
+		"secret",
+		"keys",
+		"verificationCode",
+	)
+
+	// RedactBodies redacts the contents of messages: the body values and
+	// previews of emails, search snippets and signatures
+	RedactBodies = RedactProperties(
+		"bodyValues",
+		"preview",
+		"subject",
+		"textSignature",
+		"htmlSignature",
+	)
+
+	// RedactAddresses redacts email addresses: the address fields of
+	// emails, identities, submission envelopes and filters
+	RedactAddresses = RedactProperties(
+		"email",
+		"from",
+		"to",
+		"cc",
+		"bcc",
+		"replyTo",
+		"sender",
+		"mailFrom",
+		"rcptTo",
+	)
+)
+
+// DefaultRedactRules are the rules used if none are given
+var DefaultRedactRules = []RedactRule{
+	RedactBearerTokens,
+	RedactCredentials,
+	RedactBodies,
+	RedactAddresses,
+}
+
+// LogRequests returns a Middleware which logs requests to logger, with values
+// redacted by rules (DefaultRedactRules if there are none):
+//
+//   - each call, with its method, call ID and account at debug level, along
+//     with its arguments
+//   - each response, with its method, call ID, account, the latency of the
+//     request and its state strings (state, oldState, newState and the
+//     session state) at info level. Its arguments are added at debug level
+//   - method errors at warn level
+//   - requests which fail at error level
+//
+// Set the Logger of a Client to log its requests, rather than adding this
+// Middleware
+func LogRequests(logger *slog.Logger, rules ...RedactRule) Middleware {
+	if len(rules) == 0 {
+		rules = DefaultRedactRules
+	}
+	return func(next RoundTripFunc) RoundTripFunc {
+		return func(req *Request) (*Response, error) {
+			ctx := req.Context
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			debug := logger.Enabled(ctx, slog.LevelDebug)
+			if debug {
+				for _, call := range req.Calls {
+					args := redactArgs(call.Args, rules)
+					logger.LogAttrs(ctx, slog.LevelDebug, "jmap call",
+						slog.String("method", call.Name),
+						slog.String("callId", call.CallID),
+						slog.String("accountId", argString(args, "accountId")),
+						slog.Any("args", args),
+					)
+				}
+			}
+
+			start := time.Now()
+			resp, err := next(req)
+			latency := time.Since(start)
+			if err != nil {
+				logger.LogAttrs(ctx, slog.LevelError, "jmap request failed",
+					slog.Int("calls", len(req.Calls)),
+					slog.Duration("latency", latency),
+					slog.Any("error", redact("error", err.Error(), rules)),
+				)
+				return resp, err
+			}
+
+			info := logger.Enabled(ctx, slog.LevelInfo)
+			for _, inv := range resp.Responses {
+				if merr, ok := inv.Args.(*MethodError); ok {
+					attrs := []slog.Attr{
+						slog.String("callId", inv.CallID),
+						slog.Duration("latency", latency),
+						slog.String("type", merr.Type),
+					}
+					if merr.Description != nil {
+						attrs = append(attrs, slog.Any("description", redact("description", *merr.Description, rules)))
+					}
+					logger.LogAttrs(ctx, slog.LevelWarn, "jmap method error", attrs...)
+					continue
+				}
+				if !info {
+					continue
+				}
+				fields := responseFields(inv.Args)
+				attrs := []slog.Attr{
+					slog.String("method", inv.Name),
+					slog.String("callId", inv.CallID),
+					slog.Any("accountId", redact("accountId", fields["accountId"], rules)),
+					slog.Duration("latency", latency),
+				}
+				for _, key := range []string{"state", "oldState", "newState"} {
+					if state := fields[key]; state != "" {
+						attrs = append(attrs, slog.Any(key, redact(key, state, rules)))
+					}
+				}
+				attrs = append(attrs, slog.String("sessionState", resp.SessionState))
+				if debug {
+					attrs = append(attrs, slog.Any("args", redactArgs(inv.Args, rules)))
+				}
+				logger.LogAttrs(ctx, slog.LevelInfo, "jmap response", attrs...)
+			}
+			return resp, nil
+		}
+	}
+}
+
+// Log logs a message to the Logger of the Client, if it has one. The string
+// and error values of attrs are redacted by the RedactRules of the Client, as
+// if each were the value of a property named by its key
+func (c *Client) Log(ctx context.Context, level slog.Level, msg string, attrs ...slog.Attr) {
+	c.log(ctx, level, msg, attrs...)
+}
+
+// log logs a message to the Logger of the Client, if it has one, with its
+// RedactRules applied to attrs
+func (c *Client) log(ctx context.Context, level slog.Level, msg string, attrs ...slog.Attr) {
+	if c.Logger == nil || !c.Logger.Enabled(ctx, level) {
+		return
+	}
+	rules := c.RedactRules
+	if len(rules) == 0 {
+		rules = DefaultRedactRules
+	}
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, attr := range attrs {
+		redacted = append(redacted, redactAttr(attr, rules))
+	}
+	c.Logger.LogAttrs(ctx, level, msg, redacted...)
+}
+
+// redactAttr applies rules to the value of attr if it is a string or an error.
+// Other values are kept
+func redactAttr(attr slog.Attr, rules []RedactRule) slog.Attr {
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.Any(attr.Key, redact(attr.Key, value.String(), rules))
+	case slog.KindAny:
+		if err, ok := value.Any().(error); ok {
+			return slog.Any(attr.Key, redact(attr.Key, err.Error(), rules))
+		}
+	}
+	return attr
+}
+
+// redactArgs returns the generic JSON representation of the arguments of an
+// invocation with rules applied
+func redactArgs(args interface{}, rules []RedactRule) interface{} {
+	generic, err := toGeneric(args)
+	if err != nil {
+		return nil
+	}
+	return redact("", generic, rules)
+}
+
+// redact applies rules to v, the value of the property key, and then to its
+// contents. The maps and slices of v are modified
+func redact(key string, v interface{}, rules []RedactRule) interface{} {
+	for _, rule := range rules {
+		v = rule(key, v)
+	}
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, item := range val {
+			val[k] = redact(k, item, rules)
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = redact(key, item, rules)
+		}
+	}
+	return v
+}
+
+// argString returns the string value of the property key of generic
+// arguments, or the empty string
+func argString(args interface{}, key string) string {
+	obj, _ := args.(map[string]interface{})
+	s, _ := obj[key].(string)
+	return s
+}
+
+// responseFields returns the accountId and state strings of the arguments of a
+// response. They are read from the fields of a struct, or decoded from a
+// RawResponse, so the rest of the arguments aren't encoded again
+func responseFields(args interface{}) map[string]string {
+	fields := map[string]string{}
+	if raw, ok := args.(*RawResponse); ok {
+		strs := struct {
+			AccountID string `json:"accountId"`
+			State     string `json:"state"`
+			OldState  string `json:"oldState"`
+			NewState  string `json:"newState"`
+		}{}
+		// Arguments which aren't an object have none of the fields
+		raw.Decode(&strs)
+		fields["accountId"] = strs.AccountID
+		fields["state"] = strs.State
+		fields["oldState"] = strs.OldState
+		fields["newState"] = strs.NewState
+		return fields
+	}
+	v := reflect.ValueOf(args)
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return fields
+		}
+		v = v.Elem()
+	}
+	structFields(v, fields)
+	return fields
+}
+
+// structFields adds the string fields of v tagged accountId, state, oldState or
+// newState to fields, including those of embedded structs
+func structFields(v reflect.Value, fields map[string]string) {
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			structFields(reflect.Indirect(v.Field(i)), fields)
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		switch name {
+		case "accountId", "state", "oldState", "newState":
+		default:
+			continue
+		}
+		if f := v.Field(i); f.Kind() == reflect.String {
+			fields[name] = f.String()
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package jmap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedact(t *testing.T) {
+	assert := assert.New(t)
+	args, err := toGeneric(map[string]interface{}{
+		"accountId": "A1",
+		"create": map[string]interface{}{
+			"c1": map[string]interface{}{
+				"from":       []map[string]string{{"name": "Jane", "email": "jane@example.com"}},
+				"subject":    "Hello",
+				"bodyValues": map[string]interface{}{"1": map[string]string{"value": "secret"}},
+				"keywords":   map[string]bool{"$seen": true},
+			},
+		},
+		"header": "Authorization: Bearer abc.def=",
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	data, err := json.Marshal(redact("", args, DefaultRedactRules))
+	assert.NoError(err)
+	assert.JSONEq(`{
+		"accountId": "A1",
+		"create": {
+			"c1": {
+				"from": "[REDACTED]",
+				"subject": "[REDACTED]",
+				"bodyValues": "[REDACTED]",
+				"keywords": {"$seen": true}
+			}
+		},
+		"header": "Authorization: Bearer [REDACTED]"
+	}`, string(data))
+
+	// Only the given rules are applied
+	args, _ = toGeneric(map[string]interface{}{"from": "jane@example.com", "note": "x"})
+	data, _ = json.Marshal(redact("", args, []RedactRule{RedactProperties("note")}))
+	assert.JSONEq(`{"from": "jane@example.com", "note": "[REDACTED]"}`, string(data))
+}
+
+func TestClientLogger(t *testing.T) {
+	assert := assert.New(t)
+	ts := newTestServer(t)
+	client := ts.client()
+	buf := &bytes.Buffer{}
+	client.Logger = slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	client.RedactRules = []RedactRule{RedactProperties("Hello")}
+
+	req := &Request{}
+	req.Invoke(&testMethod{Hello: "world"})
+	_, err := client.Do(req)
+	if !assert.NoError(err) {
+		return
+	}
+
+	records := map[string]map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		record := map[string]interface{}{}
+		if assert.NoError(json.Unmarshal([]byte(line), &record)) {
+			records[record["msg"].(string)] = record
+		}
+	}
+	call := records["jmap call"]
+	if assert.NotNil(call) {
+		assert.Equal("Test/method", call["method"])
+		assert.Equal("0", call["callId"])
+		assert.Equal(map[string]interface{}{"Hello": Redacted}, call["args"])
+	}
+	resp := records["jmap response"]
+	if assert.NotNil(resp) {
+		assert.Equal("Test/method", resp["method"])
+		assert.Equal("0", resp["callId"])
+		assert.Equal("s1", resp["sessionState"])
+		assert.Contains(resp, "latency")
+		assert.Equal(map[string]interface{}{"Hello": Redacted}, resp["args"])
+	}
+	assert.NotContains(buf.String(), "world")
+
+	// Failed requests are logged as errors
+	buf.Reset()
+	ts.mu.Lock()
+	ts.failures = 1
+	ts.mu.Unlock()
+	_, err = client.Do(req)
+	assert.Error(err)
+	assert.Contains(buf.String(), `"level":"ERROR","msg":"jmap request failed"`)
+}
+
+func TestResponseFields(t *testing.T) {
+	assert := assert.New(t)
+	type embedded struct {
+		OldState string `json:"oldState"`
+	}
+	typed := &struct {
+		embedded
+		Account  ID     `json:"accountId"`
+		NewState string `json:"newState,omitempty"`
+		List     []ID   `json:"list"`
+	}{embedded{"s1"}, "A1", "s2", []ID{"1"}}
+	assert.Equal(map[string]string{"accountId": "A1", "oldState": "s1", "newState": "s2"}, responseFields(typed))
+
+	raw := &RawResponse{json.RawMessage(`{"accountId":"A1","state":"s1","list":[{"id":"1"}]}`)}
+	fields := responseFields(raw)
+	assert.Equal("A1", fields["accountId"])
+	assert.Equal("s1", fields["state"])
+	assert.Equal(map[string]string{}, responseFields(nil))
+}
+
+func TestClientLog(t *testing.T) {
+	assert := assert.New(t)
+	buf := &bytes.Buffer{}
+	client := &Client{
+		Logger:      slog.New(slog.NewTextHandler(buf, nil)),
+		RedactRules: []RedactRule{RedactBearerTokens, RedactProperties("url")},
+	}
+	client.Log(context.Background(), slog.LevelInfo, "test",
+		slog.String("url", "https://example.com/?token=secret"),
+		slog.Any("error", errors.New("Authorization: Bearer secret")),
+		slog.Int("status", 401),
+	)
+	assert.Contains(buf.String(), `url=[REDACTED] error="Authorization: Bearer [REDACTED]" status=401`)
+	assert.NotContains(buf.String(), "secret")
+}
@@ -31,6 +31,8 @@ func (m *Changes) Name() string { return "Email/changes" }
 
 func (m *Changes) Requires() []jmap.URI { return []jmap.URI{mail.URI} }
 
+func (m *Changes) StandardChanges() {}
+
 // This is a standard "/changes" method as described in [RFC8620], Section 5.2.
 // If generating intermediate states for a large set of changes, it is
 // recommended that newer changes be returned first, as these are generally of
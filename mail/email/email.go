@@ -359,3 +359,14 @@ type BodyValue struct {
 	// This is true if the value has been truncated
 	IsTruncated bool `json:"isTruncated"`
 }
+
+// DownloadOptions returns the options to download the blob of the part with
+// its name and type
+//
+//	dl, err := client.DownloadWithOptions(ctx, accountID, part.BlobID, part.DownloadOptions())
+func (p *BodyPart) DownloadOptions() *jmap.DownloadOptions {
+	return &jmap.DownloadOptions{
+		Name: p.Name,
+		Type: p.Type,
+	}
+}
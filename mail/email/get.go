@@ -74,6 +74,8 @@ func (m *Get) Name() string { return "Email/get" }
 
 func (m *Get) Requires() []jmap.URI { return []jmap.URI{mail.URI} }
 
+func (m *Get) StandardGet() {}
+
 // This is a standard “/get” method as described in [@!RFC8620], Section 5.1.
 type GetResponse struct {
 	// The id of the account used for the call.
@@ -107,3 +109,9 @@ type GetResponse struct {
 }
 
 func newGetResponse() jmap.MethodResponse { return &GetResponse{} }
+
+// ThreadIDs returns a reference to the ids of the Threads of the Emails
+// returned by an Email/get call (/list/*/threadId)
+func ThreadIDs(c jmap.GetCall[*Get]) *jmap.ResultReference {
+	return c.Ref("/list/*/threadId")
+}
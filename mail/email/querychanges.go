@@ -57,6 +57,8 @@ func (m *QueryChanges) Name() string { return "Email/queryChanges" }
 
 func (m *QueryChanges) Requires() []jmap.URI { return []jmap.URI{mail.URI} }
 
+func (m *QueryChanges) StandardQueryChanges() {}
+
 // This is a standard "/queryChanges" method as described in [RFC8620], Section
 // 5.6
 type QueryChangesResponse struct {
@@ -33,6 +33,8 @@ func (m *Get) Name() string { return "EmailSubmission/get" }
 
 func (m *Get) Requires() []jmap.URI { return []jmap.URI{URI, mail.URI} }
 
+func (m *Get) StandardGet() {}
+
 // This is a standard “/get” method as described in [@!RFC8620], Section 5.1.
 type GetResponse struct {
 	// The id of the account used for the call.
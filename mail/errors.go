@@ -0,0 +1,64 @@
+package mail
+
+import "git.sr.ht/~rockorager/go-jmap"
+
+// SetError types defined by RFC 8621, for use with errors.Is
+const (
+	// The Mailbox still has at least one child Mailbox. The client MUST
+	// remove these before it can delete the parent Mailbox (Mailbox/set).
+	ErrMailboxHasChild jmap.ErrorType = "mailboxHasChild"
+
+	// The Mailbox has at least one Email assigned to it, and the
+	// onDestroyRemoveEmails argument was false (Mailbox/set).
+	ErrMailboxHasEmail jmap.ErrorType = "mailboxHasEmail"
+
+	// At least one blob id referenced in the object doesn’t exist. The
+	// notFound property of the SetError lists them (Email/set and
+	// Email/import).
+	ErrBlobNotFound jmap.ErrorType = "blobNotFound"
+
+	// The change to the Email’s keywords would exceed a server-defined
+	// maximum (Email/set).
+	ErrTooManyKeywords jmap.ErrorType = "tooManyKeywords"
+
+	// The change to the set of Mailboxes that this Email is in would
+	// exceed a server-defined maximum (Email/set).
+	ErrTooManyMailboxes jmap.ErrorType = "tooManyMailboxes"
+
+	// The Email to be sent is invalid in some way, or the blob is not a
+	// valid message (EmailSubmission/set and Email/import).
+	ErrInvalidEmail jmap.ErrorType = "invalidEmail"
+
+	// The envelope (supplied or generated) has more recipients than the
+	// server allows. The maxRecipients property of the SetError is the
+	// maximum (EmailSubmission/set).
+	ErrTooManyRecipients jmap.ErrorType = "tooManyRecipients"
+
+	// The envelope (supplied or generated) does not have any rcptTo email
+	// addresses (EmailSubmission/set).
+	ErrNoRecipients jmap.ErrorType = "noRecipients"
+
+	// The rcptTo property of the envelope (supplied or generated) contains
+	// at least one rcptTo value which is not a valid email address for
+	// sending to. The invalidRecipients property of the SetError lists
+	// them (EmailSubmission/set).
+	ErrInvalidRecipients jmap.ErrorType = "invalidRecipients"
+
+	// The server does not permit the user to send a message with the
+	// envelope From address (EmailSubmission/set).
+	ErrForbiddenMailFrom jmap.ErrorType = "forbiddenMailFrom"
+
+	// The server does not permit the user to send a message with the From
+	// header field of the message to be sent (EmailSubmission/set and
+	// Identity/set).
+	ErrForbiddenFrom jmap.ErrorType = "forbiddenFrom"
+
+	// The user does not have permission to send at all right now
+	// (EmailSubmission/set).
+	ErrForbiddenToSend jmap.ErrorType = "forbiddenToSend"
+
+	// The client attempted to update the undoStatus of a valid
+	// EmailSubmission object from “pending” to “canceled”, but the message
+	// cannot be unsent (EmailSubmission/set).
+	ErrCannotUnsend jmap.ErrorType = "cannotUnsend"
+)
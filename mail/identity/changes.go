@@ -28,6 +28,8 @@ func (m *Changes) Name() string { return "Identity/changes" }
 
 func (m *Changes) Requires() []jmap.URI { return []jmap.URI{emailsubmission.URI} }
 
+func (m *Changes) StandardChanges() {}
+
 // An Identity/changes response
 type ChangesResponse struct {
 	// The id of the account used for the call.
@@ -35,6 +35,8 @@ func (m *Changes) Name() string { return "Mailbox/changes" }
 
 func (m *Changes) Requires() []jmap.URI { return []jmap.URI{mail.URI} }
 
+func (m *Changes) StandardChanges() {}
+
 // This is a standard “/changes” method as described in [@!RFC8620], Section
 // 5.2 but with one extra argument to the response: updatedProperties
 type ChangesResponse struct {
@@ -108,6 +108,8 @@ func (m *Query) Name() string { return "Mailbox/query" }
 
 func (m *Query) Requires() []jmap.URI { return []jmap.URI{mail.URI} }
 
+func (m *Query) StandardQuery() {}
+
 type QueryResponse struct {
 	// The id of the account used for the call.
 	Account jmap.ID `json:"accountId,omitempty"`
@@ -49,6 +49,8 @@ func (m *QueryChanges) Name() string { return "Mailbox/queryChanges" }
 
 func (m *QueryChanges) Requires() []jmap.URI { return []jmap.URI{mail.URI} }
 
+func (m *QueryChanges) StandardQueryChanges() {}
+
 type QueryChangesResponse struct {
 	// The id of the account used for the call.
 	Account jmap.ID `json:"accountId,omitempty"`
@@ -17,6 +17,10 @@ func init() {
 	jmap.RegisterMethod("MDN/parse", newParseResponse)
 }
 
+// The MDN has already been sent for the Email, ie the $mdnsent keyword is set
+// on it (MDN/send). For use with errors.Is
+const ErrMDNAlreadySent jmap.ErrorType = "mdnAlreadySent"
+
 // The MDN Capability
 type Capability struct{}
 
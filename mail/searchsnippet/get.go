@@ -22,7 +22,7 @@ type Get struct {
 	ReferenceIDs *jmap.ResultReference `json:"#emailIds,omitempty"`
 }
 
-func (m *Get) Name() string { return "Mailbox/get" }
+func (m *Get) Name() string { return "SearchSnippet/get" }
 
 func (m *Get) Requires() []jmap.URI { return []jmap.URI{mail.URI} }
 
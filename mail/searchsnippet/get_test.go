@@ -0,0 +1,25 @@
+package searchsnippet
+
+import (
+	"encoding/json"
+	"testing"
+
+	"git.sr.ht/~rockorager/go-jmap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGet(t *testing.T) {
+	m := &Get{
+		Account:  "account-id",
+		EmailIDs: []jmap.ID{"M1"},
+	}
+	req := &jmap.Request{}
+
+	id := req.Invoke(m)
+	assert.Equal(t, "0", id)
+
+	data, err := json.Marshal(req)
+	assert.NoError(t, err)
+	expected := `{"using":["urn:ietf:params:jmap:mail"],"methodCalls":[["SearchSnippet/get",{"accountId":"account-id","emailIds":["M1"]},"0"]]}`
+	assert.Equal(t, expected, string(data))
+}
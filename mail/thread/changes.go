@@ -28,6 +28,8 @@ func (m *Changes) Name() string { return "Thread/changes" }
 
 func (m *Changes) Requires() []jmap.URI { return []jmap.URI{mail.URI} }
 
+func (m *Changes) StandardChanges() {}
+
 // This is a standard “/changes” method as described in [@!RFC8620], Section 5.2.
 type ChangesResponse struct {
 	// The id of the account used for the call.
@@ -33,6 +33,8 @@ func (m *Get) Name() string { return "Thread/get" }
 
 func (m *Get) Requires() []jmap.URI { return []jmap.URI{mail.URI} }
 
+func (m *Get) StandardGet() {}
+
 // This is a standard “/get” method as described in [@!RFC8620], Section 5.1.
 type GetResponse struct {
 	// The id of the account used for the call.
@@ -66,3 +68,9 @@ type GetResponse struct {
 }
 
 func newGetResponse() jmap.MethodResponse { return &GetResponse{} }
+
+// EmailIDs returns a reference to the ids of the Emails in the Threads returned
+// by a Thread/get call (/list/*/emailIds)
+func EmailIDs(c jmap.GetCall[*Get]) *jmap.ResultReference {
+	return c.Ref("/list/*/emailIds")
+}
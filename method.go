@@ -1,5 +1,7 @@
 package jmap
 
+import "encoding/json"
+
 // A JMAP method. The method object will be marshaled as the arguments to an
 // invocation.
 type Method interface {
@@ -22,7 +24,38 @@ var methods = map[string]MethodResponseFactory{}
 // Register a method. The Name parameter will be used when unmarshalling
 // responses to call the responseConstructor, which should generate a pointer to
 // an empty Response object of that method. This object will be returned in the
-// result set (unless there is an error)
+// result set (unless there is an error). To register a method for a single
+// Client, use a Registry
 func RegisterMethod(name string, factory MethodResponseFactory) {
 	methods[name] = factory
 }
+
+// A MethodFallback returns a MethodResponseFactory for a method name which
+// hasn't been registered, or nil if it doesn't know the method
+type MethodFallback func(name string) MethodResponseFactory
+
+// Registered fallbacks, in the order they were registered
+var fallbacks []MethodFallback
+
+// Register a MethodFallback. When a response to a method which hasn't been
+// registered is unmarshaled, the fallbacks are called in the order they were
+// registered until one returns a factory. If none do, the arguments of the
+// response are unmarshaled into a RawResponse
+func RegisterMethodFallback(fallback MethodFallback) {
+	fallbacks = append(fallbacks, fallback)
+}
+
+// A RawResponse holds the raw JSON arguments of a response to a method which
+// hasn't been registered, for example a vendor extension whose package isn't
+// imported. The rest of the Response can still be used, and the arguments may
+// be decoded later with Decode
+type RawResponse struct {
+	json.RawMessage
+}
+
+// Decode unmarshals the arguments into v
+func (r *RawResponse) Decode(v interface{}) error {
+	return json.Unmarshal(r.RawMessage, v)
+}
+
+func newRawResponse() MethodResponse { return &RawResponse{} }
@@ -0,0 +1,37 @@
+package jmap
+
+// A RoundTripFunc performs a Request and returns its Response
+type RoundTripFunc func(*Request) (*Response, error)
+
+// A Middleware wraps the RoundTripFunc which performs a Request. It sees the
+// Request before it is marshaled and the Response after it is decoded, and may
+// change either, or return without calling next at all:
+//
+//	func logCalls(next jmap.RoundTripFunc) jmap.RoundTripFunc {
+//		return func(req *jmap.Request) (*jmap.Response, error) {
+//			start := time.Now()
+//			resp, err := next(req)
+//			log.Printf("%d calls in %s", len(req.Calls), time.Since(start))
+//			return resp, err
+//		}
+//	}
+type Middleware func(next RoundTripFunc) RoundTripFunc
+
+// Chain returns a RoundTripFunc which performs a Request by passing it through
+// each of the middleware in order, and finally to next. The first middleware
+// is the outermost: it sees the Request first and the Response last
+func Chain(next RoundTripFunc, middleware ...Middleware) RoundTripFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		next = middleware[i](next)
+	}
+	return next
+}
+
+// Use adds middleware to the chain Requests made with Do are passed through.
+// It returns the Client
+func (c *Client) Use(middleware ...Middleware) *Client {
+	c.Lock()
+	defer c.Unlock()
+	c.Middleware = append(c.Middleware, middleware...)
+	return c
+}
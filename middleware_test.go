@@ -0,0 +1,62 @@
+package jmap
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientMiddleware(t *testing.T) {
+	assert := assert.New(t)
+	ts := newTestServer(t)
+	client := ts.client()
+
+	order := []string{}
+	trace := func(name string) Middleware {
+		return func(next RoundTripFunc) RoundTripFunc {
+			return func(req *Request) (*Response, error) {
+				order = append(order, name+" request")
+				resp, err := next(req)
+				order = append(order, name+" response")
+				return resp, err
+			}
+		}
+	}
+	// Rewrites the arguments of the calls, and sees the decoded response
+	rewrite := func(next RoundTripFunc) RoundTripFunc {
+		return func(req *Request) (*Response, error) {
+			assert.NotNil(req.Context)
+			for _, call := range req.Calls {
+				call.Args.(*testMethod).Hello = "rewritten"
+			}
+			resp, err := next(req)
+			if err == nil {
+				resp.Responses[0].Args.(*test).Hello += " and read"
+			}
+			return resp, err
+		}
+	}
+	client.Use(trace("outer"), trace("inner")).Use(rewrite)
+
+	req := &Request{}
+	req.Invoke(&testMethod{Hello: "world"})
+	resp, err := client.Do(req)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("rewritten and read", resp.Responses[0].Args.(*test).Hello)
+	assert.Equal([]string{"outer request", "inner request", "inner response", "outer response"}, order)
+	assert.Equal([]int{1}, ts.requestCalls)
+
+	// A middleware can respond without making the request
+	denied := errors.New("denied")
+	client.Middleware = []Middleware{func(next RoundTripFunc) RoundTripFunc {
+		return func(req *Request) (*Response, error) {
+			return nil, denied
+		}
+	}}
+	_, err = client.Do(req)
+	assert.ErrorIs(err, denied)
+	assert.Equal([]int{1}, ts.requestCalls)
+}
@@ -0,0 +1,284 @@
+package jmap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// A TokenStore persists OAuth2 tokens, so the refresh token obtained when the
+// user authorized the client can be used again after the program restarts
+type TokenStore interface {
+	// Load returns the stored token, or nil if there is none
+	Load() (*oauth2.Token, error)
+
+	// Store replaces the stored token
+	Store(*oauth2.Token) error
+}
+
+// A MemoryTokenStore stores a token in memory. The zero value is ready to use
+type MemoryTokenStore struct {
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+func (m *MemoryTokenStore) Load() (*oauth2.Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.token, nil
+}
+
+func (m *MemoryTokenStore) Store(t *oauth2.Token) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.token = t
+	return nil
+}
+
+// A FileTokenStore stores a token as JSON in a file. The file is only readable
+// by the user, and is replaced atomically
+type FileTokenStore struct {
+	// The path of the file
+	Path string
+}
+
+func (f *FileTokenStore) Load() (*oauth2.Token, error) {
+	data, err := os.ReadFile(f.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := &oauth2.Token{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (f *FileTokenStore) Store(t *oauth2.Token) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.Path, data)
+}
+
+// writeFileAtomic writes data to a file only readable by the user, replacing
+// it atomically
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// A PKCEAuthorization is an OAuth2 authorization code flow with PKCE (RFC
+// 7636), as used by native and command line applications. Send the user to
+// URL, then exchange the code the authorization server redirects back with
+// for a token
+//
+//	auth := jmap.StartPKCE(cfg, state)
+//	// Open auth.URL in a browser, and receive the code at cfg.RedirectURL
+//	token, err := auth.Exchange(ctx, code)
+type PKCEAuthorization struct {
+	// The URL of the authorization page to send the user to
+	URL string
+
+	config   *oauth2.Config
+	verifier string
+}
+
+// StartPKCE starts an authorization code flow with PKCE. The state is
+// returned to the redirect URL along with the code, and should be checked
+// there to protect against CSRF
+func StartPKCE(cfg *oauth2.Config, state string, opts ...oauth2.AuthCodeOption) *PKCEAuthorization {
+	verifier := oauth2.GenerateVerifier()
+	opts = append(opts, oauth2.S256ChallengeOption(verifier))
+	return &PKCEAuthorization{
+		URL:      cfg.AuthCodeURL(state, opts...),
+		config:   cfg,
+		verifier: verifier,
+	}
+}
+
+// Exchange exchanges the authorization code for a token
+func (a *PKCEAuthorization) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
+	return a.config.Exchange(ctx, code, oauth2.VerifierOption(a.verifier))
+}
+
+// A DeviceAuthorization is an OAuth2 device authorization flow (RFC 8628), for
+// clients without a browser or which can't receive a redirect. Show the user
+// the VerificationURI and UserCode, then Wait for them to authorize the
+// client
+type DeviceAuthorization struct {
+	*oauth2.DeviceAuthResponse
+
+	config *oauth2.Config
+}
+
+// StartDeviceAuth starts a device authorization flow. The DeviceAuthURL of
+// the Endpoint of cfg must be set
+func StartDeviceAuth(ctx context.Context, cfg *oauth2.Config, opts ...oauth2.AuthCodeOption) (*DeviceAuthorization, error) {
+	resp, err := cfg.DeviceAuth(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceAuthorization{
+		DeviceAuthResponse: resp,
+		config:             cfg,
+	}, nil
+}
+
+// Wait polls the token endpoint until the user has authorized the client, the
+// authorization expires or ctx is done
+func (d *DeviceAuthorization) Wait(ctx context.Context) (*oauth2.Token, error) {
+	return d.config.DeviceAccessToken(ctx, d.DeviceAuthResponse)
+}
+
+// Set the HttpClient to a client which authenticates with OAuth2 tokens from
+// store, which must hold a token obtained with cfg (eg with StartPKCE or
+// StartDeviceAuth). Expired tokens are refreshed with their refresh token,
+// and each new token is saved to store. A request fails if its new token
+// can't be saved, as the old refresh token may no longer be valid.
+//
+// If the server rejects a token with a 401 status before it has expired (eg
+// it was revoked), the token is refreshed and the request retried once
+func (c *Client) WithOAuth2(cfg *oauth2.Config, store TokenStore) *Client {
+	c.HttpClient = &http.Client{
+		Transport: &oauth2Transport{
+			base:   http.DefaultTransport,
+			config: cfg,
+			store:  store,
+		},
+	}
+	return c
+}
+
+// oauth2Transport authenticates requests with the token from a TokenStore,
+// refreshing it as needed
+type oauth2Transport struct {
+	base   http.RoundTripper
+	config *oauth2.Config
+	store  TokenStore
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+func (t *oauth2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.currentToken(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.send(req, req.Body, token)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || token.RefreshToken == "" {
+		return resp, err
+	}
+	// The body can only be sent again if it can be replayed
+	body := req.Body
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return resp, nil
+		}
+		body, err = req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+	}
+	refreshed, err := t.refresh(req.Context(), token)
+	if err != nil {
+		// Keep the 401 response
+		if body != nil {
+			body.Close()
+		}
+		return resp, nil
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	resp.Body.Close()
+	return t.send(req, body, refreshed)
+}
+
+// send sends a copy of req with body, authenticated with token
+func (t *oauth2Transport) send(req *http.Request, body io.ReadCloser, token *oauth2.Token) (*http.Response, error) {
+	// A RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	req.Body = body
+	token.SetAuthHeader(req)
+	return t.base.RoundTrip(req)
+}
+
+// currentToken returns a valid token, loading it from the store and refreshing
+// it if needed
+func (t *oauth2Transport) currentToken(ctx context.Context) (*oauth2.Token, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token == nil {
+		token, err := t.store.Load()
+		if err != nil {
+			return nil, err
+		}
+		if token == nil {
+			return nil, errors.New("no OAuth2 token is stored")
+		}
+		t.token = token
+	}
+	if t.token.Valid() {
+		return t.token, nil
+	}
+	return t.refreshLocked(ctx, t.token)
+}
+
+// refresh replaces token, which the server rejected, with a new one. If
+// another request has already replaced it, that token is returned
+func (t *oauth2Transport) refresh(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != nil && t.token.AccessToken != token.AccessToken && t.token.Valid() {
+		return t.token, nil
+	}
+	expired := *token
+	expired.Expiry = time.Unix(1, 0)
+	return t.refreshLocked(ctx, &expired)
+}
+
+func (t *oauth2Transport) refreshLocked(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	if token.RefreshToken == "" {
+		return nil, errors.New("OAuth2 token expired and has no refresh token")
+	}
+	// The refresh request is made without the authentication of this
+	// transport
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: t.base})
+	refreshed, err := t.config.TokenSource(ctx, token).Token()
+	if err != nil {
+		return nil, err
+	}
+	t.token = refreshed
+	if err := t.store.Store(refreshed); err != nil {
+		return nil, err
+	}
+	return refreshed, nil
+}
@@ -0,0 +1,204 @@
+package jmap
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+// testAuthServer is an OAuth2 authorization server, and a JMAP session
+// endpoint which only accepts its current access token
+type testAuthServer struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	// The number of tokens issued, used for the access tokens
+	issued int
+	// The access token the session endpoint accepts
+	valid string
+	// The PKCE challenge of the authorization request
+	challenge string
+	// The number of device token polls
+	polls int
+	// The number of requests to the session endpoint
+	sessionRequests int
+}
+
+func newTestAuthServer(t *testing.T) *testAuthServer {
+	ts := &testAuthServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		switch r.Form.Get("grant_type") {
+		case "authorization_code":
+			sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+			if r.Form.Get("code") != "code1" || base64.RawURLEncoding.EncodeToString(sum[:]) != ts.challenge {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":"invalid_grant"}`)
+				return
+			}
+		case "refresh_token":
+			if r.Form.Get("refresh_token") != "refresh" {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":"invalid_grant"}`)
+				return
+			}
+		case "urn:ietf:params:oauth:grant-type:device_code":
+			ts.polls += 1
+			if ts.polls < 2 {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":"authorization_pending"}`)
+				return
+			}
+		}
+		ts.issued += 1
+		ts.valid = fmt.Sprintf("access%d", ts.issued)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  ts.valid,
+			"token_type":    "Bearer",
+			"refresh_token": "refresh",
+			"expires_in":    3600,
+		})
+	})
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"device_code":"device1","user_code":"ABCD","verification_uri":"https://example.com/device","interval":1,"expires_in":60}`)
+	})
+	mux.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request) {
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		ts.sessionRequests += 1
+		if r.Header.Get("Authorization") != "Bearer "+ts.valid {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"capabilities":{},"state":"s1"}`)
+	})
+	ts.Server = httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func (ts *testAuthServer) config() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:    "client",
+		RedirectURL: "http://localhost/callback",
+		Endpoint: oauth2.Endpoint{
+			AuthURL:       ts.URL + "/authorize",
+			TokenURL:      ts.URL + "/token",
+			DeviceAuthURL: ts.URL + "/device",
+			AuthStyle:     oauth2.AuthStyleInParams,
+		},
+	}
+}
+
+func TestStartPKCE(t *testing.T) {
+	assert := assert.New(t)
+	ts := newTestAuthServer(t)
+	cfg := ts.config()
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, ts.Client())
+
+	auth := StartPKCE(cfg, "state1")
+	u, err := url.Parse(auth.URL)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.True(strings.HasPrefix(auth.URL, ts.URL+"/authorize?"))
+	assert.Equal("state1", u.Query().Get("state"))
+	assert.Equal("S256", u.Query().Get("code_challenge_method"))
+	ts.challenge = u.Query().Get("code_challenge")
+
+	token, err := auth.Exchange(ctx, "code1")
+	if assert.NoError(err) {
+		assert.Equal("access1", token.AccessToken)
+		assert.Equal("refresh", token.RefreshToken)
+	}
+
+	// A different verifier is rejected
+	_, err = StartPKCE(cfg, "state2").Exchange(ctx, "code1")
+	assert.Error(err)
+}
+
+func TestStartDeviceAuth(t *testing.T) {
+	assert := assert.New(t)
+	ts := newTestAuthServer(t)
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, ts.Client())
+
+	auth, err := StartDeviceAuth(ctx, ts.config())
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("ABCD", auth.UserCode)
+	assert.Equal("https://example.com/device", auth.VerificationURI)
+
+	token, err := auth.Wait(ctx)
+	if assert.NoError(err) {
+		assert.Equal("access1", token.AccessToken)
+	}
+	assert.Equal(2, ts.polls)
+}
+
+func TestClientWithOAuth2(t *testing.T) {
+	assert := assert.New(t)
+	ts := newTestAuthServer(t)
+	store := &FileTokenStore{Path: filepath.Join(t.TempDir(), "token.json")}
+	// An expired token is refreshed before the first request
+	assert.NoError(store.Store(&oauth2.Token{
+		AccessToken:  "expired",
+		TokenType:    "Bearer",
+		RefreshToken: "refresh",
+		Expiry:       time.Now().Add(-time.Hour),
+	}))
+
+	client := &Client{SessionEndpoint: ts.URL + "/session"}
+	client.WithOAuth2(ts.config(), store)
+	assert.NoError(client.Authenticate())
+	token, err := store.Load()
+	if assert.NoError(err) {
+		assert.Equal("access1", token.AccessToken)
+		assert.True(token.Valid())
+	}
+	assert.Equal(1, ts.sessionRequests)
+
+	// A revoked token is refreshed, and the request retried once
+	ts.mu.Lock()
+	ts.valid = "revoked"
+	ts.mu.Unlock()
+	assert.NoError(client.Authenticate())
+	token, _ = store.Load()
+	assert.Equal("access2", token.AccessToken)
+	assert.Equal(3, ts.sessionRequests)
+
+	// A token which is rejected after refreshing isn't retried again
+	client = &Client{SessionEndpoint: ts.URL + "/session"}
+	client.WithOAuth2(ts.config(), &MemoryTokenStore{token: &oauth2.Token{
+		AccessToken: "revoked",
+		Expiry:      time.Now().Add(time.Hour),
+	}})
+	ts.sessionRequests = 0
+	assert.Error(client.Authenticate())
+	assert.Equal(1, ts.sessionRequests)
+
+	// Without a token
+	client.WithOAuth2(ts.config(), &MemoryTokenStore{})
+	assert.Error(client.Authenticate())
+}
@@ -0,0 +1,65 @@
+package jmap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// evalPointer evaluates a JSON Pointer (RFC 6901) against a JSON value decoded
+// into generic Go values (maps, slices and scalars). As described in RFC 8620
+// section 3.7, the pointer may also contain "*" to map through an array: the
+// rest of the pointer is applied to each item in the array, and if the results
+// are themselves arrays they are flattened into a single array.
+func evalPointer(v interface{}, path string) (interface{}, error) {
+	if path == "" {
+		return v, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("invalid pointer '%s': must start with '/'", path)
+	}
+	return evalTokens(v, strings.Split(path[1:], "/"))
+}
+
+func evalTokens(v interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return v, nil
+	}
+	token := unescapeToken(tokens[0])
+	switch val := v.(type) {
+	case map[string]interface{}:
+		next, ok := val[token]
+		if !ok {
+			return nil, fmt.Errorf("property '%s' not found", token)
+		}
+		return evalTokens(next, tokens[1:])
+	case []interface{}:
+		if token == "*" {
+			result := []interface{}{}
+			for _, item := range val {
+				res, err := evalTokens(item, tokens[1:])
+				if err != nil {
+					return nil, err
+				}
+				if arr, ok := res.([]interface{}); ok {
+					result = append(result, arr...)
+					continue
+				}
+				result = append(result, res)
+			}
+			return result, nil
+		}
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i >= len(val) {
+			return nil, fmt.Errorf("invalid array index '%s'", token)
+		}
+		return evalTokens(val[i], tokens[1:])
+	default:
+		return nil, fmt.Errorf("can't evaluate '%s' on a value which is not an object or array", token)
+	}
+}
+
+func unescapeToken(token string) string {
+	token = strings.ReplaceAll(token, "~1", "/")
+	return strings.ReplaceAll(token, "~0", "~")
+}
@@ -0,0 +1,42 @@
+package jmap
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvalPointer(t *testing.T) {
+	var doc interface{}
+	err := json.Unmarshal([]byte(`{
+		"ids": ["a", "b"],
+		"list": [
+			{"id": "t1", "emailIds": ["e1", "e2"]},
+			{"id": "t2", "emailIds": ["e3"]}
+		],
+		"a/b": {"m~n": 1}
+	}`), &doc)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		path     string
+		expected interface{}
+	}{
+		{"/ids", []interface{}{"a", "b"}},
+		{"/ids/1", "b"},
+		{"/list/*/id", []interface{}{"t1", "t2"}},
+		{"/list/*/emailIds", []interface{}{"e1", "e2", "e3"}},
+		{"/a~1b/m~0n", float64(1)},
+	}
+	for _, test := range tests {
+		res, err := evalPointer(doc, test.path)
+		assert.NoError(t, err, test.path)
+		assert.Equal(t, test.expected, res, test.path)
+	}
+
+	for _, path := range []string{"ids", "/nope", "/ids/2", "/ids/0/x"} {
+		_, err := evalPointer(doc, path)
+		assert.Error(t, err, path)
+	}
+}
@@ -0,0 +1,134 @@
+package jmap
+
+// A Call is a method call which has been added to a Request. It creates
+// ResultReferences to the response of the call, for use as arguments of later
+// calls in the same Request.
+//
+// The typed calls returned by InvokeGet, InvokeChanges, InvokeQuery and
+// InvokeQueryChanges only have references to paths which exist in the response
+// of that kind of method, so a wrong name or path is a compile error rather
+// than an invalidResultReference error from the server
+type Call struct {
+	// The CallID of the invocation
+	ID string
+
+	// The name of the method
+	Name string
+}
+
+// Ref returns a reference to path in the response to the call. Prefer the
+// methods of the typed calls where possible
+func (c Call) Ref(path string) *ResultReference {
+	return &ResultReference{
+		ResultOf: c.ID,
+		Name:     c.Name,
+		Path:     path,
+	}
+}
+
+// A GetMethod is a standard "/get" method as described in RFC 8620 section
+// 5.1
+type GetMethod interface {
+	Method
+
+	// StandardGet marks the method as a standard /get method. It does
+	// nothing
+	StandardGet()
+}
+
+// A ChangesMethod is a standard "/changes" method as described in RFC 8620
+// section 5.2
+type ChangesMethod interface {
+	Method
+
+	// StandardChanges marks the method as a standard /changes method. It
+	// does nothing
+	StandardChanges()
+}
+
+// A QueryMethod is a standard "/query" method as described in RFC 8620
+// section 5.5
+type QueryMethod interface {
+	Method
+
+	// StandardQuery marks the method as a standard /query method. It does
+	// nothing
+	StandardQuery()
+}
+
+// A QueryChangesMethod is a standard "/queryChanges" method as described in
+// RFC 8620 section 5.6
+type QueryChangesMethod interface {
+	Method
+
+	// StandardQueryChanges marks the method as a standard /queryChanges
+	// method. It does nothing
+	StandardQueryChanges()
+}
+
+// A GetCall is a /get method call in a Request
+type GetCall[M GetMethod] struct {
+	Call
+}
+
+// InvokeGet invokes a /get method on the Request, as with Request.Invoke
+func InvokeGet[M GetMethod](r *Request, m M) GetCall[M] {
+	return GetCall[M]{r.call(m)}
+}
+
+// IDs returns a reference to the ids of the returned objects (/list/*/id)
+func (c GetCall[M]) IDs() *ResultReference { return c.Ref("/list/*/id") }
+
+// A ChangesCall is a /changes method call in a Request
+type ChangesCall[M ChangesMethod] struct {
+	Call
+}
+
+// InvokeChanges invokes a /changes method on the Request, as with
+// Request.Invoke
+func InvokeChanges[M ChangesMethod](r *Request, m M) ChangesCall[M] {
+	return ChangesCall[M]{r.call(m)}
+}
+
+// Created returns a reference to the ids of the created objects (/created)
+func (c ChangesCall[M]) Created() *ResultReference { return c.Ref("/created") }
+
+// Updated returns a reference to the ids of the updated objects (/updated)
+func (c ChangesCall[M]) Updated() *ResultReference { return c.Ref("/updated") }
+
+// Destroyed returns a reference to the ids of the destroyed objects
+// (/destroyed)
+func (c ChangesCall[M]) Destroyed() *ResultReference { return c.Ref("/destroyed") }
+
+// A QueryCall is a /query method call in a Request
+type QueryCall[M QueryMethod] struct {
+	Call
+}
+
+// InvokeQuery invokes a /query method on the Request, as with Request.Invoke
+func InvokeQuery[M QueryMethod](r *Request, m M) QueryCall[M] {
+	return QueryCall[M]{r.call(m)}
+}
+
+// IDs returns a reference to the ids of the objects in the query results
+// (/ids)
+func (c QueryCall[M]) IDs() *ResultReference { return c.Ref("/ids") }
+
+// A QueryChangesCall is a /queryChanges method call in a Request
+type QueryChangesCall[M QueryChangesMethod] struct {
+	Call
+}
+
+// InvokeQueryChanges invokes a /queryChanges method on the Request, as with
+// Request.Invoke
+func InvokeQueryChanges[M QueryChangesMethod](r *Request, m M) QueryChangesCall[M] {
+	return QueryChangesCall[M]{r.call(m)}
+}
+
+// Removed returns a reference to the ids of the objects removed from the
+// query results (/removed)
+func (c QueryChangesCall[M]) Removed() *ResultReference { return c.Ref("/removed") }
+
+// Added returns a reference to the ids of the objects added to the query
+// results (/added/*/id)
+func (c QueryChangesCall[M]) Added() *ResultReference { return c.Ref("/added/*/id") }
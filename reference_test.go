@@ -0,0 +1,52 @@
+package jmap
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testStandardMethod struct {
+	name string
+}
+
+func (m *testStandardMethod) Name() string          { return m.name }
+func (m *testStandardMethod) Requires() []URI       { return []URI{"test:jmap:capability"} }
+func (m *testStandardMethod) StandardGet()          {}
+func (m *testStandardMethod) StandardChanges()      {}
+func (m *testStandardMethod) StandardQuery()        {}
+func (m *testStandardMethod) StandardQueryChanges() {}
+
+func TestInvokeReferences(t *testing.T) {
+	assert := assert.New(t)
+	req := &Request{}
+	req.Invoke(&testStandardMethod{name: "Test/echo"})
+	get := InvokeGet(req, &testStandardMethod{name: "Test/get"})
+	changes := InvokeChanges(req, &testStandardMethod{name: "Test/changes"})
+	query := InvokeQuery(req, &testStandardMethod{name: "Test/query"})
+	queryChanges := InvokeQueryChanges(req, &testStandardMethod{name: "Test/queryChanges"})
+
+	assert.Equal(5, len(req.Calls))
+	assert.Equal([]URI{"test:jmap:capability"}, req.Using)
+	assert.Equal(Call{ID: "1", Name: "Test/get"}, get.Call)
+
+	tests := []struct {
+		ref      *ResultReference
+		expected string
+	}{
+		{get.IDs(), `{"resultOf":"1","name":"Test/get","path":"/list/*/id"}`},
+		{changes.Created(), `{"resultOf":"2","name":"Test/changes","path":"/created"}`},
+		{changes.Updated(), `{"resultOf":"2","name":"Test/changes","path":"/updated"}`},
+		{changes.Destroyed(), `{"resultOf":"2","name":"Test/changes","path":"/destroyed"}`},
+		{query.IDs(), `{"resultOf":"3","name":"Test/query","path":"/ids"}`},
+		{queryChanges.Removed(), `{"resultOf":"4","name":"Test/queryChanges","path":"/removed"}`},
+		{queryChanges.Added(), `{"resultOf":"4","name":"Test/queryChanges","path":"/added/*/id"}`},
+		{get.Ref("/list/*/parentId"), `{"resultOf":"1","name":"Test/get","path":"/list/*/parentId"}`},
+	}
+	for _, test := range tests {
+		data, err := json.Marshal(test.ref)
+		assert.NoError(err)
+		assert.Equal(test.expected, string(data))
+	}
+}
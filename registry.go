@@ -0,0 +1,148 @@
+package jmap
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// A Registry holds methods and capabilities used to decode responses and
+// Session objects, in addition to the ones registered globally with
+// RegisterMethod, RegisterMethodFallback and RegisterCapability. Methods and
+// capabilities in a Registry take precedence over the global ones, so it may
+// be used to change how a method is decoded, or to register private methods,
+// without affecting the rest of the program. A nil Registry uses only the
+// global registrations.
+//
+// A Registry is set on a Client with its Registry field. It is safe for
+// concurrent use
+type Registry struct {
+	mu           sync.RWMutex
+	methods      map[string]MethodResponseFactory
+	fallbacks    []MethodFallback
+	capabilities map[URI]Capability
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		methods:      make(map[string]MethodResponseFactory),
+		capabilities: make(map[URI]Capability),
+	}
+}
+
+// Register a method in the Registry. See RegisterMethod
+func (r *Registry) RegisterMethod(name string, factory MethodResponseFactory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.methods[name] = factory
+}
+
+// Register a MethodFallback in the Registry. See RegisterMethodFallback. The
+// fallbacks of the Registry are called before the global ones, but only for
+// methods which are registered neither in the Registry nor globally
+func (r *Registry) RegisterMethodFallback(fallback MethodFallback) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallbacks = append(r.fallbacks, fallback)
+}
+
+// Register a Capability in the Registry. See RegisterCapability
+func (r *Registry) RegisterCapability(c Capability) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.capabilities[c.URI()] = c
+}
+
+// UnmarshalSession decodes a Session object from JSON, using the capabilities
+// of the Registry for the Session and its Accounts
+func (r *Registry) UnmarshalSession(data []byte, s *Session) error {
+	return s.unmarshal(data, r)
+}
+
+// lookupMethod returns the factory for a method name from the Registry or
+// the global methods, then from the fallbacks of the Registry or the global
+// fallbacks. If no factory is found the method is decoded as a RawResponse
+func lookupMethod(r *Registry, name string) MethodResponseFactory {
+	var local []MethodFallback
+	if r != nil {
+		r.mu.RLock()
+		factory, ok := r.methods[name]
+		local = r.fallbacks
+		r.mu.RUnlock()
+		if ok {
+			return factory
+		}
+	}
+	if factory, ok := methods[name]; ok {
+		return factory
+	}
+	for _, fallback := range append(local[:len(local):len(local)], fallbacks...) {
+		if factory := fallback(name); factory != nil {
+			return factory
+		}
+	}
+	return newRawResponse
+}
+
+// lookupCapability returns the registered Capability for a URI from the
+// Registry or the global capabilities
+func lookupCapability(r *Registry, uri URI) (Capability, bool) {
+	if r != nil {
+		r.mu.RLock()
+		c, ok := r.capabilities[uri]
+		r.mu.RUnlock()
+		if ok {
+			return c, true
+		}
+	}
+	c, ok := capabilities[uri]
+	return c, ok
+}
+
+// decodeCapabilities decodes the raw capabilities which are registered in the
+// Registry or globally. Unknown capabilities are only kept in their raw form
+func decodeCapabilities(r *Registry, raw map[URI]json.RawMessage) (map[URI]Capability, error) {
+	caps := make(map[URI]Capability)
+	for key, rawCap := range raw {
+		cap, ok := lookupCapability(r, key)
+		if !ok {
+			continue
+		}
+		newCap := cap.New()
+		if err := json.Unmarshal(rawCap, newCap); err != nil {
+			return nil, err
+		}
+		caps[key] = newCap
+	}
+	return caps, nil
+}
+
+// encodeCapabilities returns the raw capabilities, with any capabilities which
+// are only in caps added
+func encodeCapabilities(caps map[URI]Capability, raw map[URI]json.RawMessage) (map[URI]json.RawMessage, error) {
+	missing := false
+	for key := range caps {
+		if _, ok := raw[key]; !ok {
+			missing = true
+			break
+		}
+	}
+	if !missing {
+		return raw, nil
+	}
+	result := make(map[URI]json.RawMessage, len(caps))
+	for key, rawCap := range raw {
+		result[key] = rawCap
+	}
+	for key, cap := range caps {
+		if _, ok := result[key]; ok {
+			continue
+		}
+		data, err := json.Marshal(cap)
+		if err != nil {
+			return nil, err
+		}
+		result[key] = data
+	}
+	return result, nil
+}
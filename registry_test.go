@@ -0,0 +1,113 @@
+package jmap
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testOverride struct {
+	Hello string
+}
+
+type testFoobarCapability struct {
+	MaxFoosFinangled int `json:"maxFoosFinangled"`
+}
+
+func (c *testFoobarCapability) URI() URI { return "https://example.com/apis/foobar" }
+
+func (c *testFoobarCapability) New() Capability { return &testFoobarCapability{} }
+
+type testMailCapability struct {
+	MaxMailboxDepth int `json:"maxMailboxDepth"`
+}
+
+func (c *testMailCapability) URI() URI { return "urn:ietf:params:jmap:mail" }
+
+func (c *testMailCapability) New() Capability { return &testMailCapability{} }
+
+func TestRegistryUnmarshalResponse(t *testing.T) {
+	RegisterMethod("Test/method", newTest)
+	assert := assert.New(t)
+	reg := NewRegistry()
+	reg.RegisterMethod("Test/override", func() MethodResponse { return &testOverride{} })
+	reg.RegisterMethodFallback(func(name string) MethodResponseFactory {
+		if strings.HasPrefix(name, "Private/") {
+			return func() MethodResponse { return &testOverride{} }
+		}
+		return nil
+	})
+
+	data := []byte(`{
+		"methodResponses": [
+			["Test/method",{"Hello":"0"},"0"],
+			["Test/override",{"Hello":"1"},"1"],
+			["Private/method",{"Hello":"2"},"2"],
+			["Unknown/method",{"Hello":"3"},"3"]
+		],
+		"sessionState": "state"
+	}`)
+	resp := &Response{}
+	err := reg.UnmarshalResponse(data, resp)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("state", resp.SessionState)
+	assert.Equal(4, len(resp.Responses))
+	assert.IsType(&test{}, resp.Responses[0].Args)
+	assert.Equal(&testOverride{Hello: "1"}, resp.Responses[1].Args)
+	assert.Equal(&testOverride{Hello: "2"}, resp.Responses[2].Args)
+	assert.IsType(&RawResponse{}, resp.Responses[3].Args)
+
+	// The registry overrides the global method
+	reg.RegisterMethod("Test/method", func() MethodResponse { return &testOverride{} })
+	resp = &Response{}
+	assert.NoError(reg.UnmarshalResponse(data, resp))
+	assert.Equal(&testOverride{Hello: "0"}, resp.Responses[0].Args)
+
+	// A nil registry only uses the global methods
+	resp = &Response{}
+	assert.NoError((*Registry)(nil).UnmarshalResponse(data, resp))
+	assert.IsType(&test{}, resp.Responses[0].Args)
+	assert.IsType(&RawResponse{}, resp.Responses[1].Args)
+}
+
+func TestRegistryUnmarshalSession(t *testing.T) {
+	RegisterCapability(&testCapability{})
+	assert := assert.New(t)
+	reg := NewRegistry()
+	reg.RegisterCapability(&testFoobarCapability{})
+	reg.RegisterCapability(&testMailCapability{})
+
+	s := &Session{}
+	err := reg.UnmarshalSession([]byte(sessionBlob), s)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(&testCapability{TestValue: 500}, s.Capabilities["test:jmap:capability"])
+	assert.Equal(&testFoobarCapability{MaxFoosFinangled: 42}, s.Capabilities["https://example.com/apis/foobar"])
+	assert.Equal("john@example.com", s.Accounts["A13824"].Name)
+	assert.Equal(&testMailCapability{MaxMailboxDepth: 10}, s.Accounts["A13824"].Capabilities["urn:ietf:params:jmap:mail"])
+
+	// The global registrations are unchanged
+	s = &Session{}
+	assert.NoError(s.UnmarshalJSON([]byte(sessionBlob)))
+	assert.NotContains(s.Capabilities, URI("https://example.com/apis/foobar"))
+}
+
+func TestClientRegistry(t *testing.T) {
+	assert := assert.New(t)
+	ts := newTestServer(t)
+	client := ts.client()
+	client.Registry = NewRegistry()
+	client.Registry.RegisterMethod("Test/method", func() MethodResponse { return &testOverride{} })
+
+	req := &Request{}
+	req.Invoke(&testMethod{Hello: "world"})
+	resp, err := client.Do(req)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(&testOverride{Hello: "world"}, resp.Responses[0].Args)
+}
@@ -26,6 +26,11 @@ type Request struct {
 // CallID of the Method is returned. CallIDs are assigned as the hex
 // representation of the index of the call, eg "0"
 func (r *Request) Invoke(m Method) string {
+	return r.call(m).ID
+}
+
+// call adds the Method to the Request and returns the Call
+func (r *Request) call(m Method) Call {
 	i := &Invocation{
 		Name:   m.Name(),
 		Args:   m,
@@ -34,7 +39,7 @@ func (r *Request) Invoke(m Method) string {
 	r.Calls = append(r.Calls, i)
 
 	r.Using = mergeURIs(r.Using, m.Requires())
-	return i.CallID
+	return Call{ID: i.CallID, Name: i.Name}
 }
 
 func mergeURIs(target []URI, opts []URI) []URI {
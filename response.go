@@ -1,5 +1,12 @@
 package jmap
 
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
 type Response struct {
 	// An array of responses, in the same format as the Calls on the
 	// Request object. The output of the methods will be added to the
@@ -15,3 +22,154 @@ type Response struct {
 	// has changed and needs to be refetched.
 	SessionState string `json:"sessionState"`
 }
+
+// Invocations returns the responses to the call with the given call ID, in
+// the order they were returned. Most calls have a single response, but some
+// methods add responses for implicit calls with the same call ID (eg
+// Email/copy with onSuccessDestroyOriginal also responds with an Email/set).
+// If the call failed, the response is a MethodError
+func (r *Response) Invocations(callID string) []*Invocation {
+	invs := []*Invocation{}
+	for _, inv := range r.Responses {
+		if inv.CallID == callID {
+			invs = append(invs, inv)
+		}
+	}
+	return invs
+}
+
+// Result returns the response of type T to the call with the given call ID,
+// as returned by Request.Invoke. If the call failed, the MethodError is
+// returned as a *CallError
+//
+//	callID := req.Invoke(&mailbox.Get{Account: id})
+//	resp, err := client.Do(req)
+//	...
+//	get, err := jmap.Result[*mailbox.GetResponse](resp, callID)
+func Result[T MethodResponse](r *Response, callID string) (T, error) {
+	var zero T
+	for _, inv := range r.Invocations(callID) {
+		switch args := inv.Args.(type) {
+		case T:
+			return args, nil
+		case *MethodError:
+			return zero, &CallError{
+				CallID: callID,
+				Err:    args,
+			}
+		}
+	}
+	return zero, fmt.Errorf("no response of type %T to call '%s'", zero, callID)
+}
+
+// Err returns an error combining the MethodError of every call which failed,
+// or nil if all calls succeeded. The returned error is a *ResponseError
+func (r *Response) Err() error {
+	return r.err(false)
+}
+
+// ErrWithSetErrors is like Err, but also includes every SetError in the
+// responses: the objects which could not be created, updated, destroyed,
+// copied, etc
+func (r *Response) ErrWithSetErrors() error {
+	return r.err(true)
+}
+
+func (r *Response) err(setErrors bool) error {
+	errs := []*CallError{}
+	for _, inv := range r.Responses {
+		if methodErr, ok := inv.Args.(*MethodError); ok {
+			errs = append(errs, &CallError{
+				CallID: inv.CallID,
+				Err:    methodErr,
+			})
+			continue
+		}
+		if setErrors {
+			errs = append(errs, findSetErrors(inv)...)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ResponseError{Errors: errs}
+}
+
+// findSetErrors returns the SetErrors of every map[ID]*SetError field of the
+// response
+func findSetErrors(inv *Invocation) []*CallError {
+	v := reflect.ValueOf(inv.Args)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	v = v.Elem()
+	errType := reflect.TypeOf(map[ID]*SetError{})
+	errs := []*CallError{}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Type() != errType {
+			continue
+		}
+		prop, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		setErrs := field.Interface().(map[ID]*SetError)
+		ids := make([]string, 0, len(setErrs))
+		for id := range setErrs {
+			ids = append(ids, string(id))
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			errs = append(errs, &CallError{
+				CallID:   inv.CallID,
+				Property: prop,
+				ID:       ID(id),
+				Err:      setErrs[ID(id)],
+			})
+		}
+	}
+	return errs
+}
+
+// A CallError is an error returned in response to a single call of a request
+type CallError struct {
+	// The call ID of the call
+	CallID string
+
+	// For SetErrors, the argument of the response the SetError was found
+	// in (eg "notCreated") and the id (or creation id) of the object
+	Property string
+	ID       ID
+
+	// The error, a *MethodError or *SetError
+	Err error
+}
+
+func (e *CallError) Error() string {
+	if e.Property != "" {
+		return fmt.Sprintf("call %s: %s %s: %v", e.CallID, e.Property, e.ID, e.Err)
+	}
+	return fmt.Sprintf("call %s: %v", e.CallID, e.Err)
+}
+
+func (e *CallError) Unwrap() error { return e.Err }
+
+// A ResponseError combines the errors of the calls of a request which failed.
+// errors.Is and errors.As match any of the errors
+type ResponseError struct {
+	Errors []*CallError
+}
+
+func (e *ResponseError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *ResponseError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err)
+	}
+	return errs
+}
@@ -1,7 +1,10 @@
 package jmap
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -27,6 +30,79 @@ func TestResponseUnmarshal(t *testing.T) {
 	assert.Equal("world", echo.Hello)
 }
 
+func TestResponseDecode(t *testing.T) {
+	RegisterMethod("Test/method", newTest)
+	assert := assert.New(t)
+	data := `{
+		"@type": "Response",
+		"methodResponses": [
+			["Test/method",{"Hello":"world","Extra":[1,{"a":null}]},"0"],
+			["error",{"type":"unknownMethod"},"1"]
+		],
+		"createdIds": {"k1": "id1"},
+		"sessionState": "state"
+	}`
+	resp := &Response{}
+	err := (*Registry)(nil).DecodeResponse(strings.NewReader(data), resp)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("state", resp.SessionState)
+	assert.Equal(map[ID]ID{"k1": "id1"}, resp.CreatedIDs)
+	assert.Equal(2, len(resp.Responses))
+	assert.Equal(&test{Hello: "world"}, resp.Responses[0].Args)
+	assert.Equal("1", resp.Responses[1].CallID)
+	assert.Equal("unknownMethod", resp.Responses[1].Args.(*MethodError).Type)
+
+	invalid := []string{
+		`[]`,
+		`{"methodResponses": {}}`,
+		`{"methodResponses": [["Test/method",{}]]}`,
+		`{"methodResponses": [["Test/method",{},"0","1"]]}`,
+		`{"methodResponses": [["Test/method",{},"0"]]`,
+	}
+	for _, data := range invalid {
+		err := json.Unmarshal([]byte(data), &Response{})
+		assert.Errorf(err, "expected an error decoding %s", data)
+	}
+}
+
+func TestDecodeArgs(t *testing.T) {
+	assert := assert.New(t)
+	type args struct {
+		State    string             `json:"state"`
+		List     []*testObject      `json:"list"`
+		NotFound []ID               `json:"notFound,omitempty"`
+		Raw      json.RawMessage    `json:"raw"`
+		Created  map[ID]*testObject `json:"created"`
+		Ignored  string             `json:"-"`
+		Name     string
+	}
+	data := `{
+		"state": "s1",
+		"list": [{"id": "1", "name": "one"}, {"id": "2"}],
+		"notFound": null,
+		"raw": [1, 2],
+		"created": {"k1": {"id": "3"}},
+		"unknown": {"list": []},
+		"-": "value",
+		"name": "folded"
+	}`
+	expected := &args{}
+	assert.NoError(json.Unmarshal([]byte(data), expected))
+
+	actual := &args{NotFound: []ID{"x"}}
+	err := decodeArgs(json.NewDecoder(strings.NewReader(data)), actual)
+	assert.NoError(err)
+	assert.Equal(expected, actual)
+	assert.Equal("folded", actual.Name)
+	assert.Equal(2, len(actual.List))
+	assert.Nil(actual.NotFound)
+
+	err = decodeArgs(json.NewDecoder(strings.NewReader(`{"list": {}}`)), &args{})
+	assert.Error(err)
+}
+
 func TestResponseMarshal(t *testing.T) {
 	assert := assert.New(t)
 	resp := &Response{
@@ -48,3 +124,128 @@ func TestResponseMarshal(t *testing.T) {
 	expected := `{"methodResponses":[["Test/method",{"Hello":"world"},"0"]],"sessionState":"state"}`
 	assert.Equal(expected, string(data))
 }
+
+func TestResponseResult(t *testing.T) {
+	RegisterMethod("Test/method", newTest)
+	assert := assert.New(t)
+	data := []byte(`{"sessionState": "state","methodResponses":[
+		["Test/method",{"Hello":"world"},"0"],
+		["error",{"type":"stateMismatch"},"1"]
+	]}`)
+	resp := &Response{}
+	assert.NoError(json.Unmarshal(data, resp))
+
+	res, err := Result[*test](resp, "0")
+	assert.NoError(err)
+	assert.Equal("world", res.Hello)
+
+	_, err = Result[*test](resp, "1")
+	assert.ErrorIs(err, ErrStateMismatch)
+	callErr := &CallError{}
+	if assert.ErrorAs(err, &callErr) {
+		assert.Equal("1", callErr.CallID)
+	}
+
+	_, err = Result[*testSetResponse](resp, "0")
+	assert.Error(err)
+	_, err = Result[*test](resp, "2")
+	assert.Error(err)
+}
+
+func TestResponseErr(t *testing.T) {
+	assert := assert.New(t)
+	resp := &Response{
+		Responses: []*Invocation{
+			{
+				Name:   "Test/method",
+				Args:   &test{},
+				CallID: "0",
+			},
+			{
+				Name: "Test/set",
+				Args: &testChunkSetResponse{
+					NotDestroyed: map[ID]*SetError{
+						"M1": {Type: "notFound"},
+					},
+				},
+				CallID: "1",
+			},
+		},
+	}
+	assert.NoError(resp.Err())
+
+	err := resp.ErrWithSetErrors()
+	assert.ErrorIs(err, ErrNotFound)
+	assert.Equal("call 1: notDestroyed M1: notFound", err.Error())
+
+	resp.Responses = append(resp.Responses, &Invocation{
+		Name:   "error",
+		Args:   &MethodError{Type: "serverFail"},
+		CallID: "2",
+	})
+	err = resp.Err()
+	assert.ErrorIs(err, ErrServerFail)
+	assert.NotErrorIs(err, ErrNotFound)
+	assert.Equal("call 2: serverFail", err.Error())
+}
+
+type benchObject struct {
+	ID      ID     `json:"id"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+type benchGetResponse struct {
+	State string         `json:"state"`
+	List  []*benchObject `json:"list"`
+}
+
+// benchResponse returns a response to a /get call of 500 objects, each with a
+// 20KB body
+func benchResponse() []byte {
+	get := &benchGetResponse{State: "state"}
+	body := strings.Repeat("Lorem ipsum dolor sit amet. ", 20*1024/28)
+	for i := 0; i < 500; i += 1 {
+		get.List = append(get.List, &benchObject{
+			ID:      ID(fmt.Sprintf("M%d", i)),
+			Subject: fmt.Sprintf("Message %d", i),
+			Body:    body,
+		})
+	}
+	data, err := json.Marshal(&Response{
+		Responses:    []*Invocation{{Name: "Bench/get", Args: get, CallID: "0"}},
+		SessionState: "state",
+	})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func BenchmarkResponseDecode(b *testing.B) {
+	RegisterMethod("Bench/get", func() MethodResponse { return &benchGetResponse{} })
+	data := benchResponse()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += 1 {
+		resp := &Response{}
+		if err := (*Registry)(nil).DecodeResponse(bytes.NewReader(data), resp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkResponseUnmarshal(b *testing.B) {
+	RegisterMethod("Bench/get", func() MethodResponse { return &benchGetResponse{} })
+	data := benchResponse()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += 1 {
+		resp := &Response{}
+		if err := json.Unmarshal(data, resp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package jmap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A RetryPolicy controls how requests which fail with a transient error are
+// retried. A request is retried if the HTTP request fails without a response
+// (eg the connection was reset), or the server responds with one of the
+// statuses 429 (Too Many Requests), 502 (Bad Gateway), 503 (Service
+// Unavailable) or 504 (Gateway Timeout).
+//
+// Retries are spaced with exponential backoff and full jitter: the delay before
+// the n-th retry is a random duration between zero and BaseDelay * 2^(n-1),
+// capped at MaxDelay. If a 429 or 503 response includes a Retry-After header,
+// its value is used as the delay instead.
+type RetryPolicy struct {
+	// The maximum number of attempts at a request, including the first.
+	// Values less than 2 disable retries
+	MaxAttempts int
+
+	// The delay before the first retry, before jitter is applied. Defaults
+	// to 100ms
+	BaseDelay time.Duration
+
+	// The maximum delay between attempts, before jitter is applied.
+	// Defaults to 10s
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy retries a request up to 3 times
+var DefaultRetryPolicy = &RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+}
+
+// delay returns the delay before the given retry (starting at 1)
+func (p *RetryPolicy) delay(retry int) time.Duration {
+	base := p.BaseDelay
+	if base <= 0 {
+		base = 100 * time.Millisecond
+	}
+	max := p.MaxDelay
+	if max <= 0 {
+		max = 10 * time.Second
+	}
+	d := base
+	for i := 1; i < retry && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// send performs an HTTP request with the HttpClient. If idempotent is true and
+// a RetryPolicy is set, the request is retried on transient errors. A request
+// with a body is only retried if its GetBody is set. The response of the last
+// attempt is returned, which may not have a 200 status
+func (c *Client) send(req *http.Request, idempotent bool) (*http.Response, error) {
+	policy := c.Retry
+	if !idempotent || policy == nil || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+		return c.HttpClient.Do(req)
+	}
+
+	ctx := req.Context()
+	for attempt := 1; ; attempt += 1 {
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+		resp, err := c.HttpClient.Do(req)
+		if attempt >= policy.MaxAttempts {
+			return resp, err
+		}
+
+		var delay time.Duration
+		switch {
+		case err != nil:
+			if ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				return nil, err
+			}
+			delay = policy.delay(attempt)
+		case isTransientStatus(resp.StatusCode):
+			delay = policy.delay(attempt)
+			if after, ok := retryAfter(resp); ok {
+				delay = after
+			}
+			// Drain the body so the connection can be reused
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+			resp.Body.Close()
+		default:
+			return resp, nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func isTransientStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter returns the delay requested by the Retry-After header of a 429 or
+// 503 response. The header may be a number of seconds or an HTTP date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	val := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if val == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(val); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(val); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// idempotent reports whether req can safely be sent more than once. Calls
+// which create or change objects (/set, /copy and /import methods) or send
+// messages (/send methods) are only idempotent if they have an ifInState
+// argument: a repeated call then fails with a stateMismatch error instead of
+// being applied twice. A result reference (#ifInState) isn't enough, as it is
+// resolved again when the request is repeated, to the state after the first
+// attempt
+func (req *Request) idempotent() bool {
+	for _, call := range req.Calls {
+		i := strings.LastIndex(call.Name, "/")
+		switch call.Name[i+1:] {
+		case "set", "copy", "import", "send":
+		default:
+			continue
+		}
+		args, err := toGeneric(call.Args)
+		if err != nil {
+			return false
+		}
+		obj, _ := args.(map[string]interface{})
+		if state, _ := obj["ifInState"].(string); state == "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package jmap
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := &RetryPolicy{
+		BaseDelay: 10 * time.Millisecond,
+		MaxDelay:  50 * time.Millisecond,
+	}
+	for retry, max := range map[int]time.Duration{
+		1: 10 * time.Millisecond,
+		2: 20 * time.Millisecond,
+		3: 40 * time.Millisecond,
+		4: 50 * time.Millisecond,
+		9: 50 * time.Millisecond,
+	} {
+		for i := 0; i < 20; i++ {
+			d := policy.delay(retry)
+			assert.GreaterOrEqual(t, d, time.Duration(0))
+			assert.LessOrEqual(t, d, max)
+		}
+	}
+}
+
+func TestRequestIdempotent(t *testing.T) {
+	assert := assert.New(t)
+	req := &Request{}
+	req.Invoke(&testMethod{Hello: "world"})
+	assert.True(req.idempotent())
+
+	req.Invoke(&testRawMethod{
+		name: "Test/set",
+		args: map[string]interface{}{"ifInState": "s1"},
+	})
+	assert.True(req.idempotent())
+
+	// A referenced state is resolved again when the request is repeated
+	ref := &Request{}
+	ref.Invoke(&testRawMethod{
+		name: "Test/set",
+		args: map[string]interface{}{
+			"#ifInState": &ResultReference{ResultOf: "0", Name: "Test/get", Path: "/state"},
+		},
+	})
+	assert.False(ref.idempotent())
+
+	req.Invoke(&testRawMethod{
+		name: "Test/set",
+		args: map[string]interface{}{},
+	})
+	assert.False(req.idempotent())
+}
+
+func TestClientRetry(t *testing.T) {
+	assert := assert.New(t)
+	ts := newTestServer(t)
+	client := ts.client()
+	client.Retry = &RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+	}
+	assert.NoError(client.Authenticate())
+
+	// Succeeds on the last attempt
+	ts.failures = 2
+	req := &Request{}
+	req.Invoke(&testMethod{Hello: "world"})
+	_, err := client.Do(req)
+	assert.NoError(err)
+	assert.Equal(3, ts.attempts)
+
+	// Fails after all attempts
+	ts.failures, ts.attempts = 3, 0
+	_, err = client.Do(req)
+	assert.Error(err)
+	assert.Equal(3, ts.attempts)
+
+	// Not retried, the call isn't idempotent
+	ts.failures, ts.attempts = 1, 0
+	req.Invoke(&testRawMethod{
+		name: "Test/set",
+		args: map[string]interface{}{},
+	})
+	_, err = client.Do(req)
+	assert.Error(err)
+	assert.Equal(1, ts.attempts)
+
+	// Uploads are replayed
+	ts.failures, ts.attempts = 2, 0
+	info, err := client.Upload("A1", bytes.NewReader([]byte("hello")))
+	if assert.NoError(err) {
+		assert.Equal(uint64(5), info.Size)
+	}
+	assert.Equal(3, ts.attempts)
+}
@@ -0,0 +1,291 @@
+package jmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// A MethodHandler performs a method call on a Server. The arguments are those
+// of the call, with result references resolved and creation ids replaced. The
+// returned value is marshaled as the arguments of the response. If the error
+// is (or wraps) a *MethodError it is the response, any other error is
+// responded to with a serverFail MethodError
+type MethodHandler func(call *MethodCall, args json.RawMessage) (interface{}, error)
+
+// A MethodCall is a method call being performed by a Server
+type MethodCall struct {
+	// The HTTP request the call was made in
+	Request *http.Request
+
+	// The name of the method, and the call ID the client set
+	Name   string
+	CallID string
+
+	// The capabilities used by the request
+	Using []URI
+
+	// The creation ids of the objects created by the request so far,
+	// mapped to the ids the server assigned. The ids in the "created"
+	// argument of a response are added once the call returns, a handler
+	// which lets creation ids be referenced within the same call adds them
+	// as it creates the objects
+	CreatedIDs map[ID]ID
+
+	// The responses added with Respond
+	implicit []*Invocation
+}
+
+// Respond adds a response to the call, which follows its own response. It is
+// used for implicit calls, eg the Email/set made by EmailSubmission/set with
+// onSuccessUpdateEmail
+func (c *MethodCall) Respond(name string, args interface{}) {
+	c.implicit = append(c.implicit, &Invocation{
+		Name:   name,
+		Args:   args,
+		CallID: c.CallID,
+	})
+}
+
+// A Server is an http.Handler for the API endpoint of a JMAP server, as
+// described in RFC 8620 section 3. It parses requests, checks the capabilities
+// they use, and dispatches each method call to the MethodHandler registered
+// for it, after resolving its result references and creation ids:
+//
+//	s := jmap.NewServer()
+//	s.Handle("Todo/get", todoURI, func(call *jmap.MethodCall, args json.RawMessage) (interface{}, error) {
+//		req := &TodoGet{}
+//		if err := json.Unmarshal(args, req); err != nil {
+//			desc := err.Error()
+//			return nil, &jmap.MethodError{Type: string(jmap.ErrInvalidArguments), Description: &desc}
+//		}
+//		...
+//	})
+//	http.Handle("/jmap/api/", s)
+//
+// The calls of a request are performed in order. Authentication, and the
+// Session, upload, download and push endpoints, are left to the program
+type Server struct {
+	// SessionState returns the state of the Session, which is returned in
+	// the sessionState of each response. If nil, it is empty
+	SessionState func() string
+
+	// The maximum size in octets of a request, and the maximum number of
+	// calls in it. Requests which exceed them are rejected with a limit
+	// RequestError. Zero means no limit
+	MaxSizeRequest    uint64
+	MaxCallsInRequest uint64
+
+	mu           sync.RWMutex
+	handlers     map[string]serverHandler
+	capabilities map[URI]bool
+}
+
+type serverHandler struct {
+	// The capability a request must use to call the method
+	capability URI
+	fn         MethodHandler
+}
+
+// NewServer returns a Server without any methods
+func NewServer() *Server {
+	return &Server{
+		handlers:     make(map[string]serverHandler),
+		capabilities: map[URI]bool{coreURI: true},
+	}
+}
+
+// Handle registers the MethodHandler of a method. Requests may only call the
+// method if they use its capability. A request may use the core capability,
+// and the capability of any registered method
+func (s *Server) Handle(name string, capability URI, fn MethodHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[name] = serverHandler{capability: capability, fn: fn}
+	s.capabilities[capability] = true
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		writeProblem(w, ErrNotJSON, "the content type must be application/json", nil)
+		return
+	}
+	body := io.Reader(r.Body)
+	if s.MaxSizeRequest > 0 {
+		body = io.LimitReader(r.Body, int64(s.MaxSizeRequest)+1)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.MaxSizeRequest > 0 && uint64(len(data)) > s.MaxSizeRequest {
+		limit := "maxSizeRequest"
+		writeProblem(w, ErrLimit, "the request is too large", &limit)
+		return
+	}
+	if !json.Valid(data) {
+		writeProblem(w, ErrNotJSON, "the request is not valid JSON", nil)
+		return
+	}
+	raw := struct {
+		Using      []URI             `json:"using"`
+		Calls      []json.RawMessage `json:"methodCalls"`
+		CreatedIDs map[ID]ID         `json:"createdIds"`
+	}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		writeProblem(w, ErrNotRequest, err.Error(), nil)
+		return
+	}
+	if raw.Using == nil || raw.Calls == nil {
+		writeProblem(w, ErrNotRequest, "using and methodCalls are required", nil)
+		return
+	}
+	if s.MaxCallsInRequest > 0 && uint64(len(raw.Calls)) > s.MaxCallsInRequest {
+		limit := "maxCallsInRequest"
+		writeProblem(w, ErrLimit, "the request has too many calls", &limit)
+		return
+	}
+	using := make(map[URI]bool)
+	s.mu.RLock()
+	for _, uri := range raw.Using {
+		if !s.capabilities[uri] {
+			s.mu.RUnlock()
+			writeProblem(w, ErrUnknownCapability, fmt.Sprintf("unknown capability %s", uri), nil)
+			return
+		}
+		using[uri] = true
+	}
+	s.mu.RUnlock()
+	calls := make([]*MethodCall, 0, len(raw.Calls))
+	args := make([]json.RawMessage, 0, len(raw.Calls))
+	for _, data := range raw.Calls {
+		var inv []json.RawMessage
+		call := &MethodCall{Request: r, Using: raw.Using}
+		if json.Unmarshal(data, &inv) != nil || len(inv) != 3 ||
+			json.Unmarshal(inv[0], &call.Name) != nil || json.Unmarshal(inv[2], &call.CallID) != nil {
+			writeProblem(w, ErrNotRequest, "invalid invocation", nil)
+			return
+		}
+		calls = append(calls, call)
+		args = append(args, inv[1])
+	}
+
+	created := make(map[ID]ID)
+	for cid, id := range raw.CreatedIDs {
+		created[cid] = id
+	}
+	resp := &Response{Responses: []*Invocation{}}
+	results := make(map[string][]*Invocation)
+	for i, call := range calls {
+		call.CreatedIDs = created
+		invs := []*Invocation{s.call(call, args[i], using, results)}
+		invs = append(invs, call.implicit...)
+		for _, inv := range invs {
+			for cid, id := range createdIDs(inv) {
+				created[cid] = id
+			}
+		}
+		results[call.CallID] = append(results[call.CallID], invs...)
+		resp.Responses = append(resp.Responses, invs...)
+	}
+	if raw.CreatedIDs != nil {
+		resp.CreatedIDs = created
+	}
+	if s.SessionState != nil {
+		resp.SessionState = s.SessionState()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// call performs a method call, and returns its response
+func (s *Server) call(call *MethodCall, args json.RawMessage, using map[URI]bool, results map[string][]*Invocation) *Invocation {
+	s.mu.RLock()
+	h, ok := s.handlers[call.Name]
+	s.mu.RUnlock()
+	if !ok || !using[h.capability] {
+		return &Invocation{
+			Name:   "error",
+			Args:   &MethodError{Type: string(ErrUnknownMethod)},
+			CallID: call.CallID,
+		}
+	}
+	args, err := resolveArgs(args, results, call.CreatedIDs)
+	var resp interface{}
+	if err == nil {
+		resp, err = h.fn(call, args)
+	}
+	if err != nil {
+		var methodErr *MethodError
+		if !errors.As(err, &methodErr) {
+			methodErr = newMethodErr(ErrServerFail, err.Error())
+		}
+		return &Invocation{Name: "error", Args: methodErr, CallID: call.CallID}
+	}
+	return &Invocation{Name: call.Name, Args: resp, CallID: call.CallID}
+}
+
+// resolveArgs returns the arguments of a call with its result references
+// replaced by their values, evaluated against the responses to earlier calls,
+// and its creation ids replaced by the ids of the objects created
+func resolveArgs(args json.RawMessage, results map[string][]*Invocation, created map[ID]ID) (json.RawMessage, error) {
+	var obj map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(args))
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil || obj == nil {
+		return nil, newMethodErr(ErrInvalidArguments, "the arguments must be an object")
+	}
+	for key, val := range obj {
+		if !strings.HasPrefix(key, "#") {
+			continue
+		}
+		name := strings.TrimPrefix(key, "#")
+		if _, ok := obj[name]; ok {
+			return nil, newMethodErr(ErrInvalidArguments, fmt.Sprintf("both %s and %s are set", name, key))
+		}
+		ref := &ResultReference{}
+		if err := fromGeneric(val, ref); err != nil {
+			return nil, newMethodErr(ErrInvalidResultReference, err.Error())
+		}
+		value, err := resolveReference(ref, results[ref.ResultOf])
+		if err != nil {
+			return nil, newMethodErr(ErrInvalidResultReference, err.Error())
+		}
+		delete(obj, key)
+		obj[name] = value
+	}
+	var resolved interface{} = obj
+	if len(created) > 0 {
+		resolved = replaceCreationIDs(obj, "", created)
+	}
+	return json.Marshal(resolved)
+}
+
+func newMethodErr(typ ErrorType, desc string) *MethodError {
+	return &MethodError{Type: string(typ), Description: &desc}
+}
+
+// writeProblem responds with a RequestError
+func writeProblem(w http.ResponseWriter, typ ErrorType, detail string, limit *string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(&RequestError{
+		Type:   string(typ),
+		Status: http.StatusBadRequest,
+		Detail: detail,
+		Limit:  limit,
+	})
+}
@@ -0,0 +1,164 @@
+package jmap
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testURI URI = "test:jmap:capability"
+
+func newTestAPI(t *testing.T) (*Server, *Client) {
+	RegisterMethod("Test/method", newTest)
+	RegisterMethod("Test/set", newTestSetResponse)
+	s := NewServer()
+	s.SessionState = func() string { return "s1" }
+	s.Handle("Test/method", testURI, func(call *MethodCall, args json.RawMessage) (interface{}, error) {
+		resp := &test{}
+		if err := json.Unmarshal(args, resp); err != nil {
+			return nil, err
+		}
+		if resp.Hello == "implicit" {
+			call.Respond("Test/method", &test{Hello: "too"})
+		}
+		return resp, nil
+	})
+	s.Handle("Test/set", testURI, func(call *MethodCall, args json.RawMessage) (interface{}, error) {
+		req := struct {
+			Create    map[ID]interface{} `json:"create"`
+			AccountID ID                 `json:"accountId"`
+			IDs       []ID               `json:"ids"`
+		}{}
+		if err := json.Unmarshal(args, &req); err != nil {
+			return nil, err
+		}
+		resp := &testSetResponse{AccountID: req.AccountID, IDs: req.IDs}
+		for cid := range req.Create {
+			if resp.Created == nil {
+				resp.Created = make(map[ID]*testCreated)
+			}
+			resp.Created[cid] = &testCreated{ID: "M1"}
+		}
+		return resp, nil
+	})
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	client := &Client{
+		HttpClient: ts.Client(),
+		Session: &Session{
+			Capabilities: map[URI]Capability{testURI: &testCapability{}},
+			APIURL:       ts.URL,
+		},
+	}
+	return s, client
+}
+
+func TestServer(t *testing.T) {
+	assert := assert.New(t)
+	_, client := newTestAPI(t)
+
+	req := &Request{CreatedIDs: map[ID]ID{"k0": "M0"}}
+	req.Invoke(&testMethod{Hello: "world"})
+	req.Invoke(&testRawMethod{
+		name: "Test/set",
+		args: map[string]interface{}{
+			"create": map[string]interface{}{"k1": map[string]interface{}{}},
+		},
+	})
+	req.Invoke(&testRawMethod{
+		name: "Test/method",
+		args: map[string]interface{}{
+			"#Hello": &ResultReference{ResultOf: "0", Name: "Test/method", Path: "/Hello"},
+		},
+	})
+	req.Invoke(&testRawMethod{
+		name: "Test/set",
+		args: map[string]interface{}{
+			"accountId": "#k1",
+			"ids":       []string{"#k0", "#k1", "#k2"},
+		},
+	})
+	// A reference to a missing property: the response to the first
+	// Test/set has no ids
+	req.Invoke(&testRawMethod{
+		name: "Test/set",
+		args: map[string]interface{}{
+			"#ids": &ResultReference{ResultOf: "1", Name: "Test/set", Path: "/ids"},
+		},
+	})
+	req.Invoke(&testRawMethod{
+		name: "Test/method",
+		args: map[string]interface{}{
+			"#Hello": &ResultReference{ResultOf: "9", Name: "Test/method", Path: "/Hello"},
+		},
+	})
+	req.Invoke(&testRawMethod{
+		name: "Test/method",
+		args: map[string]interface{}{
+			"Hello":  "world",
+			"#Hello": &ResultReference{ResultOf: "0", Name: "Test/method", Path: "/Hello"},
+		},
+	})
+	req.Invoke(&testRawMethod{name: "Test/unknown"})
+	req.Invoke(&testRawMethod{name: "Test/method", args: map[string]interface{}{"Hello": 1}})
+	req.Invoke(&testMethod{Hello: "implicit"})
+
+	resp, err := client.Do(req)
+	if !assert.NoError(err) || !assert.Equal(11, len(resp.Responses)) {
+		return
+	}
+	assert.Equal("s1", resp.SessionState)
+	assert.Equal(map[ID]ID{"k0": "M0", "k1": "M1"}, resp.CreatedIDs)
+	assert.Equal("world", resp.Responses[2].Args.(*test).Hello)
+	set := resp.Responses[3].Args.(*testSetResponse)
+	assert.Equal(ID("M1"), set.AccountID)
+	assert.Equal([]ID{"M0", "M1", "#k2"}, set.IDs)
+	for i, typ := range map[int]ErrorType{
+		4: ErrInvalidResultReference,
+		5: ErrInvalidResultReference,
+		6: ErrInvalidArguments,
+		7: ErrUnknownMethod,
+		8: ErrServerFail,
+	} {
+		assert.Equal("error", resp.Responses[i].Name)
+		assert.ErrorIs(resp.Responses[i].Args.(*MethodError), typ)
+	}
+	assert.Equal("implicit", resp.Responses[9].Args.(*test).Hello)
+	assert.Equal("too", resp.Responses[10].Args.(*test).Hello)
+	assert.Equal("9", resp.Responses[10].CallID)
+}
+
+func TestServerRequestErrors(t *testing.T) {
+	assert := assert.New(t)
+	s, _ := newTestAPI(t)
+	s.MaxCallsInRequest = 1
+
+	tests := []struct {
+		body        string
+		contentType string
+		typ         ErrorType
+	}{
+		{`{"using":[],"methodCalls":[]}`, "text/plain", ErrNotJSON},
+		{`{"using":`, "application/json", ErrNotJSON},
+		{`{"using":[]}`, "application/json", ErrNotRequest},
+		{`{"using":[],"methodCalls":[["Test/method",{}]]}`, "application/json", ErrNotRequest},
+		{`{"using":["test:unknown"],"methodCalls":[]}`, "application/json", ErrUnknownCapability},
+		{`{"using":[],"methodCalls":[["Core/echo",{},"0"],["Core/echo",{},"1"]]}`, "application/json", ErrLimit},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+		req.Header.Set("Content-Type", test.contentType)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		assert.Equal(http.StatusBadRequest, w.Code)
+		reqErr := &RequestError{}
+		if assert.NoError(json.NewDecoder(w.Body).Decode(reqErr)) {
+			assert.Truef(errors.Is(reqErr, test.typ), "%s: %s is not %s", test.body, reqErr.Type, test.typ)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package jmap
 
 import (
+	"bytes"
 	"encoding/json"
+	"reflect"
 )
 
 type Session struct {
@@ -55,24 +57,124 @@ type Session struct {
 type session Session
 
 func (s *Session) UnmarshalJSON(data []byte) error {
-	raw := (*session)(s)
+	return s.unmarshal(data, nil)
+}
+
+// unmarshal decodes the Session, using the capabilities of the Registry for
+// the Session and its Accounts
+func (s *Session) unmarshal(data []byte, r *Registry) error {
+	raw := struct {
+		*session
+		// Decoded without Account.UnmarshalJSON, so the Registry
+		// can be used
+		Accounts map[ID]*account `json:"accounts"`
+	}{
+		session: (*session)(s),
+	}
 	if err := json.Unmarshal(data, &raw); err != nil {
 		return err
 	}
 
-	s.Capabilities = make(map[URI]Capability)
-	for key, cap := range capabilities {
-		rawCap, ok := raw.RawCapabilities[key]
-		if !ok {
-			continue
+	var err error
+	s.Capabilities, err = decodeCapabilities(r, s.RawCapabilities)
+	if err != nil {
+		return err
+	}
+	s.Accounts = nil
+	if raw.Accounts != nil {
+		s.Accounts = make(map[ID]Account, len(raw.Accounts))
+	}
+	for id, acct := range raw.Accounts {
+		if acct == nil {
+			acct = &account{}
 		}
-		newCap := cap.New()
-		err := json.Unmarshal(rawCap, newCap)
+		acct.Capabilities, err = decodeCapabilities(r, acct.RawCapabilities)
 		if err != nil {
 			return err
 		}
-		s.Capabilities[key] = newCap
+		s.Accounts[id] = Account(*acct)
 	}
 
 	return nil
 }
+
+// MarshalJSON encodes the Session as it was received from the server. The
+// capabilities are taken from RawCapabilities; capabilities which are only in
+// Capabilities are encoded from their decoded value
+func (s Session) MarshalJSON() ([]byte, error) {
+	raw, err := encodeCapabilities(s.Capabilities, s.RawCapabilities)
+	if err != nil {
+		return nil, err
+	}
+	s.RawCapabilities = raw
+	return json.Marshal(session(s))
+}
+
+// A SessionChange describes how the Session object changed when it was
+// refetched
+type SessionChange struct {
+	// The Session object before it was refetched
+	Old *Session
+
+	// The Session object which replaced it
+	New *Session
+
+	// IDs of accounts the user has gained access to
+	AccountsAdded []ID
+
+	// IDs of accounts the user no longer has access to
+	AccountsRemoved []ID
+
+	// Capabilities the server newly supports
+	CapabilitiesAdded []URI
+
+	// Capabilities the server no longer supports
+	CapabilitiesRemoved []URI
+
+	// Capabilities which are still supported, but whose values (eg the
+	// limits of urn:ietf:params:jmap:core) have changed
+	CapabilitiesChanged []URI
+}
+
+// diffSessions reports the changes between two Session objects
+func diffSessions(old *Session, new *Session) *SessionChange {
+	change := &SessionChange{
+		Old: old,
+		New: new,
+	}
+	for id := range new.Accounts {
+		if _, ok := old.Accounts[id]; !ok {
+			change.AccountsAdded = append(change.AccountsAdded, id)
+		}
+	}
+	for id := range old.Accounts {
+		if _, ok := new.Accounts[id]; !ok {
+			change.AccountsRemoved = append(change.AccountsRemoved, id)
+		}
+	}
+	for uri, raw := range new.RawCapabilities {
+		oldRaw, ok := old.RawCapabilities[uri]
+		switch {
+		case !ok:
+			change.CapabilitiesAdded = append(change.CapabilitiesAdded, uri)
+		case !jsonEqual(oldRaw, raw):
+			change.CapabilitiesChanged = append(change.CapabilitiesChanged, uri)
+		}
+	}
+	for uri := range old.RawCapabilities {
+		if _, ok := new.RawCapabilities[uri]; !ok {
+			change.CapabilitiesRemoved = append(change.CapabilitiesRemoved, uri)
+		}
+	}
+	return change
+}
+
+// jsonEqual reports whether two JSON values are semantically equal, ignoring
+// formatting and the order of object keys
+func jsonEqual(a json.RawMessage, b json.RawMessage) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return bytes.Equal(a, b)
+	}
+	return reflect.DeepEqual(va, vb)
+}
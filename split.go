@@ -0,0 +1,300 @@
+package jmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// doSplit performs a request which has more calls than the server accepts in a
+// single request (maxCallsInRequest). The calls are sent in order, in batches
+// of at most max calls. Result references and creation ids which refer to a
+// call in an earlier batch are replaced by the values the server returned for
+// that call, and the responses of all batches are merged into one Response
+func (c *Client) doSplit(req *Request, session *Session, max int) (*Response, error) {
+	resp := &Response{}
+	// Responses to calls in earlier batches, by call ID
+	results := make(map[string][]*Invocation)
+	// Creation ids assigned in earlier batches
+	created := make(map[ID]ID)
+	for k, v := range req.CreatedIDs {
+		created[k] = v
+	}
+
+	for start := 0; start < len(req.Calls); start += max {
+		end := start + max
+		if end > len(req.Calls) {
+			end = len(req.Calls)
+		}
+		batch := &Request{
+			Context: req.Context,
+			Using:   req.Using,
+		}
+		if len(created) > 0 {
+			batch.CreatedIDs = make(map[ID]ID)
+			for k, v := range created {
+				batch.CreatedIDs[k] = v
+			}
+		}
+		// Calls which can't be sent because a result reference
+		// couldn't be resolved, and the error they resolve to
+		failed := make(map[int]*Invocation)
+		for i, call := range req.Calls[start:end] {
+			if start == 0 {
+				batch.Calls = append(batch.Calls, call)
+				continue
+			}
+			inv, errInv := resolveCall(call, results, created)
+			if errInv != nil {
+				failed[i] = errInv
+				continue
+			}
+			batch.Calls = append(batch.Calls, inv)
+		}
+
+		var batchResp *Response
+		if len(batch.Calls) > 0 {
+			var err error
+			batchResp, err = c.do(batch, session)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			batchResp = &Response{SessionState: resp.SessionState}
+		}
+
+		// Put the responses back in call order, including the errors
+		// of calls which weren't sent
+		first := len(resp.Responses)
+		n := 0
+		for i, call := range req.Calls[start:end] {
+			if inv, ok := failed[i]; ok {
+				resp.Responses = append(resp.Responses, inv)
+				continue
+			}
+			for n < len(batchResp.Responses) && batchResp.Responses[n].CallID == call.CallID {
+				resp.Responses = append(resp.Responses, batchResp.Responses[n])
+				n += 1
+			}
+		}
+		resp.Responses = append(resp.Responses, batchResp.Responses[n:]...)
+
+		for _, inv := range resp.Responses[first:] {
+			results[inv.CallID] = append(results[inv.CallID], inv)
+		}
+		for _, inv := range batchResp.Responses {
+			for k, v := range createdIDs(inv) {
+				created[k] = v
+			}
+		}
+		for k, v := range batchResp.CreatedIDs {
+			created[k] = v
+		}
+		resp.SessionState = batchResp.SessionState
+	}
+
+	if req.CreatedIDs != nil {
+		resp.CreatedIDs = created
+	}
+	return resp, nil
+}
+
+// resolveCall returns a copy of call where any result references to calls in
+// results, and any creation ids in created, are replaced by their values. If a
+// result reference can't be resolved, the error Invocation the server would
+// have responded with is returned
+func resolveCall(call *Invocation, results map[string][]*Invocation, created map[ID]ID) (*Invocation, *Invocation) {
+	args, err := toGeneric(call.Args)
+	if err != nil {
+		return nil, invalidResultReference(call, err.Error())
+	}
+	obj, ok := args.(map[string]interface{})
+	if !ok {
+		return call, nil
+	}
+	for key, val := range obj {
+		if !strings.HasPrefix(key, "#") {
+			continue
+		}
+		ref := &ResultReference{}
+		if err := fromGeneric(val, ref); err != nil {
+			return nil, invalidResultReference(call, err.Error())
+		}
+		responses, ok := results[ref.ResultOf]
+		if !ok {
+			// The reference is to a call in the same batch
+			continue
+		}
+		value, err := resolveReference(ref, responses)
+		if err != nil {
+			return nil, invalidResultReference(call, err.Error())
+		}
+		delete(obj, key)
+		obj[strings.TrimPrefix(key, "#")] = value
+	}
+	if len(created) > 0 {
+		args = replaceCreationIDs(obj, "", created)
+	}
+	data, err := json.Marshal(args)
+	if err != nil {
+		return nil, invalidResultReference(call, err.Error())
+	}
+	return &Invocation{
+		Name:   call.Name,
+		Args:   json.RawMessage(data),
+		CallID: call.CallID,
+	}, nil
+}
+
+// resolveReference evaluates ref against the responses to the call it refers
+// to
+func resolveReference(ref *ResultReference, responses []*Invocation) (interface{}, error) {
+	for _, inv := range responses {
+		if inv.Name != ref.Name {
+			continue
+		}
+		args, err := toGeneric(inv.Args)
+		if err != nil {
+			return nil, err
+		}
+		return evalPointer(args, ref.Path)
+	}
+	return nil, fmt.Errorf("no '%s' response to call '%s'", ref.Name, ref.ResultOf)
+}
+
+func invalidResultReference(call *Invocation, desc string) *Invocation {
+	return &Invocation{
+		Name: "error",
+		Args: &MethodError{
+			Type:        string(ErrInvalidResultReference),
+			Description: &desc,
+		},
+		CallID: call.CallID,
+	}
+}
+
+// createdIDs returns the creation id to server assigned id mapping of the
+// "created" argument of a /set (or /copy, /import, etc) response
+func createdIDs(inv *Invocation) map[ID]ID {
+	if _, ok := inv.Args.(*MethodError); ok {
+		return nil
+	}
+	args, err := toGeneric(inv.Args)
+	if err != nil {
+		return nil
+	}
+	obj, ok := args.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	createdObjs, ok := obj["created"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	ids := make(map[ID]ID)
+	for cid, v := range createdObjs {
+		o, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if id, ok := o["id"].(string); ok {
+			ids[ID(cid)] = ID(id)
+		}
+	}
+	return ids
+}
+
+// replaceCreationIDs replaces references to creation ids ("#" followed by the
+// creation id) with the ids the server assigned. Only values which are in an
+// Id typed position are replaced: properties named "id" or ending in "Id",
+// items of arrays and keys of maps named "ids", "destroy" or ending in "Ids",
+// the keys of "update" and Patch paths through any of these
+func replaceCreationIDs(v interface{}, prop string, created map[ID]ID) interface{} {
+	switch val := v.(type) {
+	case string:
+		if isIDProperty(prop) {
+			return replaceCreationID(val, created)
+		}
+		return val
+	case []interface{}:
+		for i, item := range val {
+			val[i] = replaceCreationIDs(item, prop, created)
+		}
+		return val
+	case map[string]interface{}:
+		keyed := isIDProperty(prop) || prop == "update"
+		result := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			key := k
+			switch {
+			case keyed:
+				key = replaceCreationID(k, created)
+			case strings.Contains(k, "/"):
+				key = replacePatchPath(k, created)
+			}
+			result[key] = replaceCreationIDs(item, k, created)
+		}
+		return result
+	default:
+		return val
+	}
+}
+
+func isIDProperty(prop string) bool {
+	switch {
+	case prop == "id", prop == "ids", prop == "destroy":
+		return true
+	case strings.HasSuffix(prop, "Id"), strings.HasSuffix(prop, "Ids"):
+		return true
+	}
+	return false
+}
+
+func replaceCreationID(s string, created map[ID]ID) string {
+	if !strings.HasPrefix(s, "#") {
+		return s
+	}
+	if id, ok := created[ID(strings.TrimPrefix(s, "#"))]; ok {
+		return string(id)
+	}
+	return s
+}
+
+// replacePatchPath replaces creation ids in the path of a Patch, eg
+// "mailboxIds/#cid"
+func replacePatchPath(path string, created map[ID]ID) string {
+	parts := strings.Split(path, "/")
+	for i := 1; i < len(parts); i++ {
+		if isIDProperty(parts[i-1]) {
+			parts[i] = replaceCreationID(parts[i], created)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// toGeneric converts v to its generic JSON representation, ie maps, slices
+// and scalars. Numbers are kept as json.Number so they are not changed when
+// marshaled again
+func toGeneric(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var result interface{}
+	if err := dec.Decode(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// fromGeneric converts a generic JSON value to v
+func fromGeneric(generic interface{}, v interface{}) error {
+	data, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,135 @@
+package jmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A method whose arguments are a generic JSON object
+type testRawMethod struct {
+	name string
+	args map[string]interface{}
+}
+
+func (m *testRawMethod) Name() string { return m.name }
+
+func (m *testRawMethod) Requires() []URI { return []URI{"test:jmap:capability"} }
+
+func (m *testRawMethod) MarshalJSON() ([]byte, error) { return json.Marshal(m.args) }
+
+type testCreated struct {
+	ID ID `json:"id"`
+}
+
+type testSetResponse struct {
+	Created   map[ID]*testCreated `json:"created,omitempty"`
+	AccountID ID                  `json:"accountId,omitempty"`
+	IDs       []ID                `json:"ids,omitempty"`
+}
+
+func newTestSetResponse() MethodResponse { return &testSetResponse{} }
+
+func TestClientDoSplit(t *testing.T) {
+	RegisterMethod("Test/set", newTestSetResponse)
+	assert := assert.New(t)
+	ts := newTestServer(t)
+	ts.session["capabilities"].(map[string]interface{})["urn:ietf:params:jmap:core"] = map[string]interface{}{
+		"maxCallsInRequest": 2,
+	}
+	client := ts.client()
+
+	req := &Request{}
+	req.Invoke(&testMethod{Hello: "world"})
+	req.Invoke(&testRawMethod{
+		name: "Test/set",
+		args: map[string]interface{}{
+			"created": map[string]interface{}{
+				"k1": map[string]interface{}{"id": "M1"},
+			},
+		},
+	})
+	// References the first call, which is in the previous request
+	req.Invoke(&testRawMethod{
+		name: "Test/method",
+		args: map[string]interface{}{
+			"#Hello": &ResultReference{
+				ResultOf: "0",
+				Name:     "Test/method",
+				Path:     "/Hello",
+			},
+		},
+	})
+	// References the creation id of the second call, and a call in the
+	// same request
+	req.Invoke(&testRawMethod{
+		name: "Test/set",
+		args: map[string]interface{}{
+			"accountId": "#k1",
+			"ids":       []string{"#k1", "#k2"},
+		},
+	})
+	// References a result which doesn't exist
+	req.Invoke(&testRawMethod{
+		name: "Test/method",
+		args: map[string]interface{}{
+			"#Hello": &ResultReference{
+				ResultOf: "0",
+				Name:     "Test/method",
+				Path:     "/Nope",
+			},
+		},
+	})
+
+	resp, err := client.Do(req)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal([]int{2, 2}, ts.requestCalls)
+	if !assert.Equal(5, len(resp.Responses)) {
+		return
+	}
+	for i, inv := range resp.Responses {
+		assert.Equal(fmt.Sprintf("%x", i), inv.CallID)
+	}
+	assert.Equal("world", resp.Responses[2].Args.(*test).Hello)
+	set := resp.Responses[3].Args.(*testSetResponse)
+	assert.Equal(ID("M1"), set.AccountID)
+	assert.Equal([]ID{"M1", "#k2"}, set.IDs)
+	methodErr, ok := resp.Responses[4].Args.(*MethodError)
+	if assert.Truef(ok, "invocation arguments are not type *MethodError") {
+		assert.Equal("invalidResultReference", methodErr.Type)
+	}
+}
+
+func TestReplaceCreationIDs(t *testing.T) {
+	assert := assert.New(t)
+	created := map[ID]ID{"k1": "M1"}
+	args := map[string]interface{}{
+		"subject": "#k1",
+		"update": map[string]interface{}{
+			"#k1": map[string]interface{}{
+				"mailboxIds/#k1": true,
+				"keywords/#k1":   true,
+			},
+		},
+		"destroy":    []interface{}{"#k1", "#k3"},
+		"mailboxIds": map[string]interface{}{"#k1": true},
+		"emailId":    "#k1",
+	}
+	expected := map[string]interface{}{
+		"subject": "#k1",
+		"update": map[string]interface{}{
+			"M1": map[string]interface{}{
+				"mailboxIds/M1": true,
+				"keywords/#k1":  true,
+			},
+		},
+		"destroy":    []interface{}{"M1", "#k3"},
+		"mailboxIds": map[string]interface{}{"M1": true},
+		"emailId":    "M1",
+	}
+	assert.Equal(expected, replaceCreationIDs(args, "", created))
+}
@@ -16,6 +16,13 @@ type StateChange struct {
 
 	// Map of AccountID to TypeState. Only changed values will be in the map
 	Changed map[ID]TypeState `json:"changed"`
+
+	// A (preferably short) string that encodes the entire server state
+	// visible to the user (not just the objects returned in this call).
+	// Only sent on StateChanges received over a WebSocket connection (RFC
+	// 8887), and can be used to resume push notifications after
+	// reconnecting.
+	PushState string `json:"pushState,omitempty"`
 }
 
 // TypeState is a map of Foo object names ("Mailbox", "Email", etc) to state
@@ -0,0 +1,74 @@
+package jmap
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// A SessionStore caches the Session object between runs of a program. Session
+// objects are cacheable: a client may use a stored Session instead of fetching
+// it again, and refetch it once a Response reports a different session state.
+//
+// Set a SessionStore on a Client with its SessionStore field
+type SessionStore interface {
+	// Load returns the stored Session, or nil if there is none
+	Load() (*Session, error)
+
+	// Store replaces the stored Session
+	Store(*Session) error
+}
+
+// A MemorySessionStore stores a Session in memory. It can be shared by several
+// Clients using the same SessionEndpoint, so only the first needs to fetch
+// the Session. The zero value is ready to use
+type MemorySessionStore struct {
+	mu      sync.Mutex
+	session *Session
+}
+
+func (m *MemorySessionStore) Load() (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.session, nil
+}
+
+func (m *MemorySessionStore) Store(s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.session = s
+	return nil
+}
+
+// A FileSessionStore stores a Session as JSON in a file, eg in the cache
+// directory of the user. The file is only readable by the user, and is
+// replaced atomically
+type FileSessionStore struct {
+	// The path of the file
+	Path string
+}
+
+func (f *FileSessionStore) Load() (*Session, error) {
+	data, err := os.ReadFile(f.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (f *FileSessionStore) Store(s *Session) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.Path, data)
+}
@@ -0,0 +1,164 @@
+package jmap
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSessionStore(t *testing.T) {
+	RegisterCapability(&testCapability{})
+	assert := assert.New(t)
+	store := &FileSessionStore{Path: filepath.Join(t.TempDir(), "cache", "session.json")}
+
+	s, err := store.Load()
+	assert.NoError(err)
+	assert.Nil(s)
+
+	expected := &Session{}
+	assert.NoError(json.Unmarshal([]byte(sessionBlob), expected))
+	assert.NoError(store.Store(expected))
+	info, err := os.Stat(store.Path)
+	if assert.NoError(err) {
+		assert.Equal(os.FileMode(0o600), info.Mode().Perm())
+	}
+
+	s, err = store.Load()
+	if !assert.NoError(err) {
+		return
+	}
+	expectedData, _ := json.Marshal(expected)
+	data, _ := json.Marshal(s)
+	assert.JSONEq(string(expectedData), string(data))
+	assert.Equal(expected.Accounts["A13824"].Name, s.Accounts["A13824"].Name)
+	assert.Equal(&testCapability{TestValue: 500}, s.Capabilities["test:jmap:capability"])
+
+	// A corrupt file is an error
+	assert.NoError(os.WriteFile(store.Path, []byte("{"), 0o600))
+	_, err = store.Load()
+	assert.Error(err)
+}
+
+func TestSessionMarshalCapabilities(t *testing.T) {
+	RegisterCapability(&testCapability{})
+	assert := assert.New(t)
+	s := &Session{
+		Capabilities: map[URI]Capability{
+			"test:jmap:capability": &testCapability{TestValue: 1},
+		},
+		Accounts: map[ID]Account{
+			"A1": {
+				Name: "A1",
+				Capabilities: map[URI]Capability{
+					"test:jmap:capability": &testCapability{TestValue: 2},
+				},
+			},
+		},
+		State: "s1",
+	}
+	data, err := json.Marshal(s)
+	if !assert.NoError(err) {
+		return
+	}
+	decoded := &Session{}
+	assert.NoError(json.Unmarshal(data, decoded))
+	assert.Equal(&testCapability{TestValue: 1}, decoded.Capabilities["test:jmap:capability"])
+	assert.Equal(&testCapability{TestValue: 2}, decoded.Accounts["A1"].Capabilities["test:jmap:capability"])
+	assert.Equal("s1", decoded.State)
+}
+
+func TestClientSessionStore(t *testing.T) {
+	assert := assert.New(t)
+	ts := newTestServer(t)
+	store := &MemorySessionStore{}
+
+	// The first client fetches and stores the Session
+	client := ts.client()
+	client.SessionStore = store
+	req := &Request{}
+	req.Invoke(&testMethod{Hello: "world"})
+	_, err := client.Do(req)
+	assert.NoError(err)
+	stored, _ := store.Load()
+	if assert.NotNil(stored) {
+		assert.Equal("s1", stored.State)
+	}
+
+	// The second uses the stored Session
+	client = ts.client()
+	client.SessionStore = store
+	changes := make(chan *SessionChange, 1)
+	client.OnSessionChange = func(change *SessionChange) {
+		changes <- change
+	}
+	s, err := client.EnsureSession(context.Background())
+	assert.NoError(err)
+	assert.Equal(stored, s)
+	_, err = client.Do(req)
+	assert.NoError(err)
+	ts.mu.Lock()
+	assert.Equal(1, ts.sessionFetches)
+
+	// It is revalidated with the session state of responses
+	ts.sessionState = "s2"
+	ts.session["state"] = "s2"
+	ts.mu.Unlock()
+	_, err = client.Do(req)
+	assert.NoError(err)
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for session change")
+	}
+	stored, _ = store.Load()
+	assert.Equal("s2", stored.State)
+}
+
+func TestClientSessionStoreRegistries(t *testing.T) {
+	RegisterCapability(&testCapability{})
+	assert := assert.New(t)
+	stored := &Session{}
+	if !assert.NoError(json.Unmarshal([]byte(sessionBlob), stored)) {
+		return
+	}
+	store := &MemorySessionStore{}
+	store.Store(stored)
+
+	// Each client decodes the capabilities of the shared Session with its
+	// own Registry
+	foobar := &Client{SessionStore: store, Registry: NewRegistry()}
+	foobar.Registry.RegisterCapability(&testFoobarCapability{})
+	mail := &Client{SessionStore: store, Registry: NewRegistry()}
+	mail.Registry.RegisterCapability(&testMailCapability{})
+	sessions := make([]*Session, 2)
+	var wg sync.WaitGroup
+	for i, client := range []*Client{foobar, mail} {
+		wg.Add(1)
+		go func(i int, client *Client) {
+			defer wg.Done()
+			sessions[i], _ = client.EnsureSession(context.Background())
+		}(i, client)
+	}
+	wg.Wait()
+	if !assert.NotNil(sessions[0]) || !assert.NotNil(sessions[1]) {
+		return
+	}
+	assert.Equal(&testFoobarCapability{MaxFoosFinangled: 42}, sessions[0].Capabilities["https://example.com/apis/foobar"])
+	assert.NotContains(sessions[1].Capabilities, URI("https://example.com/apis/foobar"))
+	assert.Equal(&testMailCapability{MaxMailboxDepth: 10}, sessions[1].Accounts["A13824"].Capabilities["urn:ietf:params:jmap:mail"])
+	_, ok := sessions[0].Accounts["A13824"].Capabilities["urn:ietf:params:jmap:mail"].(*testMailCapability)
+	assert.False(ok)
+
+	// The stored Session is unchanged
+	s, _ := store.Load()
+	assert.Same(stored, s)
+	assert.NotContains(s.Capabilities, URI("https://example.com/apis/foobar"))
+	_, ok = s.Accounts["A13824"].Capabilities["urn:ietf:params:jmap:mail"].(*testMailCapability)
+	assert.False(ok)
+}
@@ -0,0 +1,179 @@
+package jmap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// UploadOptions are the options of an upload made with UploadWithOptions
+type UploadOptions struct {
+	// The media type of the blob, sent as the Content-Type of the upload
+	// and returned as the Type of the UploadResponse. Defaults to
+	// application/octet-stream
+	Type string
+
+	// The size of the blob in octets, if known. If zero, the size is taken
+	// from the blob if it has a Len method (eg *bytes.Reader), and is
+	// otherwise unknown
+	Size uint64
+
+	// Progress, if set, is called each time part of the blob has been sent
+	// with the number of octets sent so far and the size of the blob, or 0
+	// if the size is unknown. If the upload is retried, the count restarts
+	// from 0
+	Progress func(sent uint64, size uint64)
+}
+
+// An UploadTooLargeError is returned when a blob is larger than the
+// maxSizeUpload limit of the server. It matches ErrTooLarge with errors.Is
+type UploadTooLargeError struct {
+	// The size of the blob. If the size wasn't known before the upload,
+	// this is the number of octets read when the limit was exceeded
+	Size uint64
+
+	// The maxSizeUpload limit of the server
+	MaxSize uint64
+}
+
+func (e *UploadTooLargeError) Error() string {
+	return fmt.Sprintf("blob of %d octets exceeds the maximum upload size of %d octets", e.Size, e.MaxSize)
+}
+
+func (e *UploadTooLargeError) Is(target error) bool {
+	return target == ErrTooLarge
+}
+
+// UploadWithOptions is like UploadWithContext, with a media type, size and
+// progress callback given by opts, which may be nil.
+//
+// If the size of the blob is known and exceeds the maxSizeUpload limit of the
+// server, an *UploadTooLargeError is returned before anything is sent. If the
+// size is unknown, the upload is aborted with the same error as soon as more
+// than maxSizeUpload octets have been read from the blob.
+//
+// Servers which offer the blob capability can also create a blob from text,
+// base64 data and ranges of other blobs: see UploadData in package core/blob
+func (c *Client) UploadWithOptions(ctx context.Context, accountID ID, blob io.Reader, opts *UploadOptions) (*UploadResponse, error) {
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+	session, err := c.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	size := opts.Size
+	if l, ok := blob.(interface{ Len() int }); ok && size == 0 {
+		size = uint64(l.Len())
+	}
+	maxSize := session.limits().MaxSizeUpload
+	if maxSize > 0 && size > maxSize {
+		return nil, &UploadTooLargeError{Size: size, MaxSize: maxSize}
+	}
+
+	if err := c.uploads.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer c.uploads.release()
+
+	url, err := expandURL(session.UploadURL, map[string]string{
+		"accountId": string(accountID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, blob)
+	if err != nil {
+		return nil, err
+	}
+	mediaType := opts.Type
+	if mediaType == "" {
+		mediaType = "application/octet-stream"
+	}
+	req.Header.Set("Content-Type", mediaType)
+	if size > 0 {
+		req.ContentLength = int64(size)
+	}
+	if seeker, ok := blob.(io.Seeker); ok && req.GetBody == nil {
+		// Rewind the blob to replay it when retrying
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			req.GetBody = func() (io.ReadCloser, error) {
+				if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+					return nil, err
+				}
+				return io.NopCloser(blob), nil
+			}
+		}
+	}
+
+	// Count the octets sent, to report progress and enforce the limit
+	wrap := func(body io.ReadCloser) io.ReadCloser {
+		return &uploadBody{
+			ReadCloser: body,
+			size:       size,
+			maxSize:    maxSize,
+			progress:   opts.Progress,
+		}
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = wrap(req.Body)
+	}
+	if getBody := req.GetBody; getBody != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+			if err != nil || body == http.NoBody {
+				return body, err
+			}
+			return wrap(body), nil
+		}
+	}
+
+	resp, err := c.send(req, true)
+	if err != nil {
+		var tooLarge *UploadTooLargeError
+		if errors.As(err, &tooLarge) {
+			return nil, tooLarge
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, decodeHttpError(resp)
+	}
+
+	info := &UploadResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// uploadBody counts the octets read from the body of an upload, reporting
+// progress and failing once more than maxSize octets have been read
+type uploadBody struct {
+	io.ReadCloser
+	sent     uint64
+	size     uint64
+	maxSize  uint64
+	progress func(sent uint64, size uint64)
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n == 0 {
+		return n, err
+	}
+	b.sent += uint64(n)
+	if b.maxSize > 0 && b.sent > b.maxSize {
+		return n, &UploadTooLargeError{Size: b.sent, MaxSize: b.maxSize}
+	}
+	if b.progress != nil {
+		b.progress(b.sent, b.size)
+	}
+	return n, err
+}
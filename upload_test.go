@@ -0,0 +1,84 @@
+package jmap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientUploadWithOptions(t *testing.T) {
+	assert := assert.New(t)
+	ts := newTestServer(t)
+	ts.session["capabilities"].(map[string]interface{})["urn:ietf:params:jmap:core"] = map[string]interface{}{
+		"maxSizeUpload": 1 << 20,
+	}
+	client := ts.client()
+	ctx := context.Background()
+
+	blob := bytes.Repeat([]byte("x"), 100*1024)
+	var sent, size uint64
+	calls := 0
+	info, err := client.UploadWithOptions(ctx, "A1", bytes.NewReader(blob), &UploadOptions{
+		Type: "image/png",
+		Progress: func(s uint64, total uint64) {
+			assert.Greater(s, sent)
+			sent, size = s, total
+			calls += 1
+		},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("image/png", info.Type)
+	assert.Equal(uint64(len(blob)), info.Size)
+	assert.Equal(uint64(len(blob)), sent)
+	assert.Equal(uint64(len(blob)), size)
+	assert.Greater(calls, 0)
+
+	// The default type
+	info, err = client.Upload("A1", strings.NewReader("hello"))
+	if assert.NoError(err) {
+		assert.Equal("application/octet-stream", info.Type)
+	}
+}
+
+func TestClientUploadTooLarge(t *testing.T) {
+	assert := assert.New(t)
+	ts := newTestServer(t)
+	ts.session["capabilities"].(map[string]interface{})["urn:ietf:params:jmap:core"] = map[string]interface{}{
+		"maxSizeUpload": 10,
+	}
+	client := ts.client()
+	assert.NoError(client.Authenticate())
+	ctx := context.Background()
+
+	// Known sizes are rejected before the upload is made
+	_, err := client.UploadWithOptions(ctx, "A1", bytes.NewReader(make([]byte, 11)), nil)
+	tooLarge := &UploadTooLargeError{}
+	if assert.True(errors.As(err, &tooLarge)) {
+		assert.Equal(uint64(11), tooLarge.Size)
+		assert.Equal(uint64(10), tooLarge.MaxSize)
+	}
+	assert.True(errors.Is(err, ErrTooLarge))
+	_, err = client.UploadWithOptions(ctx, "A1", io.MultiReader(strings.NewReader("hello")), &UploadOptions{Size: 20})
+	assert.True(errors.Is(err, ErrTooLarge))
+	ts.mu.Lock()
+	assert.Equal(0, ts.attempts)
+	ts.mu.Unlock()
+
+	// Unknown sizes fail once the limit is exceeded
+	blob := io.MultiReader(strings.NewReader("hello "), strings.NewReader("world"))
+	_, err = client.UploadWithOptions(ctx, "A1", blob, nil)
+	assert.True(errors.As(err, &tooLarge))
+
+	// Blobs within the limit are uploaded
+	info, err := client.UploadWithOptions(ctx, "A1", io.MultiReader(strings.NewReader("hello")), nil)
+	if assert.NoError(err) {
+		assert.Equal(uint64(5), info.Size)
+	}
+}
@@ -0,0 +1,348 @@
+// Package websocket implements the JMAP Subprotocol for WebSocket as defined in
+// RFC 8887.
+//
+// Documentation strings for most of the protocol objects are taken from (or
+// based on) contents of RFC 8887 and is subject to the IETF Trust Provisions.
+// See https://trustee.ietf.org/license-info for details.
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"git.sr.ht/~rockorager/go-jmap"
+	"github.com/coder/websocket"
+)
+
+// urn:ietf:params:jmap:websocket represents support for the JMAP Subprotocol
+// for WebSocket
+const URI jmap.URI = "urn:ietf:params:jmap:websocket"
+
+// The WebSocket subprotocol name to negotiate during the handshake
+const subprotocol = "jmap"
+
+func init() {
+	jmap.RegisterCapability(&WebSocket{})
+}
+
+type WebSocket struct {
+	// The wss-URI (see Section 3 of RFC 6455) to use for initiating a JMAP
+	// over WebSocket handshake (the "WebSocket URL endpoint" colloquially).
+	URL string `json:"url"`
+
+	// This is true if the server supports push notifications over the
+	// WebSocket, as described in Section 4.3.5 of RFC 8887.
+	SupportsPush bool `json:"supportsPush"`
+}
+
+func (w *WebSocket) URI() jmap.URI { return URI }
+
+func (w *WebSocket) New() jmap.Capability { return &WebSocket{} }
+
+// A JMAP over WebSocket connection. Requests sent with Do are matched to
+// their responses by request ID, so any number of requests may be in flight
+// on the same connection at once.
+type Conn struct {
+	// The JMAP client the connection was dialed with
+	Client *jmap.Client
+
+	ws *websocket.Conn
+
+	// The Capability of the server the connection was made to
+	capability *WebSocket
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[string]chan *result
+	handler func(*jmap.StateChange)
+	err     error
+
+	// closed when the read loop exits
+	done chan struct{}
+}
+
+// The outcome of a request: either a Response or a RequestError
+type result struct {
+	resp *jmap.Response
+	err  error
+}
+
+// A Request object, as sent over the WebSocket
+type request struct {
+	Type string `json:"@type"`
+	ID   string `json:"id"`
+	*jmap.Request
+}
+
+// A WebSocketPushEnable object, sent to enable push notifications
+type pushEnable struct {
+	Type      string           `json:"@type"`
+	DataTypes []jmap.EventType `json:"dataTypes"`
+	PushState string           `json:"pushState,omitempty"`
+}
+
+// A WebSocketPushDisable object, sent to disable push notifications
+type pushDisable struct {
+	Type string `json:"@type"`
+}
+
+// The @type and request ID of an incoming message. This is decoded first to
+// determine how to decode the rest of the message
+type header struct {
+	Type      string `json:"@type"`
+	RequestID string `json:"requestId"`
+}
+
+// Dial opens a WebSocket connection to the URL advertised in the Session of
+// the client. The client will be authenticated first if it doesn't yet have a
+// Session, unless one is stored in its SessionStore. The HttpClient of the
+// client is used for the opening handshake, so it carries the same
+// authentication as any other request.
+func Dial(ctx context.Context, client *jmap.Client) (*Conn, error) {
+	if _, err := client.EnsureSession(ctx); err != nil {
+		return nil, err
+	}
+	client.Lock()
+	capability, ok := client.Session.Capabilities[URI].(*WebSocket)
+	client.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("server doesn't support required capability '%s'", URI)
+	}
+
+	ws, resp, err := websocket.Dial(ctx, capability.URL, &websocket.DialOptions{
+		HTTPClient:   client.HttpClient,
+		Subprotocols: []string{subprotocol},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp != nil && resp.Body != nil {
+		resp.Body.Close()
+	}
+	if ws.Subprotocol() != subprotocol {
+		ws.Close(websocket.StatusProtocolError, "jmap subprotocol not negotiated")
+		return nil, fmt.Errorf("server did not negotiate the '%s' subprotocol", subprotocol)
+	}
+	// Responses are only limited in size by the server
+	ws.SetReadLimit(-1)
+
+	c := &Conn{
+		Client:     client,
+		ws:         ws,
+		capability: capability,
+		pending:    make(map[string]chan *result),
+		done:       make(chan struct{}),
+	}
+	go c.read()
+	return c, nil
+}
+
+// Do performs a JMAP request over the WebSocket and returns the response. Do
+// may be called concurrently from multiple goroutines. As with jmap.Client.Do,
+// the request is passed through the Middleware of the Client first, and
+// logged to its Logger.
+func (c *Conn) Do(req *jmap.Request) (*jmap.Response, error) {
+	if req.Context == nil {
+		req.Context = context.Background()
+	}
+	c.Client.Lock()
+	middleware := c.Client.Middleware
+	if c.Client.Logger != nil {
+		middleware = append(middleware[:len(middleware):len(middleware)], jmap.LogRequests(c.Client.Logger, c.Client.RedactRules...))
+	}
+	c.Client.Unlock()
+	return jmap.Chain(c.do, middleware...)(req)
+}
+
+func (c *Conn) do(req *jmap.Request) (*jmap.Response, error) {
+	ctx := req.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextID += 1
+	id := strconv.FormatUint(c.nextID, 10)
+	ch := make(chan *result, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	data, err := json.Marshal(&request{
+		Type:    "Request",
+		ID:      id,
+		Request: req,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.ws.Write(ctx, websocket.MessageText, data); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-ch:
+		if res.resp != nil {
+			c.Client.CheckSessionState(res.resp.SessionState)
+		}
+		return res.resp, res.err
+	case <-c.done:
+		return nil, c.closeErr()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// EnablePush enables push notifications on the connection. StateChange objects
+// received from the server will be passed to handler, which is called from the
+// goroutine reading the connection: no other messages are read until it
+// returns, so it must not wait on a call to Do. The events to subscribe to may be left
+// empty to subscribe to all events. If pushState is not empty, the server will
+// send any changes that have occurred since that state was issued (see the
+// PushState field of StateChange).
+//
+// Calling EnablePush again replaces the previous subscription
+func (c *Conn) EnablePush(ctx context.Context, handler func(*jmap.StateChange), events []jmap.EventType, pushState string) error {
+	if !c.capability.SupportsPush {
+		return fmt.Errorf("server doesn't support push notifications over WebSocket")
+	}
+	var dataTypes []jmap.EventType
+	for _, e := range events {
+		if e == jmap.AllEvents {
+			// A null dataTypes subscribes to all events
+			dataTypes = nil
+			break
+		}
+		dataTypes = append(dataTypes, e)
+	}
+	data, err := json.Marshal(&pushEnable{
+		Type:      "WebSocketPushEnable",
+		DataTypes: dataTypes,
+		PushState: pushState,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.handler = handler
+	c.mu.Unlock()
+	return c.ws.Write(ctx, websocket.MessageText, data)
+}
+
+// DisablePush disables push notifications on the connection
+func (c *Conn) DisablePush(ctx context.Context) error {
+	data, err := json.Marshal(&pushDisable{
+		Type: "WebSocketPushDisable",
+	})
+	if err != nil {
+		return err
+	}
+	err = c.ws.Write(ctx, websocket.MessageText, data)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.handler = nil
+	c.mu.Unlock()
+	return nil
+}
+
+// Close closes the connection. Any requests still in flight will return an
+// error
+func (c *Conn) Close() error {
+	return c.ws.Close(websocket.StatusNormalClosure, "")
+}
+
+// read reads messages until the connection is closed, dispatching each one
+func (c *Conn) read() {
+	defer close(c.done)
+	for {
+		_, data, err := c.ws.Read(context.Background())
+		if err != nil {
+			c.mu.Lock()
+			c.err = fmt.Errorf("jmap/websocket: connection closed: %w", err)
+			c.mu.Unlock()
+			return
+		}
+		if err := c.dispatch(data); err != nil {
+			c.mu.Lock()
+			c.err = err
+			c.mu.Unlock()
+			c.ws.Close(websocket.StatusUnsupportedData, "invalid message")
+			return
+		}
+	}
+}
+
+// dispatch decodes a single message and routes it to whoever is waiting on it
+func (c *Conn) dispatch(data []byte) error {
+	hdr := &header{}
+	if err := json.Unmarshal(data, hdr); err != nil {
+		return err
+	}
+
+	res := &result{}
+	switch hdr.Type {
+	case "Response":
+		resp := &jmap.Response{}
+		if err := c.Client.Registry.UnmarshalResponse(data, resp); err != nil {
+			return err
+		}
+		res.resp = resp
+	case "RequestError":
+		reqErr := &jmap.RequestError{}
+		if err := json.Unmarshal(data, reqErr); err != nil {
+			return err
+		}
+		res.err = reqErr
+	case "StateChange":
+		state := &jmap.StateChange{}
+		if err := json.Unmarshal(data, state); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		handler := c.handler
+		c.mu.Unlock()
+		if handler != nil {
+			handler(state)
+		}
+		return nil
+	default:
+		// Unknown message types are ignored
+		return nil
+	}
+
+	c.mu.Lock()
+	ch, ok := c.pending[hdr.RequestID]
+	c.mu.Unlock()
+	if !ok {
+		// The request may have been abandoned (context cancelled), or
+		// the server didn't echo the request ID. Either way, there is
+		// nobody to hand the result to
+		return nil
+	}
+	ch <- res
+	return nil
+}
+
+func (c *Conn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		return fmt.Errorf("jmap/websocket: connection closed")
+	}
+	return c.err
+}
@@ -0,0 +1,155 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"git.sr.ht/~rockorager/go-jmap"
+	"git.sr.ht/~rockorager/go-jmap/core"
+	"github.com/coder/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestServer starts a WebSocket server which hands each decoded message to
+// handler
+func newTestServer(t *testing.T, handler func(ctx context.Context, ws *websocket.Conn, msg map[string]json.RawMessage)) *jmap.Client {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			Subprotocols: []string{"jmap"},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer ws.CloseNow()
+		ctx := context.Background()
+		for {
+			_, data, err := ws.Read(ctx)
+			if err != nil {
+				return
+			}
+			msg := map[string]json.RawMessage{}
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Error(err)
+				return
+			}
+			handler(ctx, ws, msg)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return &jmap.Client{
+		HttpClient: srv.Client(),
+		Session: &jmap.Session{
+			Capabilities: map[jmap.URI]jmap.Capability{
+				core.URI: &core.Core{},
+				URI: &WebSocket{
+					URL: "ws" + strings.TrimPrefix(srv.URL, "http"),
+				},
+			},
+		},
+	}
+}
+
+func TestDo(t *testing.T) {
+	assert := assert.New(t)
+
+	// Hold the first request until the second arrives, then answer them
+	// in reverse order
+	var held []map[string]json.RawMessage
+	client := newTestServer(t, func(ctx context.Context, ws *websocket.Conn, msg map[string]json.RawMessage) {
+		assert.Equal(`"Request"`, string(msg["@type"]))
+		held = append(held, msg)
+		if len(held) < 2 {
+			return
+		}
+		for i := len(held) - 1; i >= 0; i-- {
+			resp := `{"@type":"Response","requestId":` + string(held[i]["id"]) +
+				`,"methodResponses":` + string(held[i]["methodCalls"]) +
+				`,"sessionState":"state"}`
+			ws.Write(ctx, websocket.MessageText, []byte(resp))
+		}
+		held = nil
+	})
+
+	conn, err := Dial(context.Background(), client)
+	if !assert.NoError(err) {
+		return
+	}
+	defer conn.Close()
+
+	wg := sync.WaitGroup{}
+	for _, hello := range []string{"one", "two"} {
+		wg.Add(1)
+		go func(hello string) {
+			defer wg.Done()
+			req := &jmap.Request{}
+			req.Invoke(&core.Echo{Hello: hello})
+			resp, err := conn.Do(req)
+			if !assert.NoError(err) {
+				return
+			}
+			assert.Equal("state", resp.SessionState)
+			echo, ok := resp.Responses[0].Args.(*core.Echo)
+			assert.Truef(ok, "invocation arguments are not type *core.Echo")
+			assert.Equal(hello, echo.Hello)
+		}(hello)
+	}
+	wg.Wait()
+}
+
+func TestDoRequestError(t *testing.T) {
+	assert := assert.New(t)
+	client := newTestServer(t, func(ctx context.Context, ws *websocket.Conn, msg map[string]json.RawMessage) {
+		resp := `{"@type":"RequestError","requestId":` + string(msg["id"]) +
+			`,"type":"urn:ietf:params:jmap:error:notRequest","status":400,"detail":"bad"}`
+		ws.Write(ctx, websocket.MessageText, []byte(resp))
+	})
+
+	conn, err := Dial(context.Background(), client)
+	if !assert.NoError(err) {
+		return
+	}
+	defer conn.Close()
+
+	req := &jmap.Request{}
+	req.Invoke(&core.Echo{Hello: "world"})
+	_, err = conn.Do(req)
+	reqErr, ok := err.(*jmap.RequestError)
+	if assert.Truef(ok, "error is not type *jmap.RequestError") {
+		assert.Equal("urn:ietf:params:jmap:error:notRequest", reqErr.Type)
+	}
+}
+
+func TestEnablePush(t *testing.T) {
+	assert := assert.New(t)
+	client := newTestServer(t, func(ctx context.Context, ws *websocket.Conn, msg map[string]json.RawMessage) {
+		assert.Equal(`"WebSocketPushEnable"`, string(msg["@type"]))
+		assert.Equal(`["Mailbox"]`, string(msg["dataTypes"]))
+		assert.Equal(`"old"`, string(msg["pushState"]))
+		change := `{"@type":"StateChange","changed":{"A1":{"Mailbox":"m2"}},"pushState":"new"}`
+		ws.Write(ctx, websocket.MessageText, []byte(change))
+	})
+	client.Session.Capabilities[URI].(*WebSocket).SupportsPush = true
+
+	conn, err := Dial(context.Background(), client)
+	if !assert.NoError(err) {
+		return
+	}
+	defer conn.Close()
+
+	changes := make(chan *jmap.StateChange, 1)
+	err = conn.EnablePush(context.Background(), func(change *jmap.StateChange) {
+		changes <- change
+	}, []jmap.EventType{"Mailbox"}, "old")
+	assert.NoError(err)
+
+	change := <-changes
+	assert.Equal("new", change.PushState)
+	assert.Equal("m2", change.Changed["A1"]["Mailbox"])
+}